@@ -2,9 +2,11 @@ package minhq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/hc"
@@ -22,17 +24,23 @@ type ClientConnection struct {
 	maxPushID uint64
 	pushLock  sync.Mutex
 	promises  map[uint64]*PushPromise
+
+	// requests holds requests that haven't completed, by stream ID.
+	requestsLock sync.Mutex
+	requests     map[uint64]*ClientRequest
 }
 
 // NewClientConnection wraps an instance of minq.Connection.
 func NewClientConnection(mwc *mw.Connection, config *Config) *ClientConnection {
 	return &ClientConnection{
 		connection: connection{
-			config:     config,
-			Connection: *mwc,
-			ready:      make(chan struct{}),
+			config:         config,
+			Connection:     *mwc,
+			ready:          make(chan struct{}),
+			goAwayReceived: make(chan struct{}),
 		},
 		promises: make(map[uint64]*PushPromise),
+		requests: make(map[uint64]*ClientRequest),
 	}
 }
 
@@ -70,24 +78,97 @@ func (c *ClientConnection) HandleFrame(t FrameType, r FrameReader) error {
 	}
 }
 
-// Fetch makes a request.
-func (c *ClientConnection) Fetch(method string, target string, headers ...hc.HeaderField) (*ClientRequest, error) {
+// pendingRequest is a request that has been prepared, but not yet sent.
+type pendingRequest struct {
+	req      *ClientRequest
+	s        *stream
+	response chan *ClientResponse
+}
+
+// start sends the header block and starts reading the response.
+func (pr *pendingRequest) start(c *ClientConnection, block []byte) error {
+	err := headersFrameWriter{pr.req.s}.WriteHeaderFrame(block)
+	if err != nil {
+		return err
+	}
+	c.addRequest(pr.req)
+	if pr.req.continued != nil {
+		// Don't wait forever for a server that ignores the expectation.
+		time.AfterFunc(c.config.expectContinueTimeout(), pr.req.signalContinue)
+	}
+	go pr.req.readResponse(pr.s, c, pr.response)
+	return nil
+}
+
+// cancel aborts a request that wasn't started.  The encoder might have written
+// a header block for the stream, so release any references that it holds.
+func (pr *pendingRequest) cancel(c *ClientConnection) {
+	pr.s.abort()
+	_ = c.encoder.AcknowledgeReset(pr.s.Id())
+}
+
+func (c *ClientConnection) addRequest(req *ClientRequest) {
+	defer c.requestsLock.Unlock()
+	c.requestsLock.Lock()
+	c.requests[req.stream.Id()] = req
+	c.idle.add()
+}
+
+func (c *ClientConnection) removeRequest(req *ClientRequest) {
+	defer c.requestsLock.Unlock()
+	c.requestsLock.Lock()
+	delete(c.requests, req.stream.Id())
+	c.idle.done()
+}
+
+// AbortAll aborts every request that hasn't completed.  The streams
+// for those requests are reset and stopped using `code`, and the decoder
+// releases anything that those streams reference.  Response() returns nil for
+// any request that was aborted.
+func (c *ClientConnection) AbortAll(code HTTPError) {
+	c.requestsLock.Lock()
+	requests := make([]*ClientRequest, 0, len(c.requests))
+	for id, req := range c.requests {
+		requests = append(requests, req)
+		delete(c.requests, id)
+	}
+	c.requestsLock.Unlock()
+
+	for _, req := range requests {
+		req.abort(c, code)
+	}
+}
+
+// prepareRequest validates the request, builds header fields and allocates a
+// stream for the request.
+func (c *ClientConnection) prepareRequest(ctx context.Context, method string, target string,
+	headers []hc.HeaderField) (*pendingRequest, error) {
 	err := hc.ValidatePseudoHeaders(headers)
 	if err != nil {
 		return nil, err
 	}
 
-	<-c.ready
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	if c.GetState() != minq.StateEstablished {
 		return nil, errors.New("connection not open")
 	}
+	if c.peerGoingAway() {
+		return nil, ErrGoingAway
+	}
 
 	url, allHeaders, err := buildRequestHeaderFields(method, nil, target, headers)
 	if err != nil {
 		return nil, err
 	}
 
-	s := newStream(c.CreateStream())
+	s := newStream(c.CreateStream(), c.Closed())
 	if s == nil {
 		return nil, ErrStreamBlocked
 	}
@@ -107,15 +188,121 @@ func (c *ClientConnection) Fetch(method string, target string, headers ...hc.Hea
 		pushes:                 pushes,
 		InformationalResponses: informational,
 		informationalResponses: informational,
+		stream:                 s,
+		aborted:                make(chan struct{}),
+		done:                   make(chan struct{}),
+	}
+	if expectsContinue(allHeaders) {
+		req.continued = make(chan struct{})
+	}
+	return &pendingRequest{req, s, responseChannel}, nil
+}
+
+// Fetch makes a request.  If the header fields include `Expect: 100-continue`,
+// writing the request body waits until the server sends a 100 (Continue) or
+// final response, or until Config.ExpectContinueTimeout passes.
+func (c *ClientConnection) Fetch(method string, target string, headers ...hc.HeaderField) (*ClientRequest, error) {
+	return c.FetchContext(context.Background(), method, target, headers...)
+}
+
+// FetchContext makes a request, like Fetch.  If `ctx` is done before the
+// connection is ready, this returns the error from the context.  If `ctx` is
+// done while the request is in progress, the request is aborted:
+// Response() returns nil and Err() returns the error from the context.
+func (c *ClientConnection) FetchContext(ctx context.Context, method string, target string,
+	headers ...hc.HeaderField) (*ClientRequest, error) {
+	pr, err := c.prepareRequest(ctx, method, target, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	var headerBuf bytes.Buffer
+	err = c.encoder.WriteHeaderBlock(&headerBuf, pr.s.Id(), pr.req.headers...)
+	if err != nil {
+		pr.cancel(c)
+		return nil, err
+	}
+	err = pr.start(c, headerBuf.Bytes())
+	if err != nil {
+		pr.cancel(c)
+		return nil, err
+	}
+	if ctx.Done() != nil {
+		go func(req *ClientRequest) {
+			select {
+			case <-ctx.Done():
+				// Both can be ready at once; a finished request stays finished.
+				select {
+				case <-req.done:
+				default:
+					req.abortWithError(c, ErrHttpRequestCancelled, ctx.Err())
+				}
+			case <-req.done:
+			}
+		}(pr.req)
+	}
+	return pr.req, nil
+}
+
+// RequestSpec describes a request for FetchAll.
+type RequestSpec struct {
+	Method  string
+	Target  string
+	Headers []hc.HeaderField
+}
+
+// FetchAll makes several requests at once.  The header blocks for all of the
+// requests are encoded together, which is more efficient than calling Fetch
+// repeatedly.  If any request can't be made, this returns an error and every
+// request is aborted, including any that were already sent.
+func (c *ClientConnection) FetchAll(specs ...RequestSpec) ([]*ClientRequest, error) {
+	pending := make([]*pendingRequest, 0, len(specs))
+	// abort aborts the requests that were started, which are the first
+	// `started` of them, and cancels the rest.
+	abort := func(started int) {
+		for i, pr := range pending {
+			if i < started {
+				pr.req.abort(c, ErrHttpRequestCancelled)
+			} else {
+				pr.cancel(c)
+			}
+		}
+	}
+	blocks := make([]hc.HeaderBlock, len(specs))
+	for i, spec := range specs {
+		pr, err := c.prepareRequest(context.Background(), spec.Method, spec.Target, spec.Headers)
+		if err != nil {
+			abort(0)
+			return nil, err
+		}
+		pending = append(pending, pr)
+		blocks[i] = hc.HeaderBlock{ID: pr.s.Id(), Headers: pr.req.headers}
 	}
 
-	err = req.writeHeaderBlock(allHeaders)
+	encoded, err := c.encoder.WriteHeaderBlocks(blocks...)
 	if err != nil {
+		abort(0)
 		return nil, err
 	}
 
-	go req.readResponse(s, c, responseChannel)
-	return req, nil
+	requests := make([]*ClientRequest, len(pending))
+	for i, pr := range pending {
+		err = pr.start(c, encoded[i])
+		if err != nil {
+			abort(i)
+			return nil, err
+		}
+		requests[i] = pr.req
+	}
+	return requests, nil
+}
+
+// Unprocessed returns true if the server sent GOAWAY and the request has a
+// higher stream ID than GOAWAY carried.  The server didn't process the
+// request, so it can be retried on another connection.
+func (c *ClientConnection) Unprocessed(req *ClientRequest) bool {
+	id, ok := c.GoAwayID()
+	return ok && req.stream.Id() > id
 }
 
 func (c *ClientConnection) getPushPromise(pushID uint64) *PushPromise {
@@ -123,7 +310,7 @@ func (c *ClientConnection) getPushPromise(pushID uint64) *PushPromise {
 	c.pushLock.Lock()
 	promise := c.promises[pushID]
 	if promise == nil {
-		promise = &PushPromise{pushID: pushID, responseChannel: make(chan *ClientResponse)}
+		promise = &PushPromise{c: c, pushID: pushID, responseChannel: make(chan *ClientResponse)}
 		c.promises[pushID] = promise
 	}
 	return promise
@@ -132,8 +319,16 @@ func (c *ClientConnection) getPushPromise(pushID uint64) *PushPromise {
 func (c *ClientConnection) handlePushStream(s *recvStream) error {
 	pushID, err := s.ReadVarint()
 	if err != nil {
-		return err
+		// A push stream without a valid push ID is treated as a stream of an
+		// unknown type, which only affects this stream.
+		return s.StopSending(uint16(ErrHttpUnknownStreamType))
+	}
+	if !c.accept(pushID) {
+		// This arrived after GOAWAY was sent.
+		return s.StopSending(uint16(ErrHttpRequestCancelled))
 	}
+	c.idle.add()
+	defer c.idle.done()
 
 	promise := c.getPushPromise(pushID)
 	if promise.isFulfilled() {
@@ -145,7 +340,7 @@ func (c *ClientConnection) handlePushStream(s *recvStream) error {
 		IncomingMessage: newIncomingMessage(s, c.connection.decoder, nil),
 	}
 
-	err = resp.handleMessage(func(headers headerFieldArray) (bool, error) {
+	err = resp.handleMessage(hc.ValidateResponse, func(headers headerFieldArray) (bool, error) {
 		resp.setHeaders(headers)
 		switch headers.GetStatus() / 100 {
 		case 0:
@@ -162,7 +357,8 @@ func (c *ClientConnection) handlePushStream(s *recvStream) error {
 	}, func(t FrameType, r io.Reader) error {
 		return ErrUnsupportedFrame
 	})
-	if err != nil {
+	// A push that was cancelled with StopSending is finished too.
+	if err != nil && err != ErrStreamStopped {
 		return err
 	}
 	c.creditPushes(1)
@@ -186,6 +382,6 @@ func (c *ClientConnection) creditPushes(incr uint64) error {
 	var buf bytes.Buffer
 	w := NewFrameWriter(&buf)
 	w.WriteVarint(c.maxPushID)
-	_, err := c.controlStream.WriteFrame(frameMaxPushID, buf.Bytes())
+	_, err := c.writeControlFrame(frameMaxPushID, buf.Bytes())
 	return err
 }
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/martinthomson/minhq/hc"
@@ -13,6 +14,10 @@ import (
 // ErrInvalidPushPromise occurs if a push promise isn't well formed.
 var ErrInvalidPushPromise = errors.New("invalid push promise")
 
+// ErrRequestAborted is reported by ClientRequest.Err after the request is
+// aborted.
+var ErrRequestAborted = errors.New("request aborted")
+
 type requestID struct {
 	id    uint64
 	index int
@@ -64,10 +69,51 @@ type ClientRequest struct {
 	Pushes <-chan *PushPromise
 	pushes chan<- *PushPromise
 
-	// InformationalResponses is originally nil.  Assign to this if you intend to
-	// consume informational (1xx) responses.
+	// InformationalResponses delivers informational (1xx) responses, in the
+	// order they arrive.  This is nil unless Config.InformationalResponses is
+	// set, in which case it needs to be read, or the final response won't be
+	// delivered.  It is closed before the final response is delivered, or
+	// when the response fails.
 	InformationalResponses <-chan *InformationalResponse
 	informationalResponses chan<- *InformationalResponse
+
+	// continued is closed when the request body can be sent.  This is only
+	// set if the request includes `Expect: 100-continue`.
+	continued    chan struct{}
+	continueOnce sync.Once
+
+	stream *stream
+	// aborted is closed if the request is aborted.  abortErr is the error
+	// that Err returns after that.
+	aborted   chan struct{}
+	abortOnce sync.Once
+	abortErr  error
+	// done is closed when the response is complete, or when reading the
+	// response fails.
+	done chan struct{}
+}
+
+// expectsContinue returns true if the header fields include
+// `Expect: 100-continue`.
+func expectsContinue(headers headerFieldArray) bool {
+	return strings.EqualFold(headers.GetHeader("expect"), "100-continue")
+}
+
+// signalContinue allows the request body to be sent.
+func (req *ClientRequest) signalContinue() {
+	if req.continued != nil {
+		req.continueOnce.Do(func() { close(req.continued) })
+	}
+}
+
+// Write sends request body.  If the request included `Expect: 100-continue`,
+// this waits for a 100 (Continue) response, the final response, or
+// Config.ExpectContinueTimeout to pass, before sending anything.
+func (req *ClientRequest) Write(p []byte) (int, error) {
+	if req.continued != nil {
+		<-req.continued
+	}
+	return req.OutgoingMessage.Write(p)
 }
 
 // Method returns the obvious thing.
@@ -80,9 +126,58 @@ func (req *ClientRequest) Target() *url.URL {
 	return req.target
 }
 
-// Response awaits the response and returns it.
+// Response awaits the response and returns it.  This returns nil if the
+// request is aborted before the response arrives.
 func (req *ClientRequest) Response() *ClientResponse {
-	return <-req.response
+	select {
+	case resp := <-req.response:
+		return resp
+	case <-req.aborted:
+		return nil
+	}
+}
+
+// Err returns an error if the request was aborted, or nil otherwise.  This is
+// ErrRequestAborted, unless the request was aborted because the context passed
+// to FetchContext was done, in which case it is the error from the context,
+// or because reading the response failed, in which case it is the error from
+// reading.
+func (req *ClientRequest) Err() error {
+	select {
+	case <-req.aborted:
+		return req.abortErr
+	default:
+		return nil
+	}
+}
+
+// abort resets the request stream and stops reading the response.
+func (req *ClientRequest) abort(c *ClientConnection, code HTTPError) {
+	req.abortWithError(c, code, ErrRequestAborted)
+}
+
+// abortWithError aborts the request, setting the error that Err returns.
+func (req *ClientRequest) abortWithError(c *ClientConnection, code HTTPError, err error) {
+	if req.stop(code, err) {
+		c.connection.decoder.Cancelled(req.stream.Id())
+	}
+}
+
+// stop resets the request stream and stops reading the response.  This returns
+// true if the request wasn't already aborted.  Unlike abortWithError, this
+// doesn't tell the decoder, which is what readResponse needs, because
+// handleMessage does that when reading fails.
+func (req *ClientRequest) stop(code HTTPError, err error) bool {
+	stopped := false
+	req.abortOnce.Do(func() {
+		req.abortErr = err
+		close(req.aborted)
+		req.signalContinue()
+		req.stream.Reset(uint16(code))
+		req.stream.StopSending(uint16(code))
+		stopped = true
+	})
+	return stopped
 }
 
 func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io.Reader) error {
@@ -92,11 +187,7 @@ func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io
 		return err
 	}
 
-	headers, err := c.connection.decoder.ReadHeaderBlock(fr, s.Id())
-	if err != nil {
-		return err
-	}
-	err = hc.ValidatePseudoHeaders(headers)
+	headers, err := c.connection.decoder.ReadHeaderBlockValidated(fr, s.Id(), hc.ValidateRequest)
 	if err != nil {
 		return err
 	}
@@ -106,6 +197,10 @@ func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io
 	}
 
 	pp := c.getPushPromise(pushID)
+	if !c.accept(pushID) {
+		// This was promised after GOAWAY was sent.
+		return pp.Cancel()
+	}
 	err = pp.setHeaders(headers)
 	if err != nil {
 		return err
@@ -115,24 +210,51 @@ func (req *ClientRequest) handlePushPromise(s *stream, c *ClientConnection, r io
 	return nil
 }
 
+// endInformational closes the channel for informational responses.  Only the
+// goroutine that reads the response calls this, so it doesn't need a lock.
+func (req *ClientRequest) endInformational() {
+	if req.informationalResponses != nil {
+		close(req.informationalResponses)
+		req.informationalResponses = nil
+	}
+}
+
 func (req *ClientRequest) readResponse(s *stream, c *ClientConnection,
 	responseChannel chan<- *ClientResponse) {
+	defer close(req.done)
+	defer c.removeRequest(req)
+	// Don't leave a request body waiting if the response fails.
+	defer req.signalContinue()
+	defer req.endInformational()
 	resp := &ClientResponse{
 		Request:         req,
 		IncomingMessage: newIncomingMessage(&s.recvStream, c.connection.decoder, nil),
 	}
-	err := resp.handleMessage(func(headers headerFieldArray) (bool, error) {
+	resp.headRequest = req.method == "HEAD"
+	err := resp.handleMessage(hc.ValidateResponse, func(headers headerFieldArray) (bool, error) {
 		resp.setHeaders(headers)
 		switch headers.GetStatus() / 100 {
 		case 0:
 			return false, errors.New("invalid or missing status")
 		case 1:
+			if headers.GetStatus() == 100 {
+				req.signalContinue()
+			}
 			if req.informationalResponses != nil {
-				req.informationalResponses <- &InformationalResponse{headers.GetStatus(), headers}
+				select {
+				case req.informationalResponses <- &InformationalResponse{headers.GetStatus(), headers}:
+				case <-req.aborted:
+				}
 			}
 			return false, nil
 		default:
-			responseChannel <- resp
+			// A final response means that the body is sent regardless.
+			req.signalContinue()
+			req.endInformational()
+			select {
+			case responseChannel <- resp:
+			case <-req.aborted:
+			}
 			return true, nil
 		}
 	}, func(t FrameType, r io.Reader) error {
@@ -148,7 +270,8 @@ func (req *ClientRequest) readResponse(s *stream, c *ClientConnection,
 		return nil
 	})
 	if err != nil {
-		s.abort()
+		// This includes the server resetting the stream.
+		req.stop(ErrHttpInternalError, err)
 		return
 	}
 	close(req.pushes)
@@ -255,6 +378,6 @@ func (pp *PushPromise) Cancel() error {
 	if err != nil {
 		return err
 	}
-	_, err = pp.c.controlStream.WriteFrame(frameCancelPush, buf.Bytes())
+	_, err = pp.c.writeControlFrame(frameCancelPush, buf.Bytes())
 	return err
 }
@@ -2,9 +2,13 @@ package minhq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/hc"
@@ -16,16 +20,22 @@ type HTTPError uint16
 
 // ErrHttp* are the standard defined error codes.
 const (
-	ErrHttpStopping            = HTTPError(0x0)
-	ErrHttpNoError             = HTTPError(0x1)
-	ErrHttpPushRefused         = HTTPError(0x2)
-	ErrHttpInternalError       = HTTPError(0x3)
-	ErrHttpPushAlreadyInCache  = HTTPError(0x4)
-	ErrHttpRequestCancelled    = HTTPError(0x5)
-	ErrHttpDecompressionFailed = HTTPError(0x6)
-	ErrHttpUnknownStreamType   = HTTPError(0xd)
+	ErrHttpStopping             = HTTPError(0x0)
+	ErrHttpNoError              = HTTPError(0x1)
+	ErrHttpPushRefused          = HTTPError(0x2)
+	ErrHttpInternalError        = HTTPError(0x3)
+	ErrHttpPushAlreadyInCache   = HTTPError(0x4)
+	ErrHttpRequestCancelled     = HTTPError(0x5)
+	ErrHttpDecompressionFailed  = HTTPError(0x6)
+	ErrHttpUnknownStreamType    = HTTPError(0xd)
+	ErrHttpClosedCriticalStream = HTTPError(0xf)
 )
 
+// malformedFrame returns the HTTP_MALFORMED_FRAME error code for a frame type.
+func malformedFrame(t FrameType) HTTPError {
+	return HTTPError(0x100) | HTTPError(t)
+}
+
 func (e HTTPError) String() string {
 	switch e {
 	case ErrHttpStopping:
@@ -44,9 +54,13 @@ func (e HTTPError) String() string {
 		return "HTTP_HPACK_DECOMPRESSION_FAILED"
 	case ErrHttpUnknownStreamType:
 		return "HTTP_UNKNOWN_STREAM_TYPE"
-	default:
-		return "Too lazy to do this right now"
+	case ErrHttpClosedCriticalStream:
+		return "HTTP_CLOSED_CRITICAL_STREAM"
+	}
+	if e&0xff00 == 0x100 {
+		return "HTTP_MALFORMED_FRAME"
 	}
+	return "Too lazy to do this right now"
 }
 
 type unidirectionalStreamType byte
@@ -56,8 +70,15 @@ const (
 	unidirectionalStreamPush         = unidirectionalStreamType(0x50)
 	unidirectionalStreamQpackEncoder = unidirectionalStreamType(0x48)
 	unidirectionalStreamQpackDecoder = unidirectionalStreamType(0x68)
+	// unidirectionalStreamGrease is the first of the reserved stream types.
+	unidirectionalStreamGrease = unidirectionalStreamType(0x21)
 )
 
+// isGrease returns true for the reserved stream types, 0x1f * N + 0x21.
+func (ut unidirectionalStreamType) isGrease() bool {
+	return ut >= unidirectionalStreamGrease && (ut-unidirectionalStreamGrease)%0x1f == 0
+}
+
 func (ut unidirectionalStreamType) String() string {
 	switch ut {
 	case unidirectionalStreamControl:
@@ -69,6 +90,9 @@ func (ut unidirectionalStreamType) String() string {
 	case unidirectionalStreamQpackDecoder:
 		return "QPACK Decoder"
 	}
+	if ut.isGrease() {
+		return "GREASE"
+	}
 	return "Unknown"
 }
 
@@ -79,14 +103,32 @@ var (
 	ErrExtraData    = errors.New("Extra data at the end of a frame")
 	ErrNonZeroFlags = errors.New("Frame flags were non-zero")
 	ErrInvalidFrame = errors.New("Invalid frame type for context")
+	ErrGoingAway    = errors.New("Connection is going away")
 )
 
+// DefaultMaxDataFrameSize is the size that DATA frames are limited to if
+// Config.MaxDataFrameSize isn't set.
+const DefaultMaxDataFrameSize = 16384
+
+// DefaultExpectContinueTimeout is how long a client waits for 100 (Continue)
+// if Config.ExpectContinueTimeout isn't set.
+const DefaultExpectContinueTimeout = time.Second
+
 // Config contains connection-level configuration options, such as the intended
 // capacity of the header table.
 type Config struct {
 	DecoderTableCapacity hc.TableCapacity
+	// EncoderTableCapacity is the capacity that the encoder intends to use.
+	// This is advertised to the peer so that it can size its decoder table.
+	// The encoder won't use more than the peer's DecoderTableCapacity.  Zero
+	// means that the encoder uses whatever the peer allows.
+	EncoderTableCapacity hc.TableCapacity
 	ConcurrentDecoders   uint16
 	MaxConcurrentPushes  uint64
+	// MaxHeaderListSize is the largest header list that will be accepted.
+	// This is advertised to the peer, which won't send anything larger.  The
+	// peer's value limits what this endpoint sends.  Zero means no limit.
+	MaxHeaderListSize uint64
 	// TrackConnections determines whether a server creates a channel for new connections.
 	// If true, new connections will be written to the Server.Connections channel.
 	TrackConnections bool
@@ -94,6 +136,53 @@ type Config struct {
 	// promises that emit informational responses.  Setting this to false causes
 	// informational responses to be discarded.
 	InformationalResponses bool
+	// KeepAliveInterval is how often a GREASE frame is sent on the control
+	// stream.  HTTP/QUIC has no PING frame, so this keeps the connection active
+	// and checks that it can still be written to.  Zero disables this.
+	KeepAliveInterval time.Duration
+	// CrumbleCookies causes outgoing Cookie header fields to be split into
+	// separate fields for each cookie, which compresses better.  The peer
+	// joins them again.  To do this for some messages only, leave this unset
+	// and pass the header fields for those messages through hc.CrumbleCookies.
+	CrumbleCookies bool
+	// MaxBodySize limits the size of request bodies that a server accepts.
+	// The stream is reset with REQUEST_CANCELLED if a request body is
+	// larger, and reading the body fails with ErrBodyTooLarge.  Zero means no
+	// limit.
+	MaxBodySize int64
+	// IdleTimeout is how long a connection can be idle before it is closed.
+	// A connection is idle when there are no requests or push responses in
+	// progress and no frames are sent or received on the control stream.
+	// Zero disables this.
+	IdleTimeout time.Duration
+	// MaxDataFrameSize is the largest DATA frame that is sent.  Larger writes
+	// to a message body are split into multiple frames.  Zero means
+	// DefaultMaxDataFrameSize.
+	MaxDataFrameSize int
+	// ExpectContinueTimeout is how long a client waits for a 100 (Continue)
+	// response to a request with `Expect: 100-continue` before it sends the
+	// request body anyway.  Zero means DefaultExpectContinueTimeout.
+	ExpectContinueTimeout time.Duration
+	// PriorityObserver, if set, is called with each PRIORITY frame that is
+	// received.  This is called on the goroutine that reads the control
+	// stream, so it shouldn't block.
+	PriorityObserver func(Priority)
+}
+
+// maxDataFrameSize returns the largest DATA frame that is sent.
+func (config *Config) maxDataFrameSize() int {
+	if config.MaxDataFrameSize <= 0 {
+		return DefaultMaxDataFrameSize
+	}
+	return config.MaxDataFrameSize
+}
+
+// expectContinueTimeout returns how long a client waits for 100 (Continue).
+func (config *Config) expectContinueTimeout() time.Duration {
+	if config.ExpectContinueTimeout <= 0 {
+		return DefaultExpectContinueTimeout
+	}
+	return config.ExpectContinueTimeout
 }
 
 // connectionHandler is used by subclasses of connection to deal with frames that only they handle.
@@ -105,17 +194,45 @@ type connectionHandler interface {
 // connection is an abstract wrapper around mw.Connection (a wrapper around
 // minq.Connection in turn).
 type connection struct {
+	// keepAlives counts the keep-alive frames that were sent.  Access this
+	// atomically.  This is first so that it is aligned for atomic access.
+	keepAlives uint64
+
 	config *Config
 	mw.Connection
 
 	decoder       *hc.QpackDecoder
 	encoder       *hc.QpackEncoder
 	controlStream *sendStream
+	// controlLock ensures that frames on the control stream aren't interleaved.
+	controlLock sync.Mutex
 
 	// ready is closed when the connection is truly ready to send
 	// requests or responses.  Read from it before sending anything that
 	// depends on settings.
 	ready chan struct{}
+
+	// fatalLock protects fatalError, which records the first error passed
+	// to FatalError.
+	fatalLock  sync.Mutex
+	fatalError *HTTPError
+
+	// goAwayLock protects goingAway, lastID and peerLastID.
+	goAwayLock sync.Mutex
+	// goingAway is set once this endpoint has sent GOAWAY.
+	goingAway bool
+	// lastID is the largest ID that has been accepted from the peer.  For a
+	// server, that's a request stream ID; for a client, a push ID.
+	lastID uint64
+	// goAwayReceived is closed when the peer sends GOAWAY.
+	goAwayReceived chan struct{}
+	goAwayOnce     sync.Once
+	// peerLastID is the ID that the peer sent in GOAWAY.
+	peerLastID uint64
+
+	// idle closes the connection if it is idle for too long.  This is nil if
+	// there is no idle timeout.
+	idle *idleTimer
 }
 
 // connect ensures that the connection is ready to go. It spawns a few goroutines
@@ -134,6 +251,7 @@ func (c *connection) connect(handler connectionHandler) error {
 		return err
 	}
 	c.encoder = hc.NewQpackEncoder(encoderStream, 0, 0)
+	c.encoder.CrumbleCookies = c.config.CrumbleCookies
 
 	decoderStream := c.CreateSendStream()
 	_, err = decoderStream.Write([]byte{byte(unidirectionalStreamQpackDecoder)})
@@ -141,25 +259,287 @@ func (c *connection) connect(handler connectionHandler) error {
 		return err
 	}
 	c.decoder = hc.NewQpackDecoder(decoderStream, c.config.DecoderTableCapacity)
+	c.decoder.SetMaxBlockedStreams(int(c.config.ConcurrentDecoders))
+	c.decoder.SetMaxHeaderListSize(c.config.MaxHeaderListSize)
 
 	// Asynchronously wait for incoming streams and then spawn handlers for each.
 	// ready is used to signal that we have received settings from the other side.
+	if c.config.IdleTimeout > 0 {
+		c.idle = newIdleTimer(c.config.IdleTimeout, func() {
+			_ = c.Error(uint16(ErrHttpNoError), "idle timeout")
+		})
+		go func() {
+			<-c.Closed()
+			c.idle.stop()
+		}()
+	}
 	go c.serviceUnidirectionalStreams(handler, c.ready)
+	if c.config.KeepAliveInterval > 0 {
+		go c.keepAlive(c.config.KeepAliveInterval)
+	}
 	return nil
 }
 
+// writeControlFrame writes a frame to the control stream.
+func (c *connection) writeControlFrame(t FrameType, p []byte) (int, error) {
+	defer c.controlLock.Unlock()
+	c.controlLock.Lock()
+	c.idle.touch()
+	return c.controlStream.WriteFrame(t, p)
+}
+
+// idleTimer runs a function when there have been no requests in progress and
+// no activity for a while.  The methods on a nil idleTimer do nothing.
+type idleTimer struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	timer   *time.Timer
+	// active is the number of requests in progress.
+	active int
+	// last is when there was last any activity.
+	last time.Time
+	// stopped is set when the connection closes.
+	stopped bool
+	// expired is run when the timer expires.
+	expired func()
+}
+
+func newIdleTimer(timeout time.Duration, expired func()) *idleTimer {
+	it := &idleTimer{timeout: timeout, last: time.Now(), expired: expired}
+	it.timer = time.AfterFunc(timeout, it.check)
+	return it
+}
+
+// check runs when the timer fires.  Activity doesn't reset the timer, so
+// this restarts the timer if there was activity since it was set.
+func (it *idleTimer) check() {
+	it.lock.Lock()
+	if it.stopped || it.active > 0 {
+		it.lock.Unlock()
+		return
+	}
+	remaining := it.timeout - time.Since(it.last)
+	if remaining > 0 {
+		it.timer.Reset(remaining)
+		it.lock.Unlock()
+		return
+	}
+	it.lock.Unlock()
+	it.expired()
+}
+
+// touch records activity.
+func (it *idleTimer) touch() {
+	if it == nil {
+		return
+	}
+	defer it.lock.Unlock()
+	it.lock.Lock()
+	it.last = time.Now()
+}
+
+// add records the start of a request, which stops the timer.
+func (it *idleTimer) add() {
+	if it == nil {
+		return
+	}
+	defer it.lock.Unlock()
+	it.lock.Lock()
+	it.active++
+	it.timer.Stop()
+}
+
+// done records the end of a request, which restarts the timer if there are
+// no other requests.
+func (it *idleTimer) done() {
+	if it == nil {
+		return
+	}
+	defer it.lock.Unlock()
+	it.lock.Lock()
+	it.active--
+	it.last = time.Now()
+	if it.active == 0 && !it.stopped {
+		it.timer.Reset(it.timeout)
+	}
+}
+
+// stop stops the timer for good.  This is used when the connection closes.
+func (it *idleTimer) stop() {
+	if it == nil {
+		return
+	}
+	defer it.lock.Unlock()
+	it.lock.Lock()
+	it.stopped = true
+	it.timer.Stop()
+}
+
+// keepAlive sends an empty GREASE frame on the control stream every
+// `interval` until the connection closes or the control stream can't be
+// written.
+func (c *connection) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if c.GetState() != minq.StateEstablished {
+			return
+		}
+		_, err := c.writeControlFrame(frameGrease, nil)
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&c.keepAlives, 1)
+	}
+}
+
+// KeepAlivesSent returns the number of keep-alive frames that have been sent.
+// This stops increasing if the connection can't be written to.
+func (c *connection) KeepAlivesSent() uint64 {
+	return atomic.LoadUint64(&c.keepAlives)
+}
+
+// accept records an ID from the peer.  Once GOAWAY has been sent, only IDs
+// up to the one that it carried are accepted; requests or pushes with
+// higher IDs are rejected.  Streams can arrive out of order, so lower IDs
+// can still arrive after GOAWAY.
+func (c *connection) accept(id uint64) bool {
+	defer c.goAwayLock.Unlock()
+	c.goAwayLock.Lock()
+	if id > c.lastID {
+		if c.goingAway {
+			return false
+		}
+		c.lastID = id
+	}
+	return true
+}
+
+// GoAway sends a GOAWAY frame, which carries the last request stream ID (for
+// a server) or push ID (for a client) that will be processed.  Anything that
+// the peer starts after this is rejected, but anything already in progress
+// can finish.
+func (c *connection) GoAway() error {
+	return c.goAway(context.Background())
+}
+
+func (c *connection) goAway(ctx context.Context) error {
+	c.goAwayLock.Lock()
+	c.goingAway = true
+	id := c.lastID
+	c.goAwayLock.Unlock()
+
+	var buf bytes.Buffer
+	_, err := NewFrameWriter(&buf).WriteVarint(id)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err = c.writeControlFrame(frameGoaway, buf.Bytes())
+	return err
+}
+
+// GoAwayReceived returns a channel that is closed when the peer sends GOAWAY.
+// After that, a client can't make new requests and a server can't push.
+func (c *connection) GoAwayReceived() <-chan struct{} {
+	return c.goAwayReceived
+}
+
+// peerGoingAway returns true if the peer has sent GOAWAY.
+func (c *connection) peerGoingAway() bool {
+	select {
+	case <-c.goAwayReceived:
+		return true
+	default:
+		return false
+	}
+}
+
+// handleGoaway reads a GOAWAY frame.  Nothing new is started after this, but
+// anything in progress is allowed to finish.
+func (c *connection) handleGoaway(r FrameReader) error {
+	id, err := r.ReadVarint()
+	if err != nil {
+		return err
+	}
+	err = r.CheckForEOF()
+	if err != nil {
+		return err
+	}
+	c.goAwayLock.Lock()
+	if !c.peerGoingAway() || id < c.peerLastID {
+		c.peerLastID = id
+	}
+	c.goAwayLock.Unlock()
+	c.goAwayOnce.Do(func() { close(c.goAwayReceived) })
+	return nil
+}
+
+// GoAwayID returns the ID that the peer sent in GOAWAY: the last request
+// stream ID (from a server) or push ID (from a client) that the peer will
+// process.  Anything with a higher ID wasn't processed, so it can be retried
+// on a new connection.  The second value is false if GOAWAY hasn't been
+// received.
+func (c *connection) GoAwayID() (uint64, bool) {
+	defer c.goAwayLock.Unlock()
+	c.goAwayLock.Lock()
+	if !c.peerGoingAway() {
+		return 0, false
+	}
+	return c.peerLastID, true
+}
+
+// DecoderCapacity returns the current capacity of the table used for
+// decoding header blocks from the peer.
+func (c *connection) DecoderCapacity() hc.TableCapacity {
+	return c.decoder.Table.Capacity()
+}
+
+// EncoderCapacity returns the current capacity of the table used for encoding
+// header blocks.  This is zero until settings are received from the peer.
+func (c *connection) EncoderCapacity() hc.TableCapacity {
+	return c.encoder.Table.Capacity()
+}
+
+// EncoderStats returns counts of what the encoder has written.
+func (c *connection) EncoderStats() hc.QpackEncoderStats {
+	return c.encoder.Stats()
+}
+
 // FatalError is a helper that passes on HTTP errors to the underlying connection.
 func (c *connection) FatalError(e HTTPError) error {
+	c.fatalLock.Lock()
+	if c.fatalError == nil {
+		c.fatalError = &e
+	}
+	c.fatalLock.Unlock()
 	return c.Error(uint16(e), "")
 }
 
-func (c *connection) handlePriority(r io.Reader) error {
-	// TODO implement something useful
-	_, err := io.Copy(ioutil.Discard, r)
+// FatalErrorCode returns the error code that this endpoint used to close the
+// connection.  The second value is false if FatalError hasn't been called.
+func (c *connection) FatalErrorCode() (HTTPError, bool) {
+	defer c.fatalLock.Unlock()
+	c.fatalLock.Lock()
+	if c.fatalError == nil {
+		return 0, false
+	}
+	return *c.fatalError, true
+}
+
+func (c *connection) handlePriority(r FrameReader) error {
+	p, err := ReadPriority(r)
 	if err != nil {
-		c.FatalError(ErrWtf)
+		c.FatalError(malformedFrame(framePriority))
 		return err
 	}
+	if c.config.PriorityObserver != nil {
+		c.config.PriorityObserver(*p)
+	}
 	return nil
 }
 
@@ -177,7 +557,7 @@ func (c *connection) sendSettings() error {
 	if n != int64(buf.Len()) {
 		return ErrStreamBlocked
 	}
-	_, err = c.controlStream.WriteFrame(frameSettings, buf.Bytes())
+	_, err = c.writeControlFrame(frameSettings, buf.Bytes())
 	return err
 }
 
@@ -191,7 +571,7 @@ func (c *connection) serviceControlStream(controlStream *recvStream,
 	}
 
 	if t != frameSettings {
-		return err
+		return ErrInvalidFrame
 	}
 
 	sr := settingsReader{c}
@@ -206,11 +586,20 @@ func (c *connection) serviceControlStream(controlStream *recvStream,
 		if err != nil {
 			return err
 		}
+		c.idle.touch()
 		switch t {
 		case framePriority:
 			err = c.handlePriority(r)
+		case frameGoaway:
+			err = c.handleGoaway(r)
 		default:
-			err = handler.HandleFrame(t, r)
+			// Unknown frame types, including GREASE, are ignored.  Known frame
+			// types that aren't permitted here are rejected by the handler.
+			if t.isKnown() {
+				err = handler.HandleFrame(t, r)
+			} else {
+				_, err = io.Copy(ioutil.Discard, r)
+			}
 		}
 		if err != nil {
 			return err
@@ -231,18 +620,35 @@ func (c *connection) serviceUnidirectionalStreams(handler connectionHandler,
 			t := unidirectionalStreamType(b)
 			switch t {
 			case unidirectionalStreamControl:
-				c.serviceControlStream(s, handler, ready)
+				err = c.serviceControlStream(s, handler, ready)
+				// The control stream can't be closed while the connection is open.
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					if c.GetState() == minq.StateEstablished {
+						c.FatalError(ErrHttpClosedCriticalStream)
+					}
+					return
+				}
 			case unidirectionalStreamQpackDecoder:
 				err = c.encoder.ServiceAcknowledgments(s)
+				if err != nil {
+					c.FatalError(ErrHttpInternalError)
+					return
+				}
 			case unidirectionalStreamQpackEncoder:
 				err = c.decoder.ReadTableUpdates(s)
 				c.decoder.Close()
 			default:
+				if t.isGrease() {
+					// The peer expects these to be ignored.  The stream might
+					// already be finished, so any error here is ignored too.
+					_ = s.StopSending(uint16(ErrHttpUnknownStreamType))
+					return
+				}
 				err = handler.HandleUnidirectionalStream(t, s)
 			}
 			if err != nil {
 				c.FatalError(ErrWtf)
 			}
-		}(newRecvStream(s))
+		}(newRecvStream(s, c.Closed()))
 	}
 }
@@ -2,11 +2,15 @@ package minhq_test
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
+	"net/http"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/ekr/minq"
 
@@ -28,61 +32,919 @@ func (cs *clientServer) Close() error {
 }
 
 func newClientServerPair(t *testing.T) *clientServer {
-	config := &minhq.Config{
+	return newClientServerPairWithConfig(t, &minhq.Config{
 		DecoderTableCapacity:   4096,
 		ConcurrentDecoders:     10,
 		MaxConcurrentPushes:    10,
 		TrackConnections:       true,
 		InformationalResponses: true,
+	})
+}
+
+func newClientServerPairWithConfig(t *testing.T, config *minhq.Config) *clientServer {
+	var server *minhq.Server
+	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
+		server = minhq.RunServer(ms, config)
+		return &server.Server
+	}, func(ms *mw.Server) *mw.Connection {
+		assert.Equal(t, &server.Server, ms)
+		serverConnection := <-server.Connections
+		return &serverConnection.Connection
+	})
+	client := minhq.NewClientConnection(cs.ClientConnection, config)
+	assert.Nil(t, client.Connect())
+	return &clientServer{cs, server, client}
+}
+
+func TestFetch(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	url := "https://example.com/%2fhello"
+	clientRequest, err := cs.client.Fetch("GET", url,
+		hc.HeaderField{Name: "User-Agent", Value: "Test"},
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "Test", serverRequest.GetHeader("user-AGENT"))
+	assert.Equal(t, "GET", serverRequest.Method())
+	assert.Equal(t, url, serverRequest.Target().String())
+	_, err = io.Copy(ioutil.Discard, serverRequest)
+	assert.Nil(t, err)
+	assert.Nil(t, <-serverRequest.Trailers)
+
+	serverResponse, err := serverRequest.Respond(200,
+		hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+	assert.Nil(t, err)
+	contentString := "Hello World"
+	_, err = io.Copy(serverResponse, strings.NewReader(contentString))
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	var body bytes.Buffer
+	_, err = io.Copy(&body, clientResponse)
+	assert.Nil(t, err)
+	bodyString, err := body.ReadString(0)
+	assert.Equal(t, contentString, bodyString)
+}
+
+func TestContentLength(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	contentString := "Hello World"
+	cases := []struct {
+		method        string
+		contentLength string
+		body          string
+		expected      int64
+		err           error
+	}{
+		{"GET", "11", contentString, 11, nil},
+		{"GET", "20", contentString, 20, minhq.ErrContentLength},
+		{"GET", "5", contentString, 5, minhq.ErrContentLength},
+		// A response to HEAD has no body, whatever Content-Length says.
+		{"HEAD", "11", "", -1, nil},
+	}
+	for _, tc := range cases {
+		t.Logf("%v with content-length %v and %v octets of body",
+			tc.method, tc.contentLength, len(tc.body))
+		clientRequest, err := cs.client.Fetch(tc.method, "https://example.com/")
+		assert.Nil(t, err)
+		assert.Nil(t, clientRequest.Close())
+
+		serverRequest := <-cs.server.Requests
+		err = serverRequest.RespondWith(200, strings.NewReader(tc.body),
+			hc.HeaderField{Name: "Content-Length", Value: tc.contentLength})
+		assert.Nil(t, err)
+
+		clientResponse := clientRequest.Response()
+		length, ok := clientResponse.ContentLength()
+		assert.Equal(t, tc.expected >= 0, ok)
+		if ok {
+			assert.Equal(t, tc.expected, length)
+		}
+		body, err := ioutil.ReadAll(clientResponse)
+		assert.Equal(t, tc.err, err)
+		if tc.err == nil {
+			assert.Equal(t, tc.body, string(body))
+		}
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+	client := &http.Client{Transport: &minhq.RoundTripper{C: cs.client}}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serverRequest := <-cs.server.Requests
+		assert.Equal(t, "GET", serverRequest.Method())
+		assert.Equal(t, "https://example.com/get", serverRequest.Target().String())
+		assert.Nil(t, serverRequest.RespondWith(200, strings.NewReader("Hello World"),
+			hc.HeaderField{Name: "Content-Type", Value: "text/plain"}))
+
+		serverRequest = <-cs.server.Requests
+		assert.Equal(t, "POST", serverRequest.Method())
+		assert.Equal(t, "text/plain", serverRequest.GetHeader("content-type"))
+		assert.Equal(t, "4", serverRequest.GetHeader("content-length"))
+		body, err := ioutil.ReadAll(serverRequest)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(body))
+		serverResponse, err := serverRequest.Respond(201)
+		assert.Nil(t, err)
+		_, err = serverResponse.Write([]byte("pong"))
+		assert.Nil(t, err)
+		assert.Nil(t, serverResponse.End([]hc.HeaderField{{Name: "checksum", Value: "abc"}}))
+	}()
+
+	resp, err := client.Get("https://example.com/get")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World", string(body))
+	assert.Nil(t, resp.Body.Close())
+
+	resp, err = client.Post("https://example.com/post", "text/plain", strings.NewReader("ping"))
+	assert.Nil(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	body, err = ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "pong", string(body))
+	assert.Equal(t, "abc", resp.Trailer.Get("Checksum"))
+	assert.Nil(t, resp.Body.Close())
+	<-done
+}
+
+func TestServeHandler(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	go cs.server.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/echo", r.URL.Path)
+		assert.Equal(t, "example.com", r.Host)
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("Trailer", "Checksum")
+		w.WriteHeader(http.StatusCreated)
+		_, err := io.Copy(w, r.Body)
+		assert.Nil(t, err)
+		w.Header().Set("Checksum", "abc")
+	}))
+
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/echo",
+		hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+	assert.Nil(t, err)
+	_, err = clientRequest.Write([]byte("Hello World"))
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 201, clientResponse.Status)
+	assert.Equal(t, "text/plain", clientResponse.GetHeader("content-type"))
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World", string(body))
+	assert.Equal(t, []hc.HeaderField{{Name: "checksum", Value: "abc"}}, <-clientResponse.Trailers)
+}
+
+func TestCookies(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+		CrumbleCookies:       true,
+	})
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/",
+		hc.HeaderField{Name: "Cookie", Value: "a=1; b=2"},
+		hc.HeaderField{Name: "Cookie", Value: "c=3"})
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	// Each crumb arrives as a separate field, but they are joined again.
+	crumbs := 0
+	for _, h := range serverRequest.Headers {
+		if h.Name == "cookie" {
+			crumbs++
+		}
+	}
+	assert.Equal(t, 3, crumbs)
+	assert.Equal(t, "a=1; b=2; c=3", serverRequest.GetHeader("Cookie"))
+
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+// TestCrumbleCookiesPerMessage splits the cookies for one request only.
+func TestCrumbleCookiesPerMessage(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	countCrumbs := func(cookie string, crumble bool) int {
+		headers := []hc.HeaderField{{Name: "Cookie", Value: cookie}}
+		if crumble {
+			headers = hc.CrumbleCookies(headers)
+		}
+		clientRequest, err := cs.client.Fetch("GET", "https://example.com/", headers...)
+		assert.Nil(t, err)
+		assert.Nil(t, clientRequest.Close())
+		serverRequest := <-cs.server.Requests
+		assert.Equal(t, cookie, serverRequest.GetHeader("Cookie"))
+		assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+		assert.Equal(t, 204, clientRequest.Response().Status)
+
+		crumbs := 0
+		for _, h := range serverRequest.Headers {
+			if h.Name == "cookie" {
+				crumbs++
+			}
+		}
+		return crumbs
+	}
+	assert.Equal(t, 1, countCrumbs("a=1; b=2", false))
+	assert.Equal(t, 2, countCrumbs("a=1; b=2", true))
+}
+
+func TestRespondWith(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/file")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	// Informational responses can't have a body.
+	err = serverRequest.RespondWith(103, strings.NewReader("nope"))
+	assert.Equal(t, minhq.ErrInformationalBody, err)
+
+	contentString := strings.Repeat("file contents\n", 100)
+	err = serverRequest.RespondWith(200, strings.NewReader(contentString),
+		hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+	assert.Nil(t, err)
+
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	assert.Equal(t, "text/plain", clientResponse.GetHeader("content-type"))
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, contentString, string(body))
+}
+
+func TestFetchAll(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	specs := []minhq.RequestSpec{
+		{Method: "GET", Target: "https://example.com/a",
+			Headers: []hc.HeaderField{{Name: "User-Agent", Value: "Test"}}},
+		{Method: "GET", Target: "https://example.com/b",
+			Headers: []hc.HeaderField{{Name: "User-Agent", Value: "Test"}}},
+		{Method: "HEAD", Target: "https://example.com/c"},
+	}
+	clientRequests, err := cs.client.FetchAll(specs...)
+	assert.Nil(t, err)
+	assert.Equal(t, len(specs), len(clientRequests))
+	for _, clientRequest := range clientRequests {
+		assert.Nil(t, clientRequest.Close())
+	}
+
+	// Requests can arrive in any order.
+	seen := make(map[string]*minhq.ServerRequest)
+	for range specs {
+		serverRequest := <-cs.server.Requests
+		seen[serverRequest.Target().String()] = serverRequest
+	}
+	for _, spec := range specs {
+		serverRequest := seen[spec.Target]
+		assert.NotNil(t, serverRequest)
+		assert.Equal(t, spec.Method, serverRequest.Method())
+		if len(spec.Headers) > 0 {
+			assert.Equal(t, "Test", serverRequest.GetHeader("user-agent"))
+		}
+		serverResponse, err := serverRequest.Respond(204)
+		assert.Nil(t, err)
+		assert.Nil(t, serverResponse.Close())
+	}
+
+	for _, clientRequest := range clientRequests {
+		assert.Equal(t, 204, clientRequest.Response().Status)
+	}
+}
+
+// TestFetchAllFailure makes a batch where a later request can't be encoded.
+// None of the requests reach the server, and nothing is left outstanding, so
+// the idle connection is closed.
+func TestFetchAllFailure(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+		MaxHeaderListSize:    300,
+		IdleTimeout:          200 * time.Millisecond,
+	})
+	defer cs.Close()
+
+	_, err := cs.client.FetchAll(
+		minhq.RequestSpec{Method: "GET", Target: "https://example.com/a"},
+		minhq.RequestSpec{Method: "GET", Target: "https://example.com/b",
+			Headers: []hc.HeaderField{{Name: "x-large", Value: strings.Repeat("x", 400)}}},
+	)
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+
+	select {
+	case <-cs.server.Requests:
+		t.Fatal("request reached the server")
+	case <-cs.client.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+// postBody makes a POST request with the given content-type and body.
+func postBody(t *testing.T, cs *clientServer, contentType string, body []byte) *minhq.ServerRequest {
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/form",
+		hc.HeaderField{Name: "Content-Type", Value: contentType})
+	assert.Nil(t, err)
+	_, err = clientRequest.Write(body)
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	return <-cs.server.Requests
+}
+
+func TestAbortAll(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	var requests []*minhq.ClientRequest
+	for i := 0; i < 3; i++ {
+		clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+		assert.Nil(t, err)
+		assert.Nil(t, clientRequest.Close())
+		<-cs.server.Requests
+		requests = append(requests, clientRequest)
+	}
+
+	cs.client.AbortAll(minhq.ErrHttpRequestCancelled)
+	for _, clientRequest := range requests {
+		assert.Nil(t, clientRequest.Response())
+		assert.Equal(t, minhq.ErrRequestAborted, clientRequest.Err())
+	}
+
+	// The connection is still usable.
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+	assert.Nil(t, clientRequest.Err())
+}
+
+func TestMaxBodySize(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+		MaxBodySize:          10,
+	})
+	defer cs.Close()
+
+	// A body that fits is fine.
+	serverRequest := postBody(t, cs, "text/plain", []byte("small"))
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, "small", string(body))
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+
+	// A larger body is cut off at the limit.
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/form",
+		hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+	assert.Nil(t, err)
+	_, err = clientRequest.Write([]byte("this is far too large"))
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest = <-cs.server.Requests
+	body, err = ioutil.ReadAll(serverRequest)
+	assert.Equal(t, minhq.ErrBodyTooLarge, err)
+	assert.Equal(t, "this is fa", string(body))
+
+	// The client sees the stream reset instead of a response.
+	assert.Nil(t, clientRequest.Response())
+	assert.NotNil(t, clientRequest.Err())
+
+	// Only the stream is reset, so the connection is still usable.
+	clientRequest, err = cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest = <-cs.server.Requests
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestFetchContext(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	// A context that is already done stops the request from being made.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cs.client.FetchContext(ctx, "GET", "https://example.com/")
+	assert.Equal(t, context.Canceled, err)
+
+	// Cancelling a request that is in progress aborts it.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	clientRequest, err := cs.client.FetchContext(ctx, "GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	<-cs.server.Requests
+	cancel()
+	assert.Nil(t, clientRequest.Response())
+	assert.Equal(t, context.Canceled, clientRequest.Err())
+
+	// The connection is still usable.
+	clientRequest, err = cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+	assert.Nil(t, clientRequest.Err())
+}
+
+func TestParseForm(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	serverRequest := postBody(t, cs, "application/x-www-form-urlencoded",
+		[]byte("name=value&other=a%20b&name=again"))
+	form, err := serverRequest.ParseForm()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value", "again"}, form["name"])
+	assert.Equal(t, "a b", form.Get("other"))
+
+	_, err = serverRequest.ParseMultipart(1024)
+	assert.Equal(t, minhq.ErrNotForm, err)
+	assert.Nil(t, serverRequest.RespondWith(204, &bytes.Buffer{}))
+}
+
+func TestParseMultipart(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	var body bytes.Buffer
+	mpw := multipart.NewWriter(&body)
+	assert.Nil(t, mpw.WriteField("name", "value"))
+	fw, err := mpw.CreateFormFile("file", "file.txt")
+	assert.Nil(t, err)
+	_, err = fw.Write([]byte("file contents"))
+	assert.Nil(t, err)
+	assert.Nil(t, mpw.Close())
+
+	serverRequest := postBody(t, cs, mpw.FormDataContentType(), body.Bytes())
+	_, err = serverRequest.ParseForm()
+	assert.Equal(t, minhq.ErrNotForm, err)
+	form, err := serverRequest.ParseMultipart(1024)
+	assert.Nil(t, err)
+	defer form.RemoveAll()
+	assert.Equal(t, []string{"value"}, form.Value["name"])
+	assert.Equal(t, 1, len(form.File["file"]))
+	f, err := form.File["file"][0].Open()
+	assert.Nil(t, err)
+	contents, err := ioutil.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "file contents", string(contents))
+	assert.Nil(t, serverRequest.RespondWith(204, &bytes.Buffer{}))
+}
+
+func TestRemoteAddr(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, test.ClientAddr.String(), serverRequest.C.RemoteAddr().String())
+	serverResponse, err := serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+}
+
+func TestEncoderCapacityIntent(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		EncoderTableCapacity: 1024,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+	})
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	serverResponse, err := serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 204, clientRequest.Response().Status)
+
+	// Fetch and Respond both wait until the peer's settings are read, so each
+	// decoder table is already sized to match what the peer encoder intends
+	// to use.
+	assert.Equal(t, hc.TableCapacity(1024), cs.client.DecoderCapacity())
+	assert.Equal(t, hc.TableCapacity(1024), serverRequest.C.DecoderCapacity())
+}
+
+// The encoder only uses the dynamic table once it has the peer's settings.
+func TestEncoderSettings(t *testing.T) {
+	for _, capacity := range []hc.TableCapacity{0, 4096} {
+		cs := newClientServerPairWithConfig(t, &minhq.Config{
+			DecoderTableCapacity: capacity,
+			ConcurrentDecoders:   10,
+			TrackConnections:     true,
+		})
+
+		clientRequest, err := cs.client.Fetch("GET", "https://example.com/",
+			hc.HeaderField{Name: "x-custom", Value: "value"})
+		assert.Nil(t, err)
+		assert.Nil(t, clientRequest.Close())
+		serverRequest := <-cs.server.Requests
+		assert.Equal(t, "value", serverRequest.GetHeader("x-custom"))
+		assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+		assert.Equal(t, 204, clientRequest.Response().Status)
+
+		assert.Equal(t, capacity, cs.client.EncoderCapacity())
+		inserts := cs.client.EncoderStats().Inserts
+		if capacity == 0 {
+			assert.Equal(t, uint64(0), inserts)
+		} else {
+			assert.NotEqual(t, uint64(0), inserts)
+		}
+		cs.Close()
+	}
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		MaxHeaderListSize:    200,
+		TrackConnections:     true,
+	})
+	defer cs.Close()
+
+	// The request is too large for the server, so the client won't send it.
+	_, err := cs.client.Fetch("GET", "https://example.com/",
+		hc.HeaderField{Name: "x-large", Value: strings.Repeat("x", 200)})
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/",
+		hc.HeaderField{Name: "x-small", Value: "x"})
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "x", serverRequest.GetHeader("x-small"))
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestShutdown(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	shutdown := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- cs.server.Shutdown(ctx)
+	}()
+
+	// New requests are refused once GOAWAY arrives.
+	select {
+	case <-cs.client.GoAwayReceived():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
+	}
+	_, err = cs.client.Fetch("GET", "https://example.com/")
+	assert.Equal(t, minhq.ErrGoingAway, err)
+
+	// The request in progress completes.
+	err = serverRequest.RespondWith(200, strings.NewReader("bye"))
+	assert.Nil(t, err)
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(body))
+	assert.Nil(t, <-shutdown)
+
+	// Once the connection is closed, new requests fail.
+	select {
+	case <-cs.client.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	_, err = cs.client.Fetch("GET", "https://example.com/")
+	assert.NotNil(t, err)
+}
+
+func TestShutdownAfterEmptyStream(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	// A request stream that ends before HEADERS is reset by the server.
+	stream := cs.cs.ClientConnection.CreateStream()
+	assert.Nil(t, stream.Close())
+	_, _ = ioutil.ReadAll(stream)
+
+	// That stream doesn't hold up shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, cs.server.Shutdown(ctx))
+}
+
+func TestGoAway(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Nil(t, serverRequest.C.GoAway())
+
+	select {
+	case <-cs.client.GoAwayReceived():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
+	}
+	_, err = cs.client.Fetch("GET", "https://example.com/")
+	assert.Equal(t, minhq.ErrGoingAway, err)
+
+	// GOAWAY carries the ID of the request in progress, so it isn't retried.
+	_, ok := cs.client.GoAwayID()
+	assert.True(t, ok)
+	assert.False(t, cs.client.Unprocessed(clientRequest))
+
+	// The request in progress still completes.
+	err = serverRequest.RespondWith(200, strings.NewReader("bye"))
+	assert.Nil(t, err)
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(body))
+}
+
+func TestKeepAlive(t *testing.T) {
+	interval := 20 * time.Millisecond
+	start := time.Now()
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+		KeepAliveInterval:    interval,
+	})
+	defer cs.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for cs.client.KeepAlivesSent() < 3 && time.Now().Before(deadline) {
+		time.Sleep(interval)
+	}
+	sent := cs.client.KeepAlivesSent()
+	elapsed := time.Since(start)
+	assert.True(t, sent >= 3, "too few keep-alives")
+	// Keep-alives are sent no more often than the interval.
+	assert.True(t, sent <= uint64(elapsed/interval), "too many keep-alives")
+
+	// The server ignores the keep-alives.
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+	assert.True(t, serverRequest.C.KeepAlivesSent() > 0)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		TrackConnections:     true,
+		IdleTimeout:          timeout,
+	})
+	defer cs.Close()
+
+	// A request that takes longer than the timeout keeps the connection open.
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+	select {
+	case <-cs.client.Closed():
+		t.Fatal("connection closed while a request was outstanding")
+	case <-time.After(3 * timeout):
+	}
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+
+	// Once the request is done, the connection is closed.
+	select {
+	case <-cs.client.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+// TestUnknownControlFrame uses a bare connection as a client, so that it can
+// write whatever it likes to the control stream.
+func TestUnknownControlFrame(t *testing.T) {
+	var server *minhq.Server
+	var serverConnection *minhq.ServerConnection
+	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
+		server = minhq.RunServer(ms, &minhq.Config{TrackConnections: true})
+		return &server.Server
+	}, func(ms *mw.Server) *mw.Connection {
+		serverConnection = <-server.Connections
+		return &serverConnection.Connection
+	})
+	defer cs.Close()
+
+	control := minhq.NewFrameWriter(cs.ClientConnection.CreateSendStream())
+	assert.Nil(t, control.WriteByte(0x43))
+	_, err := control.WriteFrame(minhq.FrameType(4), nil) // SETTINGS
+	assert.Nil(t, err)
+	_, err = control.WriteFrame(minhq.FrameType(0xfe), []byte{1, 2, 3})
+	assert.Nil(t, err)
+	// GOAWAY is only handled if the unknown frame was skipped.
+	_, err = control.WriteFrame(minhq.FrameType(7), []byte{0})
+	assert.Nil(t, err)
+
+	select {
+	case <-serverConnection.GoAwayReceived():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
+	}
+	_, failed := serverConnection.FatalErrorCode()
+	assert.False(t, failed)
+}
+
+// TestGreaseStream opens a unidirectional stream with a reserved type, which
+// the server ignores.
+func TestGreaseStream(t *testing.T) {
+	var server *minhq.Server
+	var serverConnection *minhq.ServerConnection
+	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
+		server = minhq.RunServer(ms, &minhq.Config{TrackConnections: true})
+		return &server.Server
+	}, func(ms *mw.Server) *mw.Connection {
+		serverConnection = <-server.Connections
+		return &serverConnection.Connection
+	})
+	defer cs.Close()
+
+	grease := cs.ClientConnection.CreateSendStream()
+	_, err := grease.Write([]byte{0x5f, 1, 2, 3})
+	assert.Nil(t, err)
+	assert.Nil(t, grease.Close())
+
+	control := minhq.NewFrameWriter(cs.ClientConnection.CreateSendStream())
+	assert.Nil(t, control.WriteByte(0x43))
+	_, err = control.WriteFrame(minhq.FrameType(4), nil) // SETTINGS
+	assert.Nil(t, err)
+	_, err = control.WriteFrame(minhq.FrameType(7), []byte{0})
+	assert.Nil(t, err)
+
+	select {
+	case <-serverConnection.GoAwayReceived():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
 	}
+	_, failed := serverConnection.FatalErrorCode()
+	assert.False(t, failed)
+}
+
+// TestDataFrameSize uses a bare connection as a client, so that it can see
+// how the server splits a large response body into DATA frames.
+func TestDataFrameSize(t *testing.T) {
 	var server *minhq.Server
 	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
-		server = minhq.RunServer(ms, config)
+		server = minhq.RunServer(ms, &minhq.Config{TrackConnections: true})
 		return &server.Server
 	}, func(ms *mw.Server) *mw.Connection {
-		assert.Equal(t, &server.Server, ms)
 		serverConnection := <-server.Connections
 		return &serverConnection.Connection
 	})
-	client := minhq.NewClientConnection(cs.ClientConnection, config)
-	assert.Nil(t, client.Connect())
-	return &clientServer{cs, server, client}
-}
-
-func TestFetch(t *testing.T) {
-	cs := newClientServerPair(t)
 	defer cs.Close()
 
-	url := "https://example.com/%2fhello"
-	clientRequest, err := cs.client.Fetch("GET", url,
-		hc.HeaderField{Name: "User-Agent", Value: "Test"},
-	)
+	control := minhq.NewFrameWriter(cs.ClientConnection.CreateSendStream())
+	assert.Nil(t, control.WriteByte(0x43))
+	_, err := control.WriteFrame(minhq.FrameType(4), nil) // SETTINGS
 	assert.Nil(t, err)
-	assert.Nil(t, clientRequest.Close())
 
-	serverRequest := <-cs.server.Requests
-	assert.Equal(t, "Test", serverRequest.GetHeader("user-AGENT"))
-	assert.Equal(t, "GET", serverRequest.Method())
-	assert.Equal(t, url, serverRequest.Target().String())
-	_, err = io.Copy(ioutil.Discard, serverRequest)
+	// The request only uses the static table, so no encoder stream is needed.
+	stream := cs.ClientConnection.CreateStream()
+	var headerBuf bytes.Buffer
+	err = hc.NewStaticQpackEncoder().WriteHeaderBlock(&headerBuf, stream.Id(),
+		hc.HeaderField{Name: ":method", Value: "GET"},
+		hc.HeaderField{Name: ":scheme", Value: "https"},
+		hc.HeaderField{Name: ":authority", Value: "example.com"},
+		hc.HeaderField{Name: ":path", Value: "/"})
 	assert.Nil(t, err)
-	assert.Nil(t, <-serverRequest.Trailers)
+	request := minhq.NewFrameWriter(stream)
+	_, err = request.WriteFrame(minhq.FrameType(1), headerBuf.Bytes()) // HEADERS
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Close())
 
-	serverResponse, err := serverRequest.Respond(200,
-		hc.HeaderField{Name: "Content-Type", Value: "text/plain"})
+	serverRequest := <-server.Requests
+	body := make([]byte, 1<<20)
+	go func() {
+		assert.Nil(t, serverRequest.RespondWith(200, bytes.NewReader(body)))
+	}()
+
+	var sizes []uint64
+	response := minhq.NewFrameReader(stream)
+	for {
+		ft, fr, err := response.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		n, err := io.Copy(ioutil.Discard, fr)
+		assert.Nil(t, err)
+		if ft == minhq.FrameType(0) { // DATA
+			sizes = append(sizes, uint64(n))
+		}
+	}
+	assert.Equal(t, len(body)/minhq.DefaultMaxDataFrameSize, len(sizes))
+	for _, size := range sizes {
+		assert.Equal(t, uint64(minhq.DefaultMaxDataFrameSize), size)
+	}
+}
+
+func TestPriorityFrame(t *testing.T) {
+	var server *minhq.Server
+	var serverConnection *minhq.ServerConnection
+	priorities := make(chan minhq.Priority, 1)
+	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
+		server = minhq.RunServer(ms, &minhq.Config{
+			TrackConnections: true,
+			PriorityObserver: func(p minhq.Priority) { priorities <- p },
+		})
+		return &server.Server
+	}, func(ms *mw.Server) *mw.Connection {
+		serverConnection = <-server.Connections
+		return &serverConnection.Connection
+	})
+	defer cs.Close()
+
+	control := minhq.NewFrameWriter(cs.ClientConnection.CreateSendStream())
+	assert.Nil(t, control.WriteByte(0x43))
+	_, err := control.WriteFrame(minhq.FrameType(4), nil) // SETTINGS
 	assert.Nil(t, err)
-	contentString := "Hello World"
-	_, err = io.Copy(serverResponse, strings.NewReader(contentString))
+	_, err = control.WriteFrame(minhq.FrameType(2), []byte{0x20, 0x04, 0x02, 0x0f})
 	assert.Nil(t, err)
-	assert.Nil(t, serverResponse.Close())
 
-	clientResponse := clientRequest.Response()
-	assert.Equal(t, 200, clientResponse.Status)
-	var body bytes.Buffer
-	_, err = io.Copy(&body, clientResponse)
+	select {
+	case p := <-priorities:
+		assert.Equal(t, uint64(4), p.ElementID)
+		assert.Equal(t, uint16(16), p.Weight)
+	case <-time.After(5 * time.Second):
+		t.Fatal("PRIORITY not received")
+	}
+
+	// A malformed PRIORITY frame is a connection error.
+	_, err = control.WriteFrame(minhq.FrameType(2), []byte{0xc0, 0x04, 0x02, 0x0f})
 	assert.Nil(t, err)
-	bodyString, err := body.ReadString(0)
-	assert.Equal(t, contentString, bodyString)
+	select {
+	case <-serverConnection.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	code, failed := serverConnection.FatalErrorCode()
+	assert.True(t, failed)
+	assert.Equal(t, "HTTP_MALFORMED_FRAME", code.String())
 }
 
 func Test1xx(t *testing.T) {
@@ -119,6 +981,169 @@ func Test1xx(t *testing.T) {
 
 	clientResponse := clientRequest.Response()
 	assert.Equal(t, 200, clientResponse.Status)
+	// The channel is closed before the final response is delivered.
+	_, ok := <-clientRequest.InformationalResponses
+	assert.False(t, ok)
+}
+
+func TestExpectContinue(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+
+	requestBody := "request body"
+	written := make(chan error)
+	go func() {
+		_, err := clientRequest.Write([]byte(requestBody))
+		if err == nil {
+			err = clientRequest.Close()
+		}
+		written <- err
+	}()
+
+	serverRequest := <-cs.server.Requests
+	assert.Equal(t, "100-continue", serverRequest.GetHeader("expect"))
+
+	// The body isn't sent until the server says to continue.
+	select {
+	case <-written:
+		t.Fatal("request body was sent before 100 (Continue)")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	serverResponse, err := serverRequest.Respond(100)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse)
+
+	info := <-clientRequest.InformationalResponses
+	assert.Equal(t, 100, info.StatusCode)
+	assert.Nil(t, <-written)
+
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(body))
+
+	serverResponse, err = serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+// TestExpectContinueTimeout checks that the request body is sent if the server
+// doesn't respond to `Expect: 100-continue`.
+func TestExpectContinueTimeout(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity:  4096,
+		ConcurrentDecoders:    10,
+		TrackConnections:      true,
+		ExpectContinueTimeout: 50 * time.Millisecond,
+	})
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("POST", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+
+	// The server reads the body without sending 100 (Continue).
+	requestBody := "request body"
+	written := make(chan error)
+	go func() {
+		_, err := clientRequest.Write([]byte(requestBody))
+		if err == nil {
+			err = clientRequest.Close()
+		}
+		written <- err
+	}()
+	serverRequest := <-cs.server.Requests
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(body))
+	assert.Nil(t, <-written)
+
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestServerContinue(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("PUT", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+
+	requestBody := "request body"
+	written := make(chan error)
+	go func() {
+		_, err := clientRequest.Write([]byte(requestBody))
+		if err == nil {
+			err = clientRequest.Close()
+		}
+		written <- err
+	}()
+
+	serverRequest := <-cs.server.Requests
+	assert.Nil(t, serverRequest.Continue())
+	// Only one 100 (Continue) is sent.
+	assert.Nil(t, serverRequest.Continue())
+	assert.Nil(t, <-written)
+
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(body))
+	assert.Nil(t, serverRequest.RespondWith(204, strings.NewReader("")))
+
+	info := <-clientRequest.InformationalResponses
+	assert.Equal(t, 100, info.StatusCode)
+	assert.Equal(t, 204, clientRequest.Response().Status)
+	_, ok := <-clientRequest.InformationalResponses
+	assert.False(t, ok)
+}
+
+// TestContinueAfterResponse reads the request body after the final response
+// has started, which doesn't send 100 (Continue).
+func TestContinueAfterResponse(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("PUT", "https://example.com/upload",
+		hc.HeaderField{Name: "Expect", Value: "100-continue"})
+	assert.Nil(t, err)
+
+	requestBody := "request body"
+	written := make(chan error)
+	go func() {
+		_, err := clientRequest.Write([]byte(requestBody))
+		if err == nil {
+			err = clientRequest.Close()
+		}
+		written <- err
+	}()
+
+	serverRequest := <-cs.server.Requests
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverRequest.Continue())
+
+	body, err := ioutil.ReadAll(serverRequest)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(body))
+	assert.Nil(t, <-written)
+	_, err = serverResponse.Write(body)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	// The client only sees the final response.
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	_, ok := <-clientRequest.InformationalResponses
+	assert.False(t, ok)
+	responseBody, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, requestBody, string(responseBody))
 }
 
 var (
@@ -185,3 +1210,242 @@ func TestPushOnRequest(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestPushTrailers(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	serverPromise, err := serverRequest.Push("GET", "/other")
+	assert.Nil(t, err)
+	serverPushResponse, err := serverPromise.Respond(200)
+	assert.Nil(t, err)
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	trailers := []hc.HeaderField{{Name: "x-trailer", Value: "done"}}
+	assert.Nil(t, serverPushResponse.End(trailers))
+
+	promise := <-clientRequest.Pushes
+	serverResponse, err := serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+
+	clientPushResponse := promise.Response()
+	assert.Equal(t, 200, clientPushResponse.Status)
+	body, err := ioutil.ReadAll(clientPushResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, pushMessage, body)
+	assert.Equal(t, trailers, <-clientPushResponse.Trailers)
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestClientCancelPush(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	serverPromise, err := serverRequest.Push("GET", "/other")
+	assert.Nil(t, err)
+	promise := <-clientRequest.Pushes
+	assert.Nil(t, promise.Cancel())
+
+	// The control stream is processed in order, so CANCEL_PUSH has been
+	// handled once the GOAWAY that follows it arrives.
+	assert.Nil(t, cs.client.GoAway())
+	select {
+	case <-serverRequest.C.GoAwayReceived():
+	case <-time.After(5 * time.Second):
+		t.Fatal("GOAWAY not received")
+	}
+	assert.True(t, serverPromise.Cancelled())
+	_, err = serverPromise.Respond(200)
+	assert.Equal(t, minhq.ErrPushCancelled, err)
+
+	serverResponse, err := serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestMaxPushID(t *testing.T) {
+	cs := newClientServerPairWithConfig(t, &minhq.Config{
+		DecoderTableCapacity: 4096,
+		ConcurrentDecoders:   10,
+		MaxConcurrentPushes:  2,
+		TrackConnections:     true,
+	})
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	serverPromise, err := serverRequest.Push("GET", "/one")
+	assert.Nil(t, err)
+	_, err = serverRequest.Push("GET", "/two")
+	assert.Nil(t, err)
+	_, err = serverRequest.Push("GET", "/three")
+	assert.Equal(t, minhq.ErrNoPushID, err)
+	added := serverRequest.C.PushIDsAdded()
+
+	// Completing a push causes the client to authorize another.
+	serverPushResponse, err := serverPromise.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+	promise := <-clientRequest.Pushes
+	assert.Equal(t, 204, promise.Response().Status)
+	<-clientRequest.Pushes
+
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("MAX_PUSH_ID not received")
+	}
+	_, err = serverRequest.Push("GET", "/three")
+	assert.Nil(t, err)
+	assert.Nil(t, (<-clientRequest.Pushes).Cancel())
+
+	serverResponse, err := serverRequest.Respond(204)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 204, clientRequest.Response().Status)
+}
+
+func TestMalformedPushStream(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+	serverRequest := <-cs.server.Requests
+
+	// A push stream (type 0x50) with a truncated push ID.
+	s := serverRequest.C.CreateSendStream()
+	_, err = s.Write([]byte{0x50, 0x40})
+	assert.Nil(t, err)
+	assert.Nil(t, s.Close())
+
+	// The connection is still usable.
+	err = serverRequest.RespondWith(200, strings.NewReader("ok"))
+	assert.Nil(t, err)
+	clientResponse := clientRequest.Response()
+	assert.Equal(t, 200, clientResponse.Status)
+	body, err := ioutil.ReadAll(clientResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", string(body))
+}
+
+// TestClosedControlStream uses a bare connection as a client, so that it can
+// close its control stream.
+func TestClosedControlStream(t *testing.T) {
+	var server *minhq.Server
+	var serverConnection *minhq.ServerConnection
+	cs := test.NewClientServerPair(func(ms *minq.Server) *mw.Server {
+		server = minhq.RunServer(ms, &minhq.Config{TrackConnections: true})
+		return &server.Server
+	}, func(ms *mw.Server) *mw.Connection {
+		serverConnection = <-server.Connections
+		return &serverConnection.Connection
+	})
+	defer cs.Close()
+
+	controlStream := cs.ClientConnection.CreateSendStream()
+	control := minhq.NewFrameWriter(controlStream)
+	assert.Nil(t, control.WriteByte(0x43))
+	_, err := control.WriteFrame(minhq.FrameType(4), nil) // SETTINGS
+	assert.Nil(t, err)
+	assert.Nil(t, controlStream.Close())
+
+	select {
+	case <-serverConnection.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	code, ok := serverConnection.FatalErrorCode()
+	assert.True(t, ok)
+	assert.Equal(t, minhq.ErrHttpClosedCriticalStream, code)
+}
+
+func TestPausePush(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/pause")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	serverPromise, err := serverRequest.Push("GET", "/paused")
+	assert.Nil(t, err)
+	serverPushResponse, err := serverPromise.Respond(200)
+	assert.Nil(t, err)
+
+	promise := <-clientRequest.Pushes
+	clientPushResponse := promise.Response()
+	assert.Equal(t, 200, clientPushResponse.Status)
+	clientPushResponse.Pause()
+
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+
+	// The message can't end while it is paused.
+	select {
+	case <-clientPushResponse.Trailers:
+		t.Fatal("push was read while paused")
+	default:
+	}
+
+	clientPushResponse.Resume()
+	body, err := ioutil.ReadAll(clientPushResponse)
+	assert.Nil(t, err)
+	assert.Equal(t, pushMessage, body)
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 200, clientRequest.Response().Status)
+}
+
+func TestCancelPausedPush(t *testing.T) {
+	cs := newClientServerPair(t)
+	defer cs.Close()
+
+	clientRequest, err := cs.client.Fetch("GET", "https://example.com/pause")
+	assert.Nil(t, err)
+	assert.Nil(t, clientRequest.Close())
+
+	serverRequest := <-cs.server.Requests
+	serverPromise, err := serverRequest.Push("GET", "/paused")
+	assert.Nil(t, err)
+	serverPushResponse, err := serverPromise.Respond(200)
+	assert.Nil(t, err)
+
+	promise := <-clientRequest.Pushes
+	clientPushResponse := promise.Response()
+	assert.Equal(t, 200, clientPushResponse.Status)
+	clientPushResponse.Pause()
+
+	_, err = serverPushResponse.Write(pushMessage)
+	assert.Nil(t, err)
+	assert.Nil(t, serverPushResponse.Close())
+
+	// Cancelling the push releases the paused stream, so the message ends.
+	assert.Nil(t, promise.Cancel())
+	assert.Nil(t, <-clientPushResponse.Trailers)
+
+	serverResponse, err := serverRequest.Respond(200)
+	assert.Nil(t, err)
+	assert.Nil(t, serverResponse.Close())
+	assert.Equal(t, 200, clientRequest.Response().Status)
+}
@@ -20,8 +20,26 @@ const (
 	framePushPromise = FrameType(5)
 	frameGoaway      = FrameType(7)
 	frameMaxPushID   = FrameType(13)
+	// frameGrease is the first of the reserved frame types, which are ignored.
+	frameGrease = FrameType(0x21)
 )
 
+// isKnown returns true for the frame types that are defined.  Other frame
+// types are ignored on the control stream.
+func (ft FrameType) isKnown() bool {
+	switch ft {
+	case frameData, frameHeaders, framePriority, frameCancelPush,
+		frameSettings, framePushPromise, frameGoaway, frameMaxPushID:
+		return true
+	}
+	return false
+}
+
+// isGrease returns true for the reserved frame types, 0x1f * N + 0x21.
+func (ft FrameType) isGrease() bool {
+	return ft >= frameGrease && (ft-frameGrease)%0x1f == 0
+}
+
 // String produces the strings from the spec.
 func (ft FrameType) String() string {
 	switch ft {
@@ -42,6 +60,9 @@ func (ft FrameType) String() string {
 	case frameMaxPushID:
 		return "MAX_PUSH_ID"
 	}
+	if ft.isGrease() {
+		return "GREASE"
+	}
 	return "UNKNOWN!"
 }
 
@@ -146,7 +167,7 @@ func (fw *frameWriter) WriteVarint(v uint64) (int, error) {
 	n := byte(1) << size
 	err = fw.WriteBits(v, n*8-2)
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 	return int(n), nil
 }
@@ -179,3 +200,8 @@ type frameWriteCloser struct {
 func NewFrameWriteCloser(w io.WriteCloser) FrameWriteCloser {
 	return &frameWriteCloser{NewFrameWriter(w), w}
 }
+
+// Close is needed to resolve an ambiguity between FrameWriter and io.Closer.
+func (fwc *frameWriteCloser) Close() error {
+	return fwc.Closer.Close()
+}
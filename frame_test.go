@@ -68,6 +68,26 @@ func TestVarintWriteOverflow(t *testing.T) {
 	fw := minhq.NewFrameWriter(&buf)
 	_, err := fw.WriteVarint(1 << 63)
 	assert.NotNil(t, err)
+	_, err = fw.WriteVarint(1 << 62)
+	assert.Equal(t, minhq.ErrTooLarge, err)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestVarintRoundTrip(t *testing.T) {
+	values := []uint64{0, 63, 64, 16383, 16384, 1<<30 - 1, 1 << 30, 1<<62 - 1}
+	var buf bytes.Buffer
+	fw := minhq.NewFrameWriter(&buf)
+	for _, v := range values {
+		_, err := fw.WriteVarint(v)
+		assert.Nil(t, err)
+	}
+	fr := minhq.NewFrameReader(&buf)
+	for _, v := range values {
+		n, err := fr.ReadVarint()
+		assert.Nil(t, err)
+		assert.Equal(t, v, n)
+	}
+	assert.Equal(t, 0, buf.Len())
 }
 
 func TestFrameRead(t *testing.T) {
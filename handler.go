@@ -0,0 +1,197 @@
+package minhq
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// Serve passes each request that the server receives to `handler`, each on its
+// own goroutine.  This returns when the Requests channel is closed.
+func (s *Server) Serve(handler http.Handler) {
+	for req := range s.Requests {
+		go ServeRequest(handler, req)
+	}
+}
+
+// ServeRequest uses `handler` to respond to a single request.  The request is
+// converted into an http.Request, and the http.ResponseWriter sends the
+// response.  If the handler doesn't write anything, the response is an empty
+// 200.
+func ServeRequest(handler http.Handler, req *ServerRequest) {
+	w := &responseWriter{req: req, header: make(http.Header)}
+	handler.ServeHTTP(w, newHTTPRequest(req))
+	w.finish()
+}
+
+// newHTTPRequest converts a ServerRequest into an http.Request.
+func newHTTPRequest(req *ServerRequest) *http.Request {
+	target := req.Target()
+	hr := &http.Request{
+		Method:        req.Method(),
+		URL:           target,
+		Proto:         "HTTP/3",
+		ProtoMajor:    3,
+		Header:        make(http.Header),
+		Trailer:       make(http.Header),
+		ContentLength: -1,
+		Host:          target.Host,
+		RequestURI:    target.RequestURI(),
+	}
+	// Connections that weren't made by a Server might not have an address.
+	if addr := req.C.RemoteAddr(); addr != nil {
+		hr.RemoteAddr = addr.String()
+	}
+	for _, h := range req.Headers {
+		if h.Name[0] == ':' {
+			continue
+		}
+		hr.Header.Add(h.Name, h.Value)
+	}
+	if length, ok := req.ContentLength(); ok {
+		hr.ContentLength = length
+	}
+	hr.Body = &requestBody{req, hr.Trailer}
+	return hr
+}
+
+// requestBody is the body of an http.Request.  This sends 100 (Continue) if
+// the client asked for it, and fills in the Trailer of the request when the
+// body has been read.
+type requestBody struct {
+	req     *ServerRequest
+	trailer http.Header
+}
+
+func (body *requestBody) Read(p []byte) (int, error) {
+	// As with net/http, reading the body is what triggers 100 (Continue).
+	err := body.req.Continue()
+	if err != nil {
+		return 0, err
+	}
+	n, err := body.req.Read(p)
+	if err == io.EOF {
+		for _, h := range <-body.req.Trailers {
+			body.trailer.Add(h.Name, h.Value)
+		}
+	}
+	return n, err
+}
+
+// Close does nothing; the response determines when the stream ends.
+func (body *requestBody) Close() error {
+	return nil
+}
+
+// responseWriter implements http.ResponseWriter and http.Flusher for a
+// ServerRequest.
+type responseWriter struct {
+	req    *ServerRequest
+	header http.Header
+	resp   *ServerResponse
+	// trailers lists the trailers that were announced in the Trailer header
+	// field when the header block was written.
+	trailers []string
+	err      error
+}
+
+var _ http.ResponseWriter = &responseWriter{}
+var _ http.Flusher = &responseWriter{}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+// headerFields converts header fields from net/http.  This drops header
+// fields that are specific to HTTP/1.1 connections, and trailers that use
+// http.TrailerPrefix.
+func headerFields(header http.Header) []hc.HeaderField {
+	var headers []hc.HeaderField
+	for name, values := range header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			continue
+		}
+		for _, v := range values {
+			h := hc.HeaderField{Name: strings.ToLower(name), Value: v}
+			if hc.ValidateConnectionHeaders([]hc.HeaderField{h}) != nil {
+				continue
+			}
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// WriteHeader sends the response header block.  Informational responses can
+// be sent before the final response.
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.resp != nil || w.err != nil {
+		return
+	}
+	resp, err := w.req.Respond(statusCode, headerFields(w.header)...)
+	if err != nil {
+		w.err = err
+		return
+	}
+	if statusCode/100 == 1 {
+		return
+	}
+	w.resp = resp
+	for _, v := range w.header["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			w.trailers = append(w.trailers, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+		}
+	}
+}
+
+// Write sends a DATA frame, first sending a 200 response if WriteHeader wasn't
+// called.
+func (w *responseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.resp.Write(p)
+}
+
+// Flush sends the header block if it hasn't been sent.  Each Write is sent
+// immediately, so there is nothing else to flush.
+func (w *responseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// trailerFields collects the trailers that were announced or set using
+// http.TrailerPrefix.
+func (w *responseWriter) trailerFields() []hc.HeaderField {
+	var trailers []hc.HeaderField
+	add := func(name string, values []string) {
+		for _, v := range values {
+			trailers = append(trailers, hc.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	for _, name := range w.trailers {
+		add(name, w.header[name])
+	}
+	for name, values := range w.header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			add(strings.TrimPrefix(name, http.TrailerPrefix), values)
+		}
+	}
+	return trailers
+}
+
+// finish ends the response after the handler returns.
+func (w *responseWriter) finish() {
+	w.WriteHeader(http.StatusOK)
+	if w.err != nil {
+		w.req.s.abort()
+		w.req.finish()
+		return
+	}
+	err := w.resp.End(w.trailerFields())
+	if err != nil {
+		w.req.s.abort()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"strings"
 )
 
 // ErrIndexError is a decoder error for the case where an invalid index is
@@ -15,6 +16,18 @@ var ErrIndexError = errors.New("decoder read an invalid index")
 // a non-pseudo header field.
 var ErrPseudoHeaderOrdering = errors.New("invalid pseudo header field order")
 
+// ErrInvalidHeaderValue indicates that an encoder was asked to encode a header
+// field value that contains NUL, CR, or LF.
+var ErrInvalidHeaderValue = errors.New("header field value contains a forbidden character")
+
+// ErrInvalidPseudoHeader indicates that pseudo header fields are missing,
+// repeated, or not permitted for the type of header block.
+var ErrInvalidPseudoHeader = errors.New("invalid pseudo header fields")
+
+// ErrConnectionHeader indicates that a header block contains a
+// connection-specific header field, which HTTP/2 and HTTP/3 forbid.
+var ErrConnectionHeader = errors.New("connection-specific header field")
+
 // HeaderField is the interface that header fields need to comply with.
 type HeaderField struct {
 	Name      string
@@ -46,6 +59,153 @@ func ValidatePseudoHeaders(headers []HeaderField) error {
 	return nil
 }
 
+// connectionHeaders are the header fields that only make sense for a single
+// HTTP/1.1 connection.
+var connectionHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+// ValidateConnectionHeaders checks that there are no connection-specific header
+// fields.  The only exception is TE, which is allowed with a value of
+// "trailers".
+func ValidateConnectionHeaders(headers []HeaderField) error {
+	for _, h := range headers {
+		name := strings.ToLower(h.Name)
+		if connectionHeaders[name] {
+			return ErrConnectionHeader
+		}
+		if name == "te" && h.Value != "trailers" {
+			return ErrConnectionHeader
+		}
+	}
+	return nil
+}
+
+// PseudoHeaderValidation selects the rules that are used to check the pseudo
+// header fields in a header block.
+type PseudoHeaderValidation byte
+
+const (
+	// ValidateNone skips all checks on pseudo header fields.
+	ValidateNone = PseudoHeaderValidation(iota)
+	// ValidateRequest requires :method, plus :scheme and :path for anything
+	// other than CONNECT, which instead requires :authority.
+	ValidateRequest
+	// ValidateResponse requires :status and nothing else.
+	ValidateResponse
+	// ValidateTrailer doesn't allow any pseudo header fields.
+	ValidateTrailer
+)
+
+func (v PseudoHeaderValidation) String() string {
+	switch v {
+	case ValidateNone:
+		return "none"
+	case ValidateRequest:
+		return "request"
+	case ValidateResponse:
+		return "response"
+	case ValidateTrailer:
+		return "trailer"
+	}
+	return "unknown"
+}
+
+// allowed lists the pseudo header fields that are permitted.
+func (v PseudoHeaderValidation) allowed() []string {
+	switch v {
+	case ValidateRequest:
+		return []string{":method", ":scheme", ":authority", ":path"}
+	case ValidateResponse:
+		return []string{":status"}
+	}
+	return nil
+}
+
+// Validate checks that the pseudo header fields in `headers` are in order and
+// that they follow the rules for this type of header block.
+func (v PseudoHeaderValidation) Validate(headers []HeaderField) error {
+	if v == ValidateNone {
+		return nil
+	}
+	err := ValidatePseudoHeaders(headers)
+	if err != nil {
+		return err
+	}
+	return v.validatePresence(headers)
+}
+
+func (v PseudoHeaderValidation) validatePresence(headers []HeaderField) error {
+	allowed := v.allowed()
+	present := make(map[string]string)
+	for _, h := range headers {
+		if len(h.Name) == 0 || h.Name[0] != ':' {
+			break
+		}
+		if _, dup := present[h.Name]; dup {
+			return ErrInvalidPseudoHeader
+		}
+		ok := false
+		for _, a := range allowed {
+			ok = ok || a == h.Name
+		}
+		if !ok {
+			return ErrInvalidPseudoHeader
+		}
+		present[h.Name] = h.Value
+	}
+
+	var required []string
+	switch v {
+	case ValidateRequest:
+		if present[":method"] == "CONNECT" {
+			required = []string{":authority"}
+		} else {
+			required = []string{":method", ":scheme", ":path"}
+		}
+	case ValidateResponse:
+		required = []string{":status"}
+	}
+	for _, r := range required {
+		if _, ok := present[r]; !ok {
+			return ErrInvalidPseudoHeader
+		}
+	}
+	return nil
+}
+
+// FieldEncoding identifies the representation that an encoder chose for a
+// header field.
+type FieldEncoding byte
+
+const (
+	// FieldEncodingIndexed is a reference to a complete entry in a table.
+	FieldEncodingIndexed = FieldEncoding(iota)
+	// FieldEncodingIncremental is a literal that was also added to the table.
+	FieldEncodingIncremental
+	// FieldEncodingLiteral is a literal that wasn't added to the table.
+	FieldEncodingLiteral
+)
+
+func (fe FieldEncoding) String() string {
+	switch fe {
+	case FieldEncodingIndexed:
+		return "indexed"
+	case FieldEncodingIncremental:
+		return "incremental"
+	case FieldEncodingLiteral:
+		return "literal"
+	}
+	return "unknown"
+}
+
+// FieldTracer is called by an encoder for each header field it writes.
+type FieldTracer func(h HeaderField, encoding FieldEncoding)
+
 type logged struct {
 	logger *log.Logger
 }
@@ -65,6 +225,101 @@ type decoderCommon struct {
 	// Table is public to provide access to its methods.
 	Table Table
 	logged
+
+	// LenientPseudoOrdering causes the decoder to move pseudo-header fields to
+	// the start of a header block rather than rejecting the block when they are
+	// out of order.  This is useful for proxies that need to forward messages
+	// from broken peers.
+	LenientPseudoOrdering bool
+
+	// MaxStringLength is the longest name or value that the decoder accepts,
+	// measured as the length of the encoded string.  Longer strings are
+	// rejected before memory is allocated for them.  Zero means no limit.
+	MaxStringLength int
+
+	// JoinCookies causes the decoder to join all Cookie header fields into
+	// one, separated by "; ".  This undoes CrumbleCookies.
+	JoinCookies bool
+}
+
+// newReader makes a Reader that respects the limits on this decoder.
+func (decoder *decoderCommon) newReader(r io.Reader) *Reader {
+	reader := NewReader(r)
+	if decoder.MaxStringLength > 0 {
+		reader.maxStringLength = uint64(decoder.MaxStringLength)
+	}
+	return reader
+}
+
+// reorderPseudoHeaders moves all pseudo-header fields to the front of the
+// list, preserving the relative order of both pseudo and regular fields.
+func reorderPseudoHeaders(headers []HeaderField) []HeaderField {
+	reordered := make([]HeaderField, 0, len(headers))
+	for _, h := range headers {
+		if h.Name[0] == ':' {
+			reordered = append(reordered, h)
+		}
+	}
+	for _, h := range headers {
+		if h.Name[0] != ':' {
+			reordered = append(reordered, h)
+		}
+	}
+	return reordered
+}
+
+// joinCookies joins Cookie header fields if JoinCookies is set.  The joined
+// field takes the place of the first Cookie header field.
+func (decoder *decoderCommon) joinCookies(headers []HeaderField) []HeaderField {
+	if !decoder.JoinCookies {
+		return headers
+	}
+	result := make([]HeaderField, 0, len(headers))
+	cookie := -1
+	for _, h := range headers {
+		if h.Name != "cookie" {
+			result = append(result, h)
+			continue
+		}
+		if cookie < 0 {
+			cookie = len(result)
+			result = append(result, h)
+			continue
+		}
+		result[cookie].Value += "; " + h.Value
+		result[cookie].Sensitive = result[cookie].Sensitive || h.Sensitive
+	}
+	return result
+}
+
+// checkPseudoHeaders validates the ordering of pseudo-header fields, or
+// reorders them if the decoder is lenient.
+func (decoder *decoderCommon) checkPseudoHeaders(headers []HeaderField) ([]HeaderField, error) {
+	err := ValidatePseudoHeaders(headers)
+	if err == nil || !decoder.LenientPseudoOrdering {
+		return headers, err
+	}
+	decoder.logger.Printf("warning: reordering out of order pseudo-header fields")
+	return reorderPseudoHeaders(headers), nil
+}
+
+// validatePseudoHeaders applies checkPseudoHeaders, then checks that the
+// pseudo header fields are appropriate for the type of header block.  This
+// also rejects connection-specific header fields.
+func (decoder *decoderCommon) validatePseudoHeaders(headers []HeaderField,
+	validation PseudoHeaderValidation) ([]HeaderField, error) {
+	if validation == ValidateNone {
+		return headers, nil
+	}
+	headers, err := decoder.checkPseudoHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidateConnectionHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	return headers, validation.validatePresence(headers)
 }
 
 type encoderCommon struct {
@@ -74,9 +329,109 @@ type encoderCommon struct {
 
 	// HuffmanPreference records preferences for Huffman coding of strings.
 	HuffmanPreference HuffmanCodingChoice
+	// ValidateOnEncode causes header blocks with values that contain NUL, CR,
+	// or LF to be rejected with ErrInvalidHeaderValue, and header blocks with
+	// connection-specific header fields to be rejected with
+	// ErrConnectionHeader.  This is on by default.
+	ValidateOnEncode bool
+	// CrumbleCookies causes the encoder to split Cookie header fields at each
+	// "; " so that each crumb can be compressed separately.
+	CrumbleCookies bool
 
 	// This stores preferences for indexing on a per-name basis.
 	indexPrefs map[string]bool
+	// indexPatterns are preferences for names that match a pattern.
+	indexPatterns []indexPattern
+	// indexDecider replaces the preferences above, if it is set.
+	indexDecider IndexDecider
+}
+
+// TableState describes the table of an encoder when it is deciding whether to
+// index a header field.
+type TableState struct {
+	// Used is the space that entries in the table take.
+	Used TableCapacity
+	// Capacity is the capacity of the table.
+	Capacity TableCapacity
+	// Referenceable is the part of the table that the encoder will reference.
+	// For HPACK, this is the same as Capacity.
+	Referenceable TableCapacity
+}
+
+// IndexDecider decides whether a header field is added to the table.
+type IndexDecider func(h HeaderField, state TableState) bool
+
+// indexPattern is a name pattern with a leading or trailing wildcard.
+type indexPattern struct {
+	pattern string
+	pref    bool
+}
+
+// match checks a lowercase name against the pattern.  A leading `*` matches
+// any prefix, and a trailing `*` matches any suffix.
+func (p indexPattern) match(name string) bool {
+	pattern := p.pattern
+	suffix := strings.HasPrefix(pattern, "*")
+	if suffix {
+		pattern = pattern[1:]
+	}
+	prefix := strings.HasSuffix(pattern, "*")
+	if prefix {
+		pattern = pattern[:len(pattern)-1]
+	}
+	switch {
+	case prefix && suffix:
+		return strings.Contains(name, pattern)
+	case prefix:
+		return strings.HasPrefix(name, pattern)
+	case suffix:
+		return strings.HasSuffix(name, pattern)
+	}
+	return name == pattern
+}
+
+// validateValues checks that header field values don't include characters that
+// HTTP forbids and that there are no connection-specific header fields.
+func (encoder *encoderCommon) validateValues(headers []HeaderField) error {
+	if !encoder.ValidateOnEncode {
+		return nil
+	}
+	for _, h := range headers {
+		if strings.ContainsAny(h.Value, "\x00\r\n") {
+			encoder.logger.Printf("invalid value for %v", h.Name)
+			return ErrInvalidHeaderValue
+		}
+	}
+	err := ValidateConnectionHeaders(headers)
+	if err != nil {
+		encoder.logger.Printf("connection-specific header field")
+	}
+	return err
+}
+
+// crumbleCookies splits Cookie header fields if CrumbleCookies is set.
+func (encoder *encoderCommon) crumbleCookies(headers []HeaderField) []HeaderField {
+	if !encoder.CrumbleCookies {
+		return headers
+	}
+	return CrumbleCookies(headers)
+}
+
+// CrumbleCookies splits Cookie header fields at each "; ", as an encoder does
+// when its CrumbleCookies field is set.  Use this to split the cookies in
+// selected header blocks only.
+func CrumbleCookies(headers []HeaderField) []HeaderField {
+	result := make([]HeaderField, 0, len(headers))
+	for _, h := range headers {
+		if !strings.EqualFold(h.Name, "cookie") || !strings.Contains(h.Value, "; ") {
+			result = append(result, h)
+			continue
+		}
+		for _, crumb := range strings.Split(h.Value, "; ") {
+			result = append(result, HeaderField{h.Name, crumb, h.Sensitive})
+		}
+	}
+	return result
 }
 
 func (encoder encoderCommon) shouldIndex(h HeaderField) bool {
@@ -101,10 +456,21 @@ func (encoder encoderCommon) shouldIndex(h HeaderField) bool {
 	if TableCapacity(len(h.Name)+len(h.Value)+32) > encoder.Table.Capacity() {
 		return false
 	}
+	if encoder.indexDecider != nil {
+		return encoder.indexDecider(h, encoder.tableState())
+	}
 	pref, ok := encoder.indexPrefs[h.Name]
 	if ok {
 		return pref
 	}
+	if len(encoder.indexPatterns) > 0 {
+		name := strings.ToLower(h.Name)
+		for _, p := range encoder.indexPatterns {
+			if p.match(name) {
+				return p.pref
+			}
+		}
+	}
 	_, d := dontIndex[h.Name]
 	if d {
 		return false
@@ -127,3 +493,56 @@ func (encoder *encoderCommon) ClearIndexPreference(name string) {
 	encoder.logger.Printf("clear indexing pref for %v", name)
 	delete(encoder.indexPrefs, name)
 }
+
+// SetIndexPreferencePattern sets preferences for header fields with names
+// that match a pattern.  A pattern can start or end with `*` to match any
+// prefix or suffix, so `x-*` matches all names that start with "x-".
+// Preferences set with SetIndexPreference take priority over patterns.  If
+// more than one pattern matches, the first one that was set is used.
+func (encoder *encoderCommon) SetIndexPreferencePattern(pattern string, pref bool) {
+	encoder.logger.Printf("set indexing pref for pattern %v to %v", pattern, pref)
+	pattern = strings.ToLower(pattern)
+	for i := range encoder.indexPatterns {
+		if encoder.indexPatterns[i].pattern == pattern {
+			encoder.indexPatterns[i].pref = pref
+			return
+		}
+	}
+	encoder.indexPatterns = append(encoder.indexPatterns, indexPattern{pattern, pref})
+}
+
+// ClearIndexPreferencePattern removes a pattern set with SetIndexPreferencePattern.
+func (encoder *encoderCommon) ClearIndexPreferencePattern(pattern string) {
+	encoder.logger.Printf("clear indexing pref for pattern %v", pattern)
+	pattern = strings.ToLower(pattern)
+	for i := range encoder.indexPatterns {
+		if encoder.indexPatterns[i].pattern == pattern {
+			encoder.indexPatterns = append(encoder.indexPatterns[:i], encoder.indexPatterns[i+1:]...)
+			return
+		}
+	}
+}
+
+// tableState reports the current state of the table.
+func (encoder *encoderCommon) tableState() TableState {
+	state := TableState{
+		Used:          encoder.Table.Used(),
+		Capacity:      encoder.Table.Capacity(),
+		Referenceable: encoder.Table.Capacity(),
+	}
+	if qt, ok := encoder.Table.(*QpackEncoderTable); ok {
+		state.Referenceable = qt.referenceableLimit
+	}
+	return state
+}
+
+// SetIndexDecider sets a function that decides which header fields are added
+// to the table.  This replaces the preferences set with SetIndexPreference and
+// SetIndexPreferencePattern, and the default list of names that aren't
+// indexed.  Header fields that don't fit in the table are never indexed.  The
+// decider is called while the encoder is busy, so it can't use the encoder.
+// Set this to nil to restore the default behavior.
+func (encoder *encoderCommon) SetIndexDecider(decider IndexDecider) {
+	encoder.logger.Printf("set index decider")
+	encoder.indexDecider = decider
+}
@@ -0,0 +1,41 @@
+package hc
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// CanonicalHash produces a hash of a header list that is suitable for use in
+// cache keys.  Header fields are sorted by name and then value before
+// hashing, so the order of fields doesn't affect the result.  Names are
+// compared without regard to case.  Values are hashed exactly; no attempt is
+// made to normalize them.  The Sensitive flag is ignored.
+func CanonicalHash(headers []HeaderField) uint64 {
+	sorted := make([]HeaderField, len(headers))
+	for i, h := range headers {
+		sorted[i] = HeaderField{Name: strings.ToLower(h.Name), Value: h.Value}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+
+	// Prefix each string with its length so that moving characters between
+	// name and value changes the hash.
+	h := fnv.New64a()
+	var length [8]byte
+	writeString := func(s string) {
+		binary.BigEndian.PutUint64(length[:], uint64(len(s)))
+		h.Write(length[:])
+		h.Write([]byte(s))
+	}
+	for _, hf := range sorted {
+		writeString(hf.Name)
+		writeString(hf.Value)
+	}
+	return h.Sum64()
+}
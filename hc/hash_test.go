@@ -0,0 +1,37 @@
+package hc_test
+
+import (
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestCanonicalHash(t *testing.T) {
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: "accept", Value: "text/html"},
+		{Name: "accept-language", Value: "en"},
+	}
+	reordered := []hc.HeaderField{
+		{Name: ":path", Value: "/"},
+		{Name: ":method", Value: "GET"},
+		{Name: "Accept-Language", Value: "en"},
+		{Name: "accept", Value: "text/html"},
+	}
+	assert.Equal(t, hc.CanonicalHash(headers), hc.CanonicalHash(reordered))
+
+	changed := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: "accept", Value: "text/plain"},
+		{Name: "accept-language", Value: "en"},
+	}
+	assert.NotEqual(t, hc.CanonicalHash(headers), hc.CanonicalHash(changed))
+
+	// Moving characters between name and value changes the hash.
+	assert.NotEqual(t,
+		hc.CanonicalHash([]hc.HeaderField{{Name: "ab", Value: "c"}}),
+		hc.CanonicalHash([]hc.HeaderField{{Name: "a", Value: "bc"}}))
+}
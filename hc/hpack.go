@@ -53,7 +53,7 @@ func (table *HpackTable) Get(i int) Entry {
 
 // Lookup finds an entry, see Table.Lookup.
 func (table *HpackTable) Lookup(name string, value string) (Entry, Entry) {
-	return table.lookupImpl(hpackStaticTable, name, value, 0, len(table.dynamic))
+	return table.lookupImpl(hpackStaticIndex, name, value, 0, table.dynamic.len())
 }
 
 // Index returns the HPACK table index for the given entry.
@@ -69,6 +69,10 @@ func (table *HpackTable) Index(e Entry) int {
 type HpackDecoder struct {
 	decoderCommon
 	table *HpackTable
+	// maxCapacity is the largest capacity that the encoder can set.
+	maxCapacity TableCapacity
+	// maxHeaderListSize is the largest header list that will be decoded.
+	maxHeaderListSize uint64
 }
 
 // NewHpackDecoder makes a new decoder and sets it up.
@@ -80,6 +84,23 @@ func NewHpackDecoder() *HpackDecoder {
 	return decoder
 }
 
+// SetMaxCapacity sets the largest table capacity that the encoder is permitted
+// to set.  A capacity update that exceeds this fails with
+// ErrCapacityTooLarge.  A value of 0, the default, means that there is no
+// limit.
+func (decoder *HpackDecoder) SetMaxCapacity(capacity TableCapacity) {
+	decoder.maxCapacity = capacity
+}
+
+// SetMaxHeaderListSize limits the size of the header list that a header block
+// can decode to.  The size of a header list is the sum of the size of each
+// field, which is 32 more than the length of the name and value.  Header blocks
+// that exceed this fail with ErrHeaderListTooLarge.  A value of 0, the default,
+// means that there is no limit.
+func (decoder *HpackDecoder) SetMaxHeaderListSize(size uint64) {
+	decoder.maxHeaderListSize = size
+}
+
 func (decoder *HpackDecoder) readIndexed(reader *Reader) (*HeaderField, error) {
 	index, err := reader.ReadIndex(7)
 	if err != nil {
@@ -131,6 +152,9 @@ func (decoder *HpackDecoder) readCapacity(reader *Reader) error {
 	if err != nil {
 		return err
 	}
+	if decoder.maxCapacity > 0 && TableCapacity(capacity) > decoder.maxCapacity {
+		return ErrCapacityTooLarge
+	}
 	decoder.table.SetCapacity(TableCapacity(capacity))
 	return nil
 }
@@ -148,10 +172,27 @@ func (decoder *HpackDecoder) readLiteral(reader *Reader) (*HeaderField, error) {
 	return &HeaderField{name, value, ni == 1}, nil
 }
 
-// ReadHeaderBlock decodes header fields as they arrive.
+// ReadHeaderBlock decodes header fields as they arrive.  If the header list is
+// too large, the remainder of the block is still read so that the table stays
+// in sync with the encoder, but ErrHeaderListTooLarge is returned.
 func (decoder *HpackDecoder) ReadHeaderBlock(r io.Reader) ([]HeaderField, error) {
-	reader := NewReader(r)
+	reader := decoder.newReader(r)
 	headers := []HeaderField{}
+	var listSize uint64
+	var failure error
+	addHeader := func(h *HeaderField) {
+		if failure != nil {
+			return
+		}
+		listSize += uint64(h.size())
+		if decoder.maxHeaderListSize > 0 && listSize > decoder.maxHeaderListSize {
+			decoder.logger.Printf("header list too large at %v", h)
+			failure = ErrHeaderListTooLarge
+			headers = nil
+			return
+		}
+		headers = append(headers, *h)
+	}
 	for {
 		b, err := reader.ReadBit()
 		if err == io.EOF {
@@ -166,7 +207,7 @@ func (decoder *HpackDecoder) ReadHeaderBlock(r io.Reader) ([]HeaderField, error)
 			if err != nil {
 				return nil, err
 			}
-			headers = append(headers, *h)
+			addHeader(h)
 			continue
 		}
 
@@ -180,7 +221,7 @@ func (decoder *HpackDecoder) ReadHeaderBlock(r io.Reader) ([]HeaderField, error)
 			if err != nil {
 				return nil, err
 			}
-			headers = append(headers, *h)
+			addHeader(h)
 			continue
 		}
 
@@ -201,21 +242,14 @@ func (decoder *HpackDecoder) ReadHeaderBlock(r io.Reader) ([]HeaderField, error)
 		if err != nil {
 			return nil, err
 		}
-		headers = append(headers, *h)
+		addHeader(h)
+	}
+	if failure != nil {
+		return nil, failure
 	}
 
 	// Sanity-check header ordering.
-	pseudo := true
-	for _, h := range headers {
-		if h.Name[0] == ':' {
-			if !pseudo {
-				return nil, ErrPseudoHeaderOrdering
-			}
-		} else {
-			pseudo = false
-		}
-	}
-	return headers, nil
+	return decoder.checkPseudoHeaders(decoder.joinCookies(headers))
 }
 
 // HpackEncoder is the top-level class for header compression.
@@ -225,6 +259,8 @@ type HpackEncoder struct {
 	// Track changes to capacity so that we can reflect them properly.
 	minCapacity  TableCapacity
 	nextCapacity TableCapacity
+	// tracer, if set, is told how each header field was encoded.
+	tracer FieldTracer
 }
 
 // NewHpackEncoder makes a new encoder and sets it up.
@@ -233,10 +269,24 @@ func NewHpackEncoder(capacity TableCapacity) *HpackEncoder {
 	encoder.table = new(HpackTable)
 	encoder.Table = encoder.table
 	encoder.SetCapacity(capacity)
+	encoder.ValidateOnEncode = true
 	encoder.initLogging(nil)
 	return encoder
 }
 
+// SetTracer sets a function that is called for each header field that is
+// encoded, reporting whether the field was indexed, inserted, or sent as a
+// literal.  Set this to nil to disable tracing.
+func (encoder *HpackEncoder) SetTracer(tracer FieldTracer) {
+	encoder.tracer = tracer
+}
+
+func (encoder *HpackEncoder) trace(h HeaderField, encoding FieldEncoding) {
+	if encoder.tracer != nil {
+		encoder.tracer(h, encoding)
+	}
+}
+
 func (encoder *HpackEncoder) writeCapacity(writer *Writer, c TableCapacity) error {
 	err := writer.WriteBits(1, 3)
 	if err != nil {
@@ -327,8 +377,13 @@ func (encoder HpackEncoder) writeLiteral(writer *Writer, h HeaderField, nameEntr
 
 // WriteHeaderBlock writes out a header block.
 func (encoder *HpackEncoder) WriteHeaderBlock(w io.Writer, headers ...HeaderField) error {
+	err := encoder.validateValues(headers)
+	if err != nil {
+		return err
+	}
+	headers = encoder.crumbleCookies(headers)
 	writer := NewWriter(w)
-	err := encoder.writeCapacityChange(writer)
+	err = encoder.writeCapacityChange(writer)
 	if err != nil {
 		return err
 	}
@@ -341,25 +396,31 @@ func (encoder *HpackEncoder) WriteHeaderBlock(w io.Writer, headers ...HeaderFiel
 		} else {
 			pseudo = false
 		}
+		var encoding FieldEncoding
 		if h.Sensitive {
 			// It's not clear here whether the name is sensitive, but let's assume that
 			// it might be. It's not exactly rational to put secrets in header field
 			// names (how do you find them again?), but it's safer not to assume rational
 			// behaviour.
 			err = encoder.writeLiteral(writer, h, nil)
+			encoding = FieldEncodingLiteral
 		} else {
 			m, nm := encoder.Table.Lookup(h.Name, h.Value)
 			if m != nil {
 				err = encoder.writeIndexed(writer, m)
+				encoding = FieldEncodingIndexed
 			} else if encoder.shouldIndex(h) {
 				err = encoder.writeIncremental(writer, h, nm)
+				encoding = FieldEncodingIncremental
 			} else {
 				err = encoder.writeLiteral(writer, h, nm)
+				encoding = FieldEncodingLiteral
 			}
 		}
 		if err != nil {
 			return err
 		}
+		encoder.trace(h, encoding)
 	}
 	return nil
 }
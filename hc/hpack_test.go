@@ -127,3 +127,158 @@ func TestHpackEviction(t *testing.T) {
 	assert.Equal(t, headers, h)
 	checkDynamicTable(t, decoder.Table, dynamicTable)
 }
+
+type tracedField struct {
+	name     string
+	encoding hc.FieldEncoding
+}
+
+func TestHpackEncoderTrace(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	var traced []tracedField
+	encoder.SetTracer(func(h hc.HeaderField, encoding hc.FieldEncoding) {
+		traced = append(traced, tracedField{h.Name, encoding})
+	})
+
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf,
+		hc.HeaderField{Name: ":method", Value: "GET"},
+		hc.HeaderField{Name: ":path", Value: "/trace"},
+		hc.HeaderField{Name: "custom-key", Value: "custom-value"},
+		hc.HeaderField{Name: "password", Value: "secret", Sensitive: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []tracedField{
+		{":method", hc.FieldEncodingIndexed},
+		{":path", hc.FieldEncodingLiteral},
+		{"custom-key", hc.FieldEncodingIncremental},
+		{"password", hc.FieldEncodingLiteral},
+	}, traced)
+
+	// The second time, the inserted field is indexed.
+	traced = nil
+	buf.Reset()
+	err = encoder.WriteHeaderBlock(&buf,
+		hc.HeaderField{Name: "custom-key", Value: "custom-value"})
+	assert.Nil(t, err)
+	assert.Equal(t, []tracedField{{"custom-key", hc.FieldEncodingIndexed}}, traced)
+}
+
+func TestHpackDecoderLenientPseudoHeaderOrder(t *testing.T) {
+	decoder := hc.NewHpackDecoder()
+	decoder.LenientPseudoOrdering = true
+	// accept-encoding, :authority, :method, accept-encoding
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x90, 0x81, 0x82, 0x90}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: ":authority", Value: ""},
+		{Name: ":method", Value: "GET"},
+		{Name: "accept-encoding", Value: "gzip, deflate"},
+		{Name: "accept-encoding", Value: "gzip, deflate"},
+	}, headers)
+}
+
+func TestHpackDecoderMaxStringLength(t *testing.T) {
+	decoder := hc.NewHpackDecoder()
+	decoder.MaxStringLength = 8
+
+	// A literal with a name that fits.
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{
+		0x00, 0x01, 'a', 0x01, 'b'}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "a", Value: "b"}}, headers)
+
+	// A Huffman-encoded name with a length of about 2^35.  This is rejected
+	// before anything is allocated.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{
+		0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}))
+	assert.Equal(t, hc.ErrStringTooLong, err)
+}
+
+func TestHpackDecoderMaxCapacity(t *testing.T) {
+	decoder := hc.NewHpackDecoder()
+	decoder.SetMaxCapacity(256)
+
+	// Capacity updates to 256 and 257.
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x3f, 0xe1, 0x01}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{}, headers)
+	assert.Equal(t, hc.TableCapacity(256), decoder.Table.Capacity())
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x3f, 0xe2, 0x01}))
+	assert.Equal(t, hc.ErrCapacityTooLarge, err)
+	assert.Equal(t, hc.TableCapacity(256), decoder.Table.Capacity())
+}
+
+func TestHpackDecoderMaxHeaderListSize(t *testing.T) {
+	decoder := hc.NewHpackDecoder()
+	decoder.SetMaxHeaderListSize(40)
+
+	// Set the capacity to 256, then insert "a: b" and "c: d", which is 68
+	// octets of header list.
+	_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{
+		0x3f, 0xe1, 0x01,
+		0x40, 0x01, 'a', 0x01, 'b',
+		0x40, 0x01, 'c', 0x01, 'd'}))
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+
+	// Both entries were still added to the table.
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0xbe}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "c", Value: "d"}}, headers)
+	headers, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0xbf}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "a", Value: "b"}}, headers)
+}
+
+func TestHpackEncoderInvalidValue(t *testing.T) {
+	encoder := hc.NewHpackEncoder(256)
+	var buf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&buf, hc.HeaderField{Name: "a", Value: "b\x00"})
+	assert.Equal(t, hc.ErrInvalidHeaderValue, err)
+	assert.Equal(t, 0, buf.Len())
+}
+
+// responseHeaders is a realistic set of response header fields.
+var responseHeaders = []hc.HeaderField{
+	{Name: ":status", Value: "200"},
+	{Name: "accept-ranges", Value: "bytes"},
+	{Name: "access-control-allow-origin", Value: "*"},
+	{Name: "age", Value: "3151"},
+	{Name: "alt-svc", Value: "h3=\":443\"; ma=86400"},
+	{Name: "cache-control", Value: "public, max-age=31536000"},
+	{Name: "content-encoding", Value: "br"},
+	{Name: "content-length", Value: "12894"},
+	{Name: "content-security-policy", Value: "default-src 'self'"},
+	{Name: "content-type", Value: "text/html; charset=utf-8"},
+	{Name: "date", Value: "Mon, 21 Oct 2013 20:13:21 GMT"},
+	{Name: "etag", Value: "\"33a64df551425fcc55e4d42a148795d9f25f89d4\""},
+	{Name: "expect-ct", Value: "max-age=604800"},
+	{Name: "expires", Value: "Thu, 01 Dec 1994 16:00:00 GMT"},
+	{Name: "last-modified", Value: "Tue, 15 Nov 1994 12:45:26 GMT"},
+	{Name: "link", Value: "</style.css>; rel=preload; as=style"},
+	{Name: "nel", Value: "{\"report_to\":\"default\",\"max_age\":2592000}"},
+	{Name: "permissions-policy", Value: "interest-cohort=()"},
+	{Name: "referrer-policy", Value: "strict-origin-when-cross-origin"},
+	{Name: "report-to", Value: "{\"group\":\"default\",\"max_age\":2592000}"},
+	{Name: "server", Value: "minhq"},
+	{Name: "set-cookie", Value: "id=a3fWa; Max-Age=2592000"},
+	{Name: "set-cookie", Value: "lang=en-US; Path=/"},
+	{Name: "strict-transport-security", Value: "max-age=31536000"},
+	{Name: "timing-allow-origin", Value: "*"},
+	{Name: "vary", Value: "accept-encoding"},
+	{Name: "via", Value: "1.1 cache"},
+	{Name: "x-content-type-options", Value: "nosniff"},
+	{Name: "x-frame-options", Value: "SAMEORIGIN"},
+	{Name: "x-xss-protection", Value: "1; mode=block"},
+}
+
+func BenchmarkHpackEncodeResponse(b *testing.B) {
+	encoder := hc.NewHpackEncoder(4096)
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		err := encoder.WriteHeaderBlock(&buf, responseHeaders...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,10 +3,22 @@ package hc
 import (
 	"errors"
 	"io"
+	"sync"
 
 	bitio "github.com/martinthomson/minhq/io"
 )
 
+// ErrHuffmanPadding is returned by HuffmanDecompressor if Huffman-encoded data
+// ends with more than 7 bits of padding or padding that isn't all ones.
+var ErrHuffmanPadding = errors.New("invalid Huffman padding")
+
+// ErrHuffmanEOS is returned by HuffmanDecompressor if the encoded data
+// includes the EOS symbol.
+var ErrHuffmanEOS = errors.New("Huffman-encoded data includes EOS")
+
+// huffmanEOSLength is the length of the EOS symbol, which is all ones.
+const huffmanEOSLength = 30
+
 // HuffmanCompressor is a progressive compressor for Huffman-encoded data.
 type HuffmanCompressor struct {
 	writer    bitio.BitWriter
@@ -36,7 +48,8 @@ func (compressor *HuffmanCompressor) Pad() error {
 	return compressor.writer.Pad(0xff)
 }
 
-// This is a huffmanDecoderNode in the reverse mapping tree.  We use 4-bit chunks because those result in at most a single emission of a character.
+// This is a huffmanDecoderNode in the reverse mapping tree.  The tree is only
+// used to build huffmanTransitions.
 type huffmanDecoderNode struct {
 	next [2]*huffmanDecoderNode
 	leaf bool
@@ -78,43 +91,172 @@ func makeLayer(prefix uint32, prefixLen byte) *huffmanDecoderNode {
 	return layer
 }
 
-var decompressorTree *huffmanDecoderNode
+// These flags describe what happens when a huffmanTransition is taken.
+const (
+	// huffmanEmit is set if a symbol is decoded.
+	huffmanEmit = 1 << iota
+	// huffmanFail is set if the input isn't a valid Huffman code.
+	huffmanFail
+	// huffmanEOS is set if the input includes the EOS symbol.
+	huffmanEOS
+)
+
+// huffmanTransition is what the decompressor does with 4 bits of input in a
+// given state.  We use 4-bit chunks because those result in at most a single
+// emission of a character; the shortest code is 5 bits.
+type huffmanTransition struct {
+	next  uint16
+	val   byte
+	flags byte
+}
+
+// huffmanState is a non-leaf node in the decoder tree.  depth is the number
+// of bits since the last symbol and ones is true if all of those bits were
+// ones.
+type huffmanState struct {
+	node  *huffmanDecoderNode
+	depth int
+	ones  bool
+}
+
+var (
+	// huffmanTransitions is indexed by state and then 4 bits of input.  State 0
+	// is the start of a symbol.
+	huffmanTransitions [][16]huffmanTransition
+	// huffmanPadding is true for each state that is valid padding: no more
+	// than 7 bits, all set to one.
+	huffmanPadding []bool
+	huffmanOnce    sync.Once
+)
 
-func initDecompressorTree() {
-	if decompressorTree == nil {
-		decompressorTree = makeLayer(0, 0)
+// step takes a single bit in the tree, returning the new state and any
+// transition flags.
+func (s *huffmanState) step(root *huffmanDecoderNode, b byte) (byte, byte) {
+	s.depth++
+	s.ones = s.ones && b == 1
+	if s.ones && s.depth >= huffmanEOSLength {
+		return 0, huffmanEOS
+	}
+	s.node = s.node.next[b]
+	if s.node == nil {
+		return 0, huffmanFail
+	}
+	if s.node.leaf {
+		val := s.node.val
+		*s = huffmanState{root, 0, true}
+		return val, huffmanEmit
+	}
+	return 0, 0
+}
+
+func initDecompressorTable() {
+	root := makeLayer(0, 0)
+	states := []huffmanState{{root, 0, true}}
+	ids := map[*huffmanDecoderNode]uint16{root: 0}
+	// Note that this appends to states as it goes.
+	for i := 0; i < len(states); i++ {
+		huffmanPadding = append(huffmanPadding, states[i].ones && states[i].depth <= 7)
+		var row [16]huffmanTransition
+		for nibble := range row {
+			s := states[i]
+			t := &row[nibble]
+			for bit := 3; bit >= 0; bit-- {
+				val, flags := s.step(root, byte(nibble>>uint(bit))&1)
+				if flags&huffmanEmit != 0 {
+					t.val = val
+				}
+				t.flags |= flags
+				if flags&(huffmanFail|huffmanEOS) != 0 {
+					break
+				}
+			}
+			if t.flags&(huffmanFail|huffmanEOS) != 0 {
+				continue
+			}
+			id, ok := ids[s.node]
+			if !ok {
+				id = uint16(len(states))
+				ids[s.node] = id
+				states = append(states, s)
+			}
+			t.next = id
+		}
+		huffmanTransitions = append(huffmanTransitions, row)
 	}
 }
 
 // HuffmanDecompressor is the opposite of huffmanCompressor
 type HuffmanDecompressor struct {
 	reader bitio.BitReader
-	cursor *huffmanDecoderNode
+	state  uint16
+	// saved holds the second 4 bits of the last octet if there wasn't space to
+	// decode them.
+	saved    byte
+	hasSaved bool
 }
 
 // NewHuffmanDecompressor makes a new decompressor, which implements io.Reader.
 func NewHuffmanDecompressor(reader io.Reader) *HuffmanDecompressor {
-	initDecompressorTree()
-	return &HuffmanDecompressor{bitio.NewBitReader(reader), decompressorTree}
+	huffmanOnce.Do(initDecompressorTable)
+	return &HuffmanDecompressor{reader: bitio.NewBitReader(reader)}
 }
 
-// Read bytes of input and decode.
+// take decodes 4 bits of input, writing to p[i] if a symbol is decoded.
+func (decompressor *HuffmanDecompressor) take(nibble byte, p []byte, i int) (int, error) {
+	t := &huffmanTransitions[decompressor.state][nibble]
+	if t.flags&huffmanEmit != 0 {
+		p[i] = t.val
+		i++
+	}
+	if t.flags&huffmanEOS != 0 {
+		return i, ErrHuffmanEOS
+	}
+	if t.flags&huffmanFail != 0 {
+		return i, errors.New("invalid Huffman coding")
+	}
+	decompressor.state = t.next
+	return i, nil
+}
+
+// Read bytes of input and decode.  At the end of the input, this checks that
+// any partial symbol is valid padding: no more than 7 bits, all set to one.
 func (decompressor *HuffmanDecompressor) Read(p []byte) (int, error) {
 	i := 0
+	var err error
+	if decompressor.hasSaved && len(p) > 0 {
+		decompressor.hasSaved = false
+		i, err = decompressor.take(decompressor.saved, p, i)
+		if err != nil {
+			return i, err
+		}
+	}
 	for i < len(p) {
-		b, err := decompressor.reader.ReadBit()
+		var b byte
+		b, err = decompressor.reader.ReadByte()
+		if err == io.EOF {
+			if !huffmanPadding[decompressor.state] {
+				return i, ErrHuffmanPadding
+			}
+			return i, err
+		}
 		if err != nil {
 			return i, err
 		}
 
-		decompressor.cursor = decompressor.cursor.next[b]
-		if decompressor.cursor == nil {
-			return i, errors.New("invalid Huffman coding")
+		i, err = decompressor.take(b>>4, p, i)
+		if err != nil {
+			return i, err
+		}
+		// Each 4 bits produces at most one symbol, so if the first half of the
+		// octet filled the buffer, save the second half for next time.
+		if i >= len(p) {
+			decompressor.saved = b & 0xf
+			decompressor.hasSaved = true
+			break
 		}
-		if decompressor.cursor.leaf {
-			p[i] = decompressor.cursor.val
-			i++
-			decompressor.cursor = decompressorTree
+		i, err = decompressor.take(b&0xf, p, i)
+		if err != nil {
+			return i, err
 		}
 	}
 	return i, nil
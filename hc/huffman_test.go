@@ -3,6 +3,7 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -59,3 +60,59 @@ func TestHuffmanDecompress(t *testing.T) {
 		assert.Equal(t, decompressed[0:n], []byte(v.text))
 	}
 }
+
+func decompressAll(encoded []byte) ([]byte, error) {
+	decompressor := hc.NewHuffmanDecompressor(bytes.NewReader(encoded))
+	decompressed := make([]byte, len(encoded)*2)
+	n, err := decompressor.Read(decompressed)
+	return decompressed[:n], err
+}
+
+func TestHuffmanPadding(t *testing.T) {
+	// "a" is 00011, so 3 bits of padding is valid.
+	decompressed, err := decompressAll([]byte{0x1f})
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("a"), decompressed)
+
+	// Padding that isn't all ones.
+	_, err = decompressAll([]byte{0x1d})
+	assert.Equal(t, hc.ErrHuffmanPadding, err)
+
+	// Padding that is longer than 7 bits.
+	_, err = decompressAll([]byte{0x1f, 0xff})
+	assert.Equal(t, hc.ErrHuffmanPadding, err)
+
+	// A complete EOS symbol.
+	_, err = decompressAll([]byte{0x1f, 0xff, 0xff, 0xff, 0xf0})
+	assert.Equal(t, hc.ErrHuffmanEOS, err)
+}
+
+func BenchmarkHuffmanDecompress(b *testing.B) {
+	var text bytes.Buffer
+	for text.Len() < 64*1024 {
+		for _, v := range tests {
+			text.WriteString(v.text)
+		}
+	}
+	var buffer bytes.Buffer
+	compressor := hc.NewHuffmanCompressor(&buffer)
+	_, err := compressor.Write(text.Bytes())
+	if err == nil {
+		err = compressor.Pad()
+	}
+	if err != nil {
+		b.Fatal(err)
+	}
+	compressed := buffer.Bytes()
+
+	decompressed := make([]byte, text.Len()+1)
+	b.SetBytes(int64(text.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decompressor := hc.NewHuffmanDecompressor(bytes.NewReader(compressed))
+		n, err := io.ReadFull(decompressor, decompressed)
+		if err != io.ErrUnexpectedEOF || n != text.Len() {
+			b.Fatalf("decompression failed: %v", err)
+		}
+	}
+}
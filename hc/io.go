@@ -11,14 +11,62 @@ import (
 // ErrIntegerOverflow is used to signal integer overflow.
 var ErrIntegerOverflow = errors.New("integer overflow")
 
+// ErrStringTooLong is used when a string is longer than the configured maximum.
+var ErrStringTooLong = errors.New("string too long")
+
 // Reader wraps BitReader with more methods
 type Reader struct {
 	bitio.BitReader
+	// maxStringLength is the largest string that ReadString accepts.  Zero
+	// means that any length is accepted.
+	maxStringLength uint64
+	// bits is the number of bits that have been read.
+	bits uint64
 }
 
 // NewReader wraps the reader with HPACK-specific reading functions.
 func NewReader(reader io.Reader) *Reader {
-	return &Reader{bitio.NewBitReader(reader)}
+	return &Reader{BitReader: bitio.NewBitReader(reader)}
+}
+
+// ReadBit reads a single bit, counting it.
+func (hr *Reader) ReadBit() (byte, error) {
+	b, err := hr.BitReader.ReadBit()
+	if err == nil {
+		hr.bits++
+	}
+	return b, err
+}
+
+// ReadBits reads multiple bits, counting them.
+func (hr *Reader) ReadBits(count byte) (uint64, error) {
+	v, err := hr.BitReader.ReadBits(count)
+	if err == nil {
+		hr.bits += uint64(count)
+	}
+	return v, err
+}
+
+// ReadByte reads a single octet, counting it.
+func (hr *Reader) ReadByte() (byte, error) {
+	b, err := hr.BitReader.ReadByte()
+	if err == nil {
+		hr.bits += 8
+	}
+	return b, err
+}
+
+// Read reads octets, counting them.
+func (hr *Reader) Read(p []byte) (int, error) {
+	n, err := hr.BitReader.Read(p)
+	hr.bits += uint64(n) * 8
+	return n, err
+}
+
+// Offset returns the offset of the octet that will be read next, or the octet
+// that is partially read.
+func (hr *Reader) Offset() int {
+	return int(hr.bits / 8)
 }
 
 // ReadInt reads an HPACK integer with the specified prefix length.
@@ -73,10 +121,17 @@ func (hr *Reader) ReadIndex(prefix byte) (int, error) {
 func (hr *Reader) ReadString(prefix byte) (string, error) {
 	huffman, err := hr.ReadBit()
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 	len, err := hr.ReadInt(prefix)
 	if err != nil {
+		return "", err
+	}
+	// Check before allocating so that a bogus length can't force a large allocation.
+	if hr.maxStringLength > 0 && len > hr.maxStringLength {
+		return "", ErrStringTooLong
+	}
+	if len == 0 {
 		return "", nil
 	}
 	var valueReader io.Reader = &io.LimitedReader{R: hr, N: int64(len)}
@@ -200,3 +255,36 @@ func (hw *Writer) WriteStringRaw(s string, prefix byte, huffman HuffmanCodingCho
 func (hw *Writer) WriteString(s string, prefix byte) error {
 	return hw.WriteStringRaw(s, prefix, HuffmanCodingAuto)
 }
+
+// EncodeInteger writes a single HPACK integer to `w`.  The bits ahead of the
+// prefix in the first octet are set to zero.  `prefix` is between 1 and 8.
+func EncodeInteger(w io.Writer, v uint64, prefix byte) error {
+	hw := NewWriter(w)
+	err := hw.WriteBits(0, 8-prefix)
+	if err != nil {
+		return err
+	}
+	return hw.WriteInt(v, prefix)
+}
+
+// DecodeInteger reads a single HPACK integer from `r`, ignoring the bits ahead
+// of the prefix in the first octet.  `prefix` is between 1 and 8.
+func DecodeInteger(r io.Reader, prefix byte) (uint64, error) {
+	hr := NewReader(r)
+	_, err := hr.ReadBits(8 - prefix)
+	if err != nil {
+		return 0, err
+	}
+	return hr.ReadInt(prefix)
+}
+
+// EncodeString writes a single HPACK string to `w`, which includes the Huffman
+// flag and a length with a 7-bit prefix.
+func EncodeString(w io.Writer, s string, huffman HuffmanCodingChoice) error {
+	return NewWriter(w).WriteStringRaw(s, 7, huffman)
+}
+
+// DecodeString reads a single HPACK string from `r`.
+func DecodeString(r io.Reader) (string, error) {
+	return NewReader(r).ReadString(7)
+}
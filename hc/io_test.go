@@ -3,6 +3,7 @@ package hc_test
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -73,6 +74,36 @@ func TestIntegerOverflow(t *testing.T) {
 	}
 }
 
+func TestIntegerRoundTrip(t *testing.T) {
+	for prefix := byte(1); prefix <= 8; prefix++ {
+		limit := uint64(1)<<prefix - 1
+		for _, v := range []uint64{0, limit - 1, limit, limit + 1, 1 << 20, 1<<63 + 1, ^uint64(0)} {
+			var encoded bytes.Buffer
+			assert.Nil(t, hc.EncodeInteger(&encoded, v, prefix))
+			// Values below the limit fit in one octet.
+			if v < limit {
+				assert.Equal(t, 1, encoded.Len())
+			} else {
+				assert.True(t, encoded.Len() > 1)
+			}
+			decoded, err := hc.DecodeInteger(&encoded, prefix)
+			assert.Nil(t, err)
+			assert.Equal(t, v, decoded)
+			assert.Equal(t, 0, encoded.Len())
+		}
+	}
+}
+
+func TestDecodeInteger(t *testing.T) {
+	// The bits ahead of the prefix are ignored.
+	v, err := hc.DecodeInteger(bytes.NewReader([]byte{0xea}), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), v)
+
+	_, err = hc.DecodeInteger(bytes.NewReader([]byte{0x1f, 0x80}), 5)
+	assert.Equal(t, io.EOF, err)
+}
+
 var encodedStrings = []struct {
 	value   string
 	encoded string
@@ -116,3 +147,26 @@ func TestWriteString(t *testing.T) {
 		assert.Equal(t, expected, encoded.Bytes())
 	}
 }
+
+func TestStringRoundTrip(t *testing.T) {
+	values := []string{"", "a", "no-cache", "\x00\xff binary \x7f", string(make([]byte, 300))}
+	for _, v := range values {
+		for _, huffman := range []hc.HuffmanCodingChoice{
+			hc.HuffmanCodingAuto, hc.HuffmanCodingAlways, hc.HuffmanCodingNever,
+		} {
+			var encoded bytes.Buffer
+			assert.Nil(t, hc.EncodeString(&encoded, v, huffman))
+			if huffman != hc.HuffmanCodingAuto && len(v) > 0 {
+				assert.Equal(t, huffman == hc.HuffmanCodingAlways, encoded.Bytes()[0]&0x80 != 0)
+			}
+			decoded, err := hc.DecodeString(&encoded)
+			assert.Nil(t, err)
+			assert.Equal(t, v, decoded)
+		}
+	}
+}
+
+func TestDecodeStringTruncated(t *testing.T) {
+	_, err := hc.DecodeString(bytes.NewReader([]byte{0x7f}))
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,304 @@
+package hc
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrInvalidPriority is returned when a Priority header field value is badly formed.
+var ErrInvalidPriority = errors.New("invalid priority header field value")
+
+// DefaultUrgency is the urgency that applies when the Priority header field
+// doesn't include one.
+const DefaultUrgency = 3
+
+// MaxUrgency is the largest (and least urgent) urgency value.
+const MaxUrgency = 7
+
+// ParsePriority parses the value of a Priority header field, which is a
+// structured field dictionary.  This returns the urgency (u) and incremental
+// (i) parameters, using defaults for any that are absent.  Other dictionary
+// members are ignored.
+func ParsePriority(value string) (int, bool, error) {
+	urgency := DefaultUrgency
+	incremental := false
+	p := sfParser{s: value}
+	p.skipSpace()
+	for !p.done() {
+		key, err := p.parseKey()
+		if err != nil {
+			return 0, false, err
+		}
+		var item interface{} = true
+		if p.consume('=') {
+			if p.peek() == '(' {
+				item, err = p.skipInnerList()
+			} else {
+				item, err = p.parseBareItem()
+			}
+			if err != nil {
+				return 0, false, err
+			}
+		}
+		err = p.skipParameters()
+		if err != nil {
+			return 0, false, err
+		}
+
+		switch key {
+		case "u":
+			u, ok := item.(int64)
+			if !ok || u < 0 || u > MaxUrgency {
+				return 0, false, ErrInvalidPriority
+			}
+			urgency = int(u)
+		case "i":
+			i, ok := item.(bool)
+			if !ok {
+				return 0, false, ErrInvalidPriority
+			}
+			incremental = i
+		}
+
+		p.skipOWS()
+		if p.done() {
+			break
+		}
+		if !p.consume(',') {
+			return 0, false, ErrInvalidPriority
+		}
+		p.skipOWS()
+		if p.done() {
+			// A trailing comma isn't allowed.
+			return 0, false, ErrInvalidPriority
+		}
+	}
+	return urgency, incremental, nil
+}
+
+// FormatPriority produces a value for the Priority header field.  The urgency
+// is always included; the incremental flag is only included if it is set.
+func FormatPriority(urgency int, incremental bool) (string, error) {
+	if urgency < 0 || urgency > MaxUrgency {
+		return "", ErrInvalidPriority
+	}
+	v := "u=" + strconv.Itoa(urgency)
+	if incremental {
+		v += ", i"
+	}
+	return v, nil
+}
+
+// sfParser is just enough of a structured field parser to read a dictionary
+// and skip over the values that aren't understood.
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) consume(c byte) bool {
+	if p.peek() == c && !p.done() {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *sfParser) skipSpace() {
+	for p.consume(' ') {
+	}
+}
+
+func (p *sfParser) skipOWS() {
+	for p.consume(' ') || p.consume('\t') {
+	}
+}
+
+func isLcAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (p *sfParser) parseKey() (string, error) {
+	start := p.i
+	c := p.peek()
+	if !isLcAlpha(c) && c != '*' {
+		return "", ErrInvalidPriority
+	}
+	p.i++
+	for !p.done() {
+		c = p.peek()
+		if !isLcAlpha(c) && !isDigit(c) && c != '_' && c != '-' && c != '.' && c != '*' {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+// parseBareItem returns an int64 for integers, a bool for booleans, and a
+// string for everything else.  Decimals, strings, tokens, and byte sequences
+// are checked, but not decoded.
+func (p *sfParser) parseBareItem() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '-' || isDigit(c):
+		return p.parseNumber()
+	case c == '?':
+		p.i++
+		if p.consume('1') {
+			return true, nil
+		}
+		if p.consume('0') {
+			return false, nil
+		}
+	case c == '"':
+		return p.skipString()
+	case c == ':':
+		return p.skipByteSequence()
+	case isLcAlpha(c) || (c >= 'A' && c <= 'Z') || c == '*':
+		return p.skipToken(), nil
+	}
+	return nil, ErrInvalidPriority
+}
+
+func (p *sfParser) parseNumber() (interface{}, error) {
+	start := p.i
+	p.consume('-')
+	digits := 0
+	decimal := -1
+	for !p.done() {
+		c := p.peek()
+		if c == '.' && decimal < 0 {
+			decimal = digits
+		} else if !isDigit(c) {
+			break
+		} else {
+			digits++
+		}
+		p.i++
+	}
+	if digits == 0 {
+		return nil, ErrInvalidPriority
+	}
+	if decimal >= 0 {
+		if decimal == digits || decimal > 12 || digits-decimal > 3 {
+			return nil, ErrInvalidPriority
+		}
+		return p.s[start:p.i], nil
+	}
+	if digits > 15 {
+		return nil, ErrInvalidPriority
+	}
+	v, err := strconv.ParseInt(p.s[start:p.i], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidPriority
+	}
+	return v, nil
+}
+
+func (p *sfParser) skipString() (interface{}, error) {
+	start := p.i
+	p.i++ // the opening quote
+	for !p.done() {
+		c := p.peek()
+		p.i++
+		switch {
+		case c == '\\':
+			if p.peek() != '"' && p.peek() != '\\' {
+				return nil, ErrInvalidPriority
+			}
+			p.i++
+		case c == '"':
+			return p.s[start:p.i], nil
+		case c < 0x20 || c > 0x7e:
+			return nil, ErrInvalidPriority
+		}
+	}
+	return nil, ErrInvalidPriority
+}
+
+func (p *sfParser) skipByteSequence() (interface{}, error) {
+	start := p.i
+	p.i++ // the opening colon
+	for !p.done() {
+		c := p.peek()
+		p.i++
+		if c == ':' {
+			return p.s[start:p.i], nil
+		}
+		if !isLcAlpha(c) && !(c >= 'A' && c <= 'Z') && !isDigit(c) &&
+			c != '+' && c != '/' && c != '=' {
+			return nil, ErrInvalidPriority
+		}
+	}
+	return nil, ErrInvalidPriority
+}
+
+func (p *sfParser) skipToken() string {
+	start := p.i
+	p.i++
+	for !p.done() {
+		c := p.peek()
+		if c <= 0x20 || c >= 0x7f || c == ',' || c == ';' || c == '=' ||
+			c == '"' || c == '(' || c == ')' {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+func (p *sfParser) skipInnerList() (interface{}, error) {
+	start := p.i
+	p.i++ // the opening parenthesis
+	for {
+		p.skipSpace()
+		if p.consume(')') {
+			return p.s[start:p.i], nil
+		}
+		_, err := p.parseBareItem()
+		if err != nil {
+			return nil, err
+		}
+		err = p.skipParameters()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ' ' && p.peek() != ')' {
+			return nil, ErrInvalidPriority
+		}
+	}
+}
+
+// skipParameters skips any parameters that follow a dictionary member.
+func (p *sfParser) skipParameters() error {
+	for p.consume(';') {
+		p.skipSpace()
+		_, err := p.parseKey()
+		if err != nil {
+			return err
+		}
+		if p.consume('=') {
+			_, err = p.parseBareItem()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
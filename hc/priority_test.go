@@ -0,0 +1,72 @@
+package hc_test
+
+import (
+	"testing"
+
+	"github.com/martinthomson/minhq/hc"
+	"github.com/stvp/assert"
+)
+
+func TestParsePriority(t *testing.T) {
+	for _, tc := range []struct {
+		value       string
+		urgency     int
+		incremental bool
+	}{
+		{"", 3, false},
+		{"u=5", 5, false},
+		{"i", 3, true},
+		{"u=0, i", 0, true},
+		{"i=?0,u=7", 7, false},
+		{"i=?1", 3, true},
+		{"  u=1 ,\ti", 1, true},
+		{"u=2;x=1, i;y", 2, true},
+		{"foo=\"a, b\", u=6", 6, false},
+		{"bar=(1 2 tok), u=4", 4, false},
+		{"x=:AQID:, y=1.5, z=tok/1, u=1", 1, false},
+		{"u=1, u=2", 2, false},
+	} {
+		u, i, err := hc.ParsePriority(tc.value)
+		assert.Nil(t, err, tc.value)
+		assert.Equal(t, tc.urgency, u, tc.value)
+		assert.Equal(t, tc.incremental, i, tc.value)
+	}
+}
+
+func TestParsePriorityInvalid(t *testing.T) {
+	for _, value := range []string{
+		"u=8",
+		"u=-1",
+		"u=1.0",
+		"u=?1",
+		"i=1",
+		"i=\"yes\"",
+		"U=1",
+		"u=1,",
+		"u=1 i",
+		",u=1",
+		"x=\"unterminated",
+		"x=(1 2",
+		"u=",
+	} {
+		_, _, err := hc.ParsePriority(value)
+		assert.Equal(t, hc.ErrInvalidPriority, err, value)
+	}
+}
+
+func TestFormatPriority(t *testing.T) {
+	v, err := hc.FormatPriority(5, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "u=5", v)
+
+	v, err = hc.FormatPriority(0, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "u=0, i", v)
+	u, i, err := hc.ParsePriority(v)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, u)
+	assert.True(t, i)
+
+	_, err = hc.FormatPriority(8, false)
+	assert.Equal(t, hc.ErrInvalidPriority, err)
+}
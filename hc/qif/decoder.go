@@ -8,6 +8,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/martinthomson/minhq/hc"
 	hqio "github.com/martinthomson/minhq/io"
@@ -21,6 +22,7 @@ type decoder struct {
 
 	stream uint64
 	qpack  *hc.QpackDecoder
+	acks   *ackWriter
 }
 
 type ioSink struct{}
@@ -37,7 +39,40 @@ func (sink *ioSink) Close() error {
 
 var devnull ioSink
 
-func newDecoder(inputName string, outputName string) *decoder {
+// ackWriter writes the decoder stream to a file.  Each instruction is framed
+// in the same way as the input: a 64-bit stream identifier, which is always
+// 0, a 32-bit length, then the instruction.
+type ackWriter struct {
+	file   *os.File
+	output hqio.BitWriter
+	// closed is closed when the decoder stops writing.
+	closed chan struct{}
+}
+
+func newAckWriter(name string) *ackWriter {
+	file, err := os.OpenFile(name, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	check(err)
+	return &ackWriter{file, hqio.NewBitWriter(file), make(chan struct{})}
+}
+
+func (aw *ackWriter) Write(p []byte) (int, error) {
+	err := aw.output.WriteBits(0, 64)
+	if err != nil {
+		return 0, err
+	}
+	err = aw.output.WriteBits(uint64(len(p)), 32)
+	if err != nil {
+		return 0, err
+	}
+	return aw.output.Write(p)
+}
+
+func (aw *ackWriter) Close() error {
+	defer close(aw.closed)
+	return aw.file.Close()
+}
+
+func newDecoder(inputName string, outputName string, ackName string) *decoder {
 	dec := new(decoder)
 
 	var err error
@@ -63,7 +98,12 @@ func newDecoder(inputName string, outputName string) *decoder {
 
 	dec.input = hqio.NewBitReader(dec.inputFile)
 	dec.output = dec.outputFile
-	dec.qpack = hc.NewQpackDecoder(&devnull, 4096)
+	if ackName == "" {
+		dec.qpack = hc.NewQpackDecoder(&devnull, 4096)
+	} else {
+		dec.acks = newAckWriter(ackName)
+		dec.qpack = hc.NewQpackDecoder(dec.acks, 4096)
+	}
 	return dec
 }
 
@@ -87,6 +127,13 @@ func (dec *decoder) writeBlock(block []hc.HeaderField) {
 	dec.output.Write([]byte{'\n'})
 }
 
+// logTable logs the contents of the dynamic table.
+func (dec *decoder) logTable(logger *log.Logger) {
+	for i, hf := range dec.qpack.TableSnapshot() {
+		logger.Printf("table[%d] %s: %s\n", i, hf.Name, hf.Value)
+	}
+}
+
 func (dec *decoder) Decode(logger *log.Logger) {
 	dec.qpack.SetLogger(logger)
 
@@ -114,6 +161,9 @@ func (dec *decoder) Decode(logger *log.Logger) {
 			updateStream.AddReader(reader)
 		} else {
 			headers, err := dec.qpack.ReadHeaderBlock(reader, stream)
+			if err != nil {
+				dec.logTable(logger)
+			}
 			check(err)
 			dec.writeBlock(headers)
 		}
@@ -182,6 +232,9 @@ func (dec *decoder) DecodeAsync(logger *log.Logger) {
 			defer wg.Done()
 			logger.Println("stream", stream)
 			headers, err := dec.qpack.ReadHeaderBlock(reader, stream)
+			if err != nil {
+				dec.logTable(logger)
+			}
 			check(err)
 			results <- &result{stream, headers}
 		}(stream, reader)
@@ -195,7 +248,19 @@ func (dec *decoder) DecodeAsync(logger *log.Logger) {
 	}
 }
 
+// SetAckDelay sets the delay before Table State Synchronize instructions are
+// written.
+func (dec *decoder) SetAckDelay(delay time.Duration) {
+	dec.qpack.SetAckDelay(delay)
+}
+
 func (dec *decoder) Close() error {
+	if dec.acks != nil {
+		// Stop the decoder and wait for it to finish writing.  A Table State
+		// Synchronize instruction that is still waiting is lost.
+		check(dec.qpack.Close())
+		<-dec.acks.closed
+	}
 	check(dec.inputFile.Close())
 	check(dec.outputFile.Close())
 	return nil
@@ -7,6 +7,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"time"
 
 	"github.com/martinthomson/minhq/hc"
 )
@@ -23,9 +24,12 @@ func usage() {
 		"    -r    Set the referenceable capacity (must be after -t)\n" +
 		"    -v    Verbose logging\n\n" +
 		"Decode from a QIF file:\n" +
-		"    ... decode [-a] [-t cap] [-v] [in [out]]\n" +
+		"    ... decode [-a] [-t cap] [-ack file] [-d ms] [-v] [in [out]]\n" +
 		"    -a    Enable asynchronous decoding\n" +
 		"    -t    Set the capacity of the table\n" +
+		"    -ack  Write the decoder stream to a file; each instruction is\n" +
+		"          framed like a block on stream 0\n" +
+		"    -d    Delay Table State Synchronize by this many milliseconds\n" +
 		"    -v    Verbose logging\n\n"
 	fmt.Fprintf(os.Stderr, msg, os.Args[0])
 	os.Exit(2)
@@ -87,7 +91,7 @@ func encode(args []string) {
 	}
 	defer enc.Close()
 	enc.acknowledge = ack
-	enc.qpack.SetCapacity(capacity)
+	check(enc.qpack.SetMaxCapacity(capacity))
 	enc.qpack.SetReferenceableLimit(referenceable)
 	enc.qpack.SetMaxBlockedStreams(maxBlocked)
 	enc.Encode(logger)
@@ -99,6 +103,8 @@ func decode(args []string) {
 	var dec *decoder
 	async := false
 	capacity := hc.TableCapacity(4096)
+	ackName := ""
+	ackDelay := time.Duration(0)
 	for len(args) > 1 && args[0][0:1] == "-" {
 		if args[0] == "-a" {
 			async = true
@@ -111,18 +117,27 @@ func decode(args []string) {
 			check(err)
 			capacity = hc.TableCapacity(sz)
 			args = args[2:]
+		} else if len(args) >= 2 && args[0] == "-ack" {
+			ackName = args[1]
+			args = args[2:]
+		} else if len(args) >= 2 && args[0] == "-d" {
+			ms, err := strconv.Atoi(args[1])
+			check(err)
+			ackDelay = time.Duration(ms) * time.Millisecond
+			args = args[2:]
 		}
 	}
 	switch len(args) {
 	case 0:
-		dec = newDecoder("", "")
+		dec = newDecoder("", "", ackName)
 	case 1:
-		dec = newDecoder(args[0], "")
+		dec = newDecoder(args[0], "", ackName)
 	default:
-		dec = newDecoder(args[0], args[1])
+		dec = newDecoder(args[0], args[1], ackName)
 	}
 	defer dec.Close()
-	dec.qpack.Table.SetCapacity(capacity)
+	dec.qpack.SetMaxCapacity(capacity)
+	dec.SetAckDelay(ackDelay)
 	if async {
 		dec.DecodeAsync(logger)
 	} else {
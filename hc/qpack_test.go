@@ -2,8 +2,12 @@ package hc_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"io"
+	"runtime"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -159,6 +163,54 @@ func TestQpackDuplicate(t *testing.T) {
 	assertQpackTableFull(t, encoder)
 }
 
+// TestQpackDuplicationPolicy sets up the conditions for a duplication, but
+// without acknowledging the inserts.  Only the aggressive policy duplicates.
+func TestQpackDuplicationPolicy(t *testing.T) {
+	stats := func(policy hc.DuplicationPolicy) hc.QpackEncoderStats {
+		var updateBuf bytes.Buffer
+		encoder := hc.NewQpackEncoder(&updateBuf, 200, 100)
+		encoder.SetDuplicationPolicy(policy, 50)
+		setupEncoder(t, encoder, &updateBuf)
+		// Shrink the referenceable part of the table so that name1 is close
+		// to eviction before it is acknowledged.
+		encoder.SetReferenceableLimit(50)
+
+		// The reference to name2 blocks the stream, which allows name1 to be
+		// duplicated.
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+			hc.HeaderField{Name: "name2", Value: "value2"},
+			hc.HeaderField{Name: "name1", Value: "value1"})
+		assert.Nil(t, err)
+		return encoder.Stats()
+	}
+
+	conservative := stats(hc.DuplicateAcknowledged)
+	assert.Equal(t, uint64(0), conservative.Duplicates)
+	aggressive := stats(hc.DuplicateWithFreeSpace)
+	assert.Equal(t, uint64(1), aggressive.Duplicates)
+	assert.True(t, aggressive.Indexed > conservative.Indexed)
+	assert.True(t, aggressive.LiteralNameReferences+aggressive.LiteralNames <
+		conservative.LiteralNameReferences+conservative.LiteralNames)
+}
+
+// TestQpackDuplicationPolicyUnblocked checks that unacknowledged entries aren't
+// duplicated if that would block a stream that isn't already blocked.
+func TestQpackDuplicationPolicyUnblocked(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 200, 100)
+	encoder.SetDuplicationPolicy(hc.DuplicateWithFreeSpace, 50)
+	setupEncoder(t, encoder, &updateBuf)
+	encoder.SetReferenceableLimit(50)
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, uint64(0), encoder.Stats().Duplicates)
+}
+
 // TestQpackDuplicateLiteral sets up the conditions for a duplication, but the
 // table is too small to allow it.
 func TestQpackDuplicateLiteral(t *testing.T) {
@@ -356,6 +408,263 @@ func TestQpackBlockedEncode(t *testing.T) {
 	})
 }
 
+// Lower the limit on blocked streams while more streams than the new limit
+// are blocked.
+func TestQpackLowerMaxBlocked(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 250, 200)
+	encoder.SetMaxBlockedStreams(2)
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1,
+		hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	err = encoder.WriteHeaderBlock(&headerBuf, 2,
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+
+	// Two streams are blocked; lowering the limit below that is OK.
+	encoder.SetMaxBlockedStreams(1)
+
+	headerBuf.Reset()
+	updateBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, 3,
+		hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	expectedHeader, err := hex.DecodeString("00002ca874943f85ee3a2d287f")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedHeader, headerBuf.Bytes())
+
+	// Unblocking one stream isn't enough.
+	assert.Nil(t, encoder.AcknowledgeHeader(1))
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, 4,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	// The entry might be inserted, but it isn't referenced.
+	assert.Equal(t, byte(0x00), headerBuf.Bytes()[0])
+
+	// Unblocking the other allows a stream to block again.
+	assert.Nil(t, encoder.AcknowledgeHeader(2))
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, 5,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x04, 0x00, 0x80}, headerBuf.Bytes())
+}
+
+func TestQpackEncoderStats(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 250, 200)
+	setupEncoder(t, encoder, &updateBuf)
+	assert.Equal(t, hc.QpackEncoderStats{
+		Inserts:     2,
+		Indexed:     2,
+		UpdateBytes: 22,
+		HeaderBytes: 4,
+	}, encoder.Stats())
+
+	// Sensitive header fields are never indexed.
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: "name1", Value: "secret", Sensitive: true},
+		hc.HeaderField{Name: "other", Value: "secret", Sensitive: true})
+	assert.Nil(t, err)
+	stats := encoder.Stats()
+	assert.Equal(t, uint64(2), stats.LiteralNames)
+	assert.Equal(t, uint64(4+headerBuf.Len()), stats.HeaderBytes)
+	assert.Equal(t, uint64(22), stats.UpdateBytes)
+
+	// Without a dynamic table, names can still come from the static table.
+	encoder = hc.NewQpackEncoder(&updateBuf, 0, 0)
+	headerBuf.Reset()
+	err = encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+		hc.HeaderField{Name: ":method", Value: "PATCH"})
+	assert.Nil(t, err)
+	assert.Equal(t, hc.QpackEncoderStats{
+		LiteralNameReferences: 1,
+		HeaderBytes:           uint64(headerBuf.Len()),
+	}, encoder.Stats())
+}
+
+// TestQpackStateless checks that a stateless encoder doesn't use the dynamic
+// table, even when it has matching entries.
+func TestQpackStateless(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 250, 200)
+	setupEncoder(t, encoder, &updateBuf)
+	assert.Nil(t, encoder.AcknowledgeHeader(setupToken))
+	encoder.SetStateless(true)
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 250)
+	defer decoder.Close()
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},    // complete static match
+		{Name: ":path", Value: "/x"},       // static name match
+		{Name: "name1", Value: "value1"},   // in the dynamic table
+		{Name: "custom", Value: "literal"}, // no match
+	}
+	for i := uint64(1); i <= 10; i++ {
+		var headerBuf bytes.Buffer
+		assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, i, headers...))
+		assert.Equal(t, []byte{0x00, 0x00}, headerBuf.Bytes()[:2])
+
+		// The decoder doesn't need any table state.
+		decoded, err := decoder.ReadHeaderBlock(&headerBuf, i)
+		assert.Nil(t, err)
+		assert.Equal(t, headers, decoded)
+	}
+	assert.Equal(t, 0, updateBuf.Len())
+}
+
+func TestStaticQpackEncoder(t *testing.T) {
+	encoder := hc.NewStaticQpackEncoder()
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 0)
+	defer decoder.Close()
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/x"},
+		{Name: "custom", Value: "literal"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+
+	var wg sync.WaitGroup
+	for i := uint64(1); i <= 10; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			var headerBuf bytes.Buffer
+			assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, id, headers...))
+			assert.Equal(t, []byte{0x00, 0x00}, headerBuf.Bytes()[:2])
+			decoded, err := decoder.ReadHeaderBlock(&headerBuf, id)
+			assert.Nil(t, err)
+			assert.Equal(t, headers, decoded)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 0, encoder.Table.Base())
+	assert.Equal(t, uint64(0), encoder.Stats().UpdateBytes)
+}
+
+// ackQueue carries acknowledgments from a decoder to an encoder.  Like a
+// socket, and unlike io.Pipe, writing doesn't wait for the reader.
+type ackQueue struct {
+	chunks chan []byte
+	buf    []byte
+}
+
+func newAckQueue() *ackQueue {
+	return &ackQueue{chunks: make(chan []byte, 10000)}
+}
+
+func (q *ackQueue) Write(p []byte) (int, error) {
+	q.chunks <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+func (q *ackQueue) Close() error {
+	close(q.chunks)
+	return nil
+}
+
+func (q *ackQueue) Read(p []byte) (int, error) {
+	for len(q.buf) == 0 {
+		chunk, ok := <-q.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		q.buf = chunk
+	}
+	n := copy(p, q.buf)
+	q.buf = q.buf[n:]
+	return n, nil
+}
+
+// TestConcurrentEncoding writes header blocks for many streams at once.  The
+// table is small, so inserts for one stream evict entries that other streams
+// might be using.  Run this with -race.
+func TestConcurrentEncoding(t *testing.T) {
+	updatesReader, updatesWriter := io.Pipe()
+	acks := newAckQueue()
+	encoder := hc.NewQpackEncoder(updatesWriter, 256, 192)
+	encoder.SetMaxBlockedStreams(100)
+	decoder := hc.NewQpackDecoder(acks, 256)
+	decoder.SetMaxBlockedStreams(100)
+
+	updatesDone := make(chan error)
+	go func() {
+		updatesDone <- decoder.ReadTableUpdates(updatesReader)
+	}()
+	acksDone := make(chan error)
+	go func() {
+		acksDone <- encoder.ServiceAcknowledgments(acks)
+	}()
+
+	var wg sync.WaitGroup
+	for i := uint64(1); i <= 50; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				headers := []hc.HeaderField{
+					{Name: ":authority", Value: "example.com"},
+					{Name: "custom", Value: "value" + strconv.Itoa(j)},
+					{Name: "stream", Value: strconv.FormatUint(id, 10)},
+				}
+				var headerBuf bytes.Buffer
+				assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, id, headers...))
+				decoded, err := decoder.ReadHeaderBlock(&headerBuf, id)
+				assert.Nil(t, err)
+				assert.Equal(t, headers, decoded)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Nil(t, updatesWriter.Close())
+	assert.Nil(t, <-updatesDone)
+	assert.Nil(t, decoder.Close())
+	assert.Nil(t, <-acksDone)
+}
+
+// TestQpackBaseDelta checks that the encoder picks a base below the largest
+// reference when most references are to older entries.
+func TestQpackBaseDelta(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(1)
+	var fields []hc.HeaderField
+	for i := 1; i <= 80; i++ {
+		fields = append(fields, hc.HeaderField{
+			Name:  "name" + strconv.Itoa(i),
+			Value: "value" + strconv.Itoa(i),
+		})
+	}
+	var headerBuf bytes.Buffer
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, fields...))
+	assert.Nil(t, encoder.AcknowledgeHeader(1))
+	assert.Equal(t, 80, encoder.Table.Base())
+
+	selected := []hc.HeaderField{fields[0], fields[1], fields[2], fields[79]}
+	headerBuf.Reset()
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 2, selected...))
+	t.Logf("Header block: %x", headerBuf.Bytes())
+	// The required insert count is still 80 (encoded as 81), but the base is
+	// 1 (a negative delta of 79).  The first reference uses a relative index
+	// and the others use post-base indices.
+	expectedHeader, err := hex.DecodeString("51cf801011" + "1f3f")
+	assert.Nil(t, err)
+	assert.Equal(t, expectedHeader, headerBuf.Bytes())
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 4096)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+	headers, err := decoder.ReadHeaderBlock(&headerBuf, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, selected, headers)
+}
+
 // Use a name reference and ensure that it can't be evicted.
 func TestQpackNameReference(t *testing.T) {
 	var updateBuf bytes.Buffer
@@ -415,6 +724,67 @@ func TestNotIndexedNameReference(t *testing.T) {
 	assertQpackTableFull(t, encoder)
 }
 
+func TestIndexPreferencePattern(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetIndexPreferencePattern("authorization", false)
+	encoder.SetIndexPreferencePattern("X-*", false)
+	encoder.SetIndexPreferencePattern("*-id", false)
+	encoder.SetIndexPreference("x-allowed", true)
+
+	indexed := func(name string) bool {
+		updateBuf.Reset()
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+			hc.HeaderField{Name: name, Value: "value"})
+		assert.Nil(t, err)
+		return updateBuf.Len() > 0
+	}
+
+	assert.True(t, !indexed("authorization"))
+	assert.True(t, !indexed("Authorization"))
+	assert.True(t, !indexed("x-custom"))
+	assert.True(t, !indexed("request-id"))
+	assert.True(t, indexed("x-allowed"))
+	assert.True(t, indexed("authorization-extra"))
+	assert.True(t, indexed("accept"))
+
+	encoder.ClearIndexPreferencePattern("x-*")
+	assert.True(t, indexed("x-custom"))
+}
+
+func TestIndexDecider(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 2048)
+	encoder.SetMaxBlockedStreams(100)
+	encoder.SetIndexDecider(func(h hc.HeaderField, state hc.TableState) bool {
+		assert.Equal(t, hc.TableCapacity(4096), state.Capacity)
+		assert.Equal(t, hc.TableCapacity(2048), state.Referenceable)
+		assert.True(t, state.Used <= state.Capacity)
+		return h.Name == ":authority" || len(h.Value) <= 10
+	})
+
+	indexed := func(name string, value string) bool {
+		updateBuf.Reset()
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken,
+			hc.HeaderField{Name: name, Value: value})
+		assert.Nil(t, err)
+		return updateBuf.Len() > 0
+	}
+
+	assert.True(t, indexed("x-small", "value"))
+	assert.True(t, !indexed("x-large", "a value that is too long"))
+	assert.True(t, indexed(":authority", "a long authority.example"))
+	// The default would not index this name.
+	assert.True(t, indexed("date", "today"))
+
+	encoder.SetIndexDecider(nil)
+	assert.True(t, !indexed("date", "tomorrow"))
+	assert.True(t, indexed("x-large", "another value that is too long"))
+}
+
 func TestEncodeLargestReferenceWrap(t *testing.T) {
 	var updateBuf bytes.Buffer
 	// Size here has to be enough for two entries, but less than 32*3.
@@ -851,3 +1221,1314 @@ func TestDecoderLargestReferenceOverflow(t *testing.T) {
 		hc.HeaderField{Name: "name5", Value: "value5"},
 	}, headers)
 }
+
+func TestDecoderTableSnapshot(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 95)
+	defer decoder.Close()
+	assert.Equal(t, 0, len(decoder.TableSnapshot()))
+
+	// Five inserts, but the table only holds two entries.
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf" +
+		"64a874959f85ee3a2d2b3f64a87495af85ee3a2d2b5f" +
+		"64a87495bf85ee3a2d2b7f")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+	ackChecker.WaitForBase(5)
+
+	assert.Equal(t, []hc.HeaderField{
+		hc.HeaderField{Name: "name5", Value: "value5"},
+		hc.HeaderField{Name: "name4", Value: "value4"},
+	}, decoder.TableSnapshot())
+}
+
+// The largest reference is only reduced starting with draft-05.
+func TestQpackDraftVersion(t *testing.T) {
+	cases := []struct {
+		version hc.QpackDraftVersion
+		header  string
+	}{
+		{hc.QpackDraft04, "02008180"},
+		{hc.QpackDraft05, "03008180"},
+	}
+	headers := []hc.HeaderField{
+		{Name: "name1", Value: "value1"},
+		{Name: "name2", Value: "value2"},
+	}
+	for _, tc := range cases {
+		t.Logf("%v", tc.version)
+		var updateBuf bytes.Buffer
+		encoder := hc.NewQpackEncoder(&updateBuf, 95, 95)
+		encoder.SetMaxBlockedStreams(1)
+		encoder.DraftVersion = tc.version
+		var headerBuf bytes.Buffer
+		assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, defaultToken, headers...))
+		expectedHeader, err := hex.DecodeString(tc.header)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedHeader, headerBuf.Bytes())
+
+		ackChecker := newAckChecker(t)
+		decoder := hc.NewQpackDecoder(ackChecker, 95)
+		decoder.DraftVersion = tc.version
+		assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+		ackChecker.WaitForBase(2)
+		decoded, err := decoder.ReadHeaderBlock(&headerBuf, defaultToken)
+		assert.Nil(t, err)
+		assert.Equal(t, headers, decoded)
+		decoder.Close()
+	}
+}
+
+func TestQpackDecoderPseudoHeaderOrder(t *testing.T) {
+	headers := []hc.HeaderField{
+		{Name: "regular", Value: "1"},
+		{Name: ":method", Value: "GET"},
+		{Name: "other", Value: "2"},
+		{Name: ":path", Value: "/"},
+	}
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 0, 0)
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, defaultToken, headers...)
+	assert.Nil(t, err)
+	encoded := headerBuf.Bytes()
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 0)
+	defer decoder.Close()
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader(encoded), defaultToken)
+	assert.Equal(t, hc.ErrPseudoHeaderOrdering, err)
+
+	decoder.LenientPseudoOrdering = true
+	decoded, err := decoder.ReadHeaderBlock(bytes.NewReader(encoded), defaultToken)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/"},
+		{Name: "regular", Value: "1"},
+		{Name: "other", Value: "2"},
+	}, decoded)
+}
+
+func TestPseudoHeaderValidation(t *testing.T) {
+	request := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/"},
+		{Name: "accept", Value: "*/*"},
+	}
+	connect := []hc.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":authority", Value: "example.com:443"},
+	}
+	noPath := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+	}
+	response := []hc.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: "server", Value: "minhq"},
+	}
+	twoStatus := []hc.HeaderField{
+		{Name: ":status", Value: "200"},
+		{Name: ":status", Value: "204"},
+	}
+	trailer := []hc.HeaderField{
+		{Name: "checksum", Value: "abc"},
+	}
+	misordered := []hc.HeaderField{
+		{Name: "checksum", Value: "abc"},
+		{Name: ":status", Value: "200"},
+	}
+
+	cases := []struct {
+		validation hc.PseudoHeaderValidation
+		headers    []hc.HeaderField
+		err        error
+	}{
+		{hc.ValidateRequest, request, nil},
+		{hc.ValidateRequest, connect, nil},
+		{hc.ValidateRequest, noPath, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateRequest, response, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateRequest, trailer, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateResponse, response, nil},
+		{hc.ValidateResponse, request, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateResponse, twoStatus, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateResponse, trailer, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateResponse, misordered, hc.ErrPseudoHeaderOrdering},
+		{hc.ValidateTrailer, trailer, nil},
+		{hc.ValidateTrailer, response, hc.ErrInvalidPseudoHeader},
+		{hc.ValidateNone, trailer, nil},
+		{hc.ValidateNone, twoStatus, nil},
+		{hc.ValidateNone, misordered, nil},
+	}
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 0)
+	defer decoder.Close()
+	encoder := hc.NewQpackEncoder(&bytes.Buffer{}, 0, 0)
+	for _, tc := range cases {
+		t.Logf("%v: %v", tc.validation, tc.headers)
+		assert.Equal(t, tc.err, tc.validation.Validate(tc.headers))
+
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken, tc.headers...)
+		assert.Nil(t, err)
+		decoded, err := decoder.ReadHeaderBlockValidated(&headerBuf, defaultToken, tc.validation)
+		assert.Equal(t, tc.err, err)
+		if tc.err == nil {
+			assert.Equal(t, tc.headers, decoded)
+		}
+	}
+}
+
+// TestCapacityChangeMidUpdate reduces the table capacity between inserts.
+// The capacity change evicts an entry and the next insert evicts another.
+func TestCapacityChangeMidUpdate(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf" +
+		"3f13" + // Set Dynamic Table Capacity = 50
+		"64a874959f85ee3a2d2b3f")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	assert.Equal(t, hc.TableCapacity(50), decoder.Table.Capacity())
+	assert.Equal(t, 3, decoder.Table.Base())
+	checkDynamicTable(t, decoder.Table, &[]dynamicTableEntry{
+		{"name3", "value3"},
+	})
+
+	// Shrinking the table further means that the next insert doesn't fit.
+	updates, err = hex.DecodeString("64a874943f85ee3a2d287f" +
+		"3f01" + // Set Dynamic Table Capacity = 32
+		"64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Equal(t, hc.ErrTableOverflow, err)
+	assert.Equal(t, 4, decoder.Table.Base())
+	assert.Equal(t, hc.TableCapacity(0), decoder.Table.Used())
+}
+
+func TestDecoderReduceCapacity(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	decoder.ReduceCapacity(50)
+	assert.Equal(t, hc.TableCapacity(50), decoder.Table.Capacity())
+	assert.Equal(t, 2, decoder.Table.Base())
+	checkDynamicTable(t, decoder.Table, &[]dynamicTableEntry{
+		{"name2", "value2"},
+	})
+
+	// The encoder still uses the old capacity for the largest reference, so
+	// the remaining entry can be used.
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x80}), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "name2", Value: "value2"}}, headers)
+
+	// The evicted entry can't.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x81}), 2)
+	assert.True(t, errors.Is(err, hc.ErrIndexError))
+
+	// The encoder can't increase the capacity past the limit.
+	err = decoder.ReadTableUpdates(bytes.NewReader([]byte{0x3f, 0xe1, 0x01}))
+	assert.Nil(t, err)
+	assert.Equal(t, hc.TableCapacity(50), decoder.Table.Capacity())
+}
+
+func TestCapacityTooLarge(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+
+	// Set Dynamic Table Capacity = 256 is fine.
+	err := decoder.ReadTableUpdates(bytes.NewReader([]byte{0x3f, 0xe1, 0x01}))
+	assert.Nil(t, err)
+	assert.Equal(t, hc.TableCapacity(256), decoder.Table.Capacity())
+
+	// Set Dynamic Table Capacity = 257 is not.
+	err = decoder.ReadTableUpdates(bytes.NewReader([]byte{0x3f, 0xe2, 0x01}))
+	assert.Equal(t, hc.ErrCapacityTooLarge, err)
+	assert.Equal(t, hc.TableCapacity(256), decoder.Table.Capacity())
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+type ackCapture struct {
+	events []hc.AckEvent
+	bytes  []byte
+	done   chan struct{}
+}
+
+func (ac *ackCapture) observe(e hc.AckEvent, p []byte) {
+	ac.events = append(ac.events, e)
+	ac.bytes = append(ac.bytes, p...)
+	ac.done <- struct{}{}
+}
+
+func TestDecoderAckObserver(t *testing.T) {
+	var ackStream bufferCloser
+	decoder := hc.NewQpackDecoder(&ackStream, 256)
+	defer decoder.Close()
+	decoder.SetAckDelay(time.Hour)
+	capture := &ackCapture{done: make(chan struct{})}
+	decoder.SetAckObserver(capture.observe)
+
+	// Insert two entries, then reference one on stream 200.
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+	block := []byte{0x02, 0x00, 0x80}
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader(block), 200)
+	assert.Nil(t, err)
+	<-capture.done
+
+	decoder.Cancelled(3)
+	<-capture.done
+
+	assert.Equal(t, []hc.AckEvent{
+		{Type: hc.AckHeader, Value: 200},
+		{Type: hc.AckReset, Value: 3},
+	}, capture.events)
+	// 200 doesn't fit in the 7-bit prefix, so it takes two more octets.
+	assert.Equal(t, []byte{0xff, 0x49, 0x43}, capture.bytes)
+	// The same bytes were written to the stream.
+	assert.Equal(t, capture.bytes, ackStream.Bytes())
+}
+
+func TestMaxHeaderListSize(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	// Each of these fields is 43 bytes.
+	block := []byte{0x03, 0x00, 0x81, 0x80}
+	decoder.SetMaxHeaderListSize(85)
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader(block), 1)
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+	assert.Nil(t, headers)
+	// The header block is still acknowledged.
+	ackChecker.WaitForHeaderBlock(1, block)
+
+	decoder.SetMaxHeaderListSize(86)
+	headers, err = decoder.ReadHeaderBlock(bytes.NewReader(block), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(headers))
+	ackChecker.WaitForHeaderBlock(2, block)
+}
+
+func TestEncoderMaxHeaderListSize(t *testing.T) {
+	var updates, block bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updates, 256, 256)
+	encoder.SetMaxHeaderListSize(81)
+
+	// Each of these fields is 41 bytes.
+	headers := []hc.HeaderField{{"name", "value", false}, {"name2", "valu", false}}
+	err := encoder.WriteHeaderBlock(&block, 1, headers...)
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+	assert.Equal(t, 0, updates.Len())
+	assert.Equal(t, 0, block.Len())
+	_, err = encoder.WriteHeaderBlocks(hc.HeaderBlock{ID: 2, Headers: headers})
+	assert.Equal(t, hc.ErrHeaderListTooLarge, err)
+
+	encoder.SetMaxHeaderListSize(82)
+	err = encoder.WriteHeaderBlock(&block, 3, headers...)
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, block.Len())
+}
+
+func TestMaxFieldValueLength(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	// The value from the table is "value1", then "GET" from the static table.
+	block := []byte{0x02, 0x00, 0x80, 0xd1}
+	decoder.SetMaxFieldValueLength(5)
+	headers, err := decoder.ReadHeaderBlockValidated(bytes.NewReader(block), 1, hc.ValidateNone)
+	assert.Equal(t, hc.ErrFieldValueTooLong, err)
+	assert.Nil(t, headers)
+	// The header block is still acknowledged.
+	ackChecker.WaitForHeaderBlock(1, block)
+
+	// A long literal value is also rejected.
+	literal := []byte{0x00, 0x00, 0x5f, 0x1d, 0x07}
+	literal = append(literal, []byte("private")...)
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader(literal), 2)
+	assert.Equal(t, hc.ErrFieldValueTooLong, err)
+
+	decoder.SetMaxFieldValueLength(6)
+	headers, err = decoder.ReadHeaderBlockValidated(bytes.NewReader(block), 3, hc.ValidateNone)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: "name1", Value: "value1"},
+		{Name: ":method", Value: "GET"},
+	}, headers)
+	ackChecker.WaitForHeaderBlock(3, block)
+}
+
+func TestPostBaseNameReference(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	// The base is 1, so post-base index 0 is the second entry, "name2".  The
+	// first field uses a post-base index, the second uses a post-base name
+	// reference with a literal value of "foo".
+	block := []byte{0x03, 0x81, 0x10, 0x00, 0x03, 'f', 'o', 'o'}
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader(block), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: "name2", Value: "value2"},
+		{Name: "name2", Value: "foo"},
+	}, headers)
+	ackChecker.WaitForHeaderBlock(1, block)
+}
+
+func TestQpackError(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+
+	// Two inserts, then a Duplicate of an entry that doesn't exist.
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf05")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.True(t, errors.Is(err, hc.ErrIndexError))
+	assert.Equal(t, &hc.QpackError{
+		Err:         hc.ErrIndexError,
+		Offset:      22,
+		Instruction: "Duplicate",
+		Index:       5,
+		Base:        2,
+	}, err)
+
+	// An indexed reference to an entry that doesn't exist.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x85}), 1)
+	assert.True(t, errors.Is(err, hc.ErrIndexError))
+	assert.Equal(t, &hc.QpackError{
+		Err:         hc.ErrIndexError,
+		Offset:      2,
+		Instruction: "Indexed Header Field",
+		Index:       5,
+		Base:        2,
+	}, err)
+}
+
+func TestDecodeAtBase(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+
+	expected := []hc.HeaderField{
+		{Name: "name1", Value: "value1"},
+		{Name: "name2", Value: "value2"},
+	}
+	captured := []byte{0x03, 0x00, 0x81, 0x80}
+	headers, err := decoder.DecodeAtBase(captured, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, headers)
+
+	// Adding more entries doesn't change the result.
+	updates, err = hex.DecodeString("64a874959f85ee3a2d2b3f")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Nil(t, err)
+	headers, err = decoder.DecodeAtBase(captured, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, headers)
+
+	// A block that references entries beyond the base can't be decoded.
+	_, err = decoder.DecodeAtBase(captured, 1)
+	assert.Equal(t, hc.ErrIndexError, err)
+}
+
+func TestDecodeHeaderBlockWithStats(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+
+	block := []byte{
+		0x03, 0x81, // largest reference 2, base 1
+		0xd1,                 // static :method: GET
+		0x51, 0x02, '/', 'x', // static name reference :path: /x
+		0x80,                      // dynamic name1: value1
+		0x10,                      // post-base name2: value2
+		0x22, 'a', 'b', 0x01, 'c', // literal ab: c
+	}
+	headers, stats, err := decoder.DecodeHeaderBlockWithStats(bytes.NewReader(block), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":path", Value: "/x"},
+		{Name: "name1", Value: "value1"},
+		{Name: "name2", Value: "value2"},
+		{Name: "ab", Value: "c"},
+	}, headers)
+	assert.Equal(t, &hc.HeaderBlockStats{
+		StaticIndices: []int{17, 1},
+		Literals:      []int{1, 4},
+		StaticRefs:    2,
+		DynamicRefs:   1,
+		PostBaseRefs:  1,
+	}, stats)
+}
+
+func TestClearWhileWaiting(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	table := decoder.Table.(*hc.QpackDecoderTable)
+
+	// This header block needs two inserts that will never arrive.
+	result := make(chan error)
+	go func() {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x81, 0x80}), 1)
+		result <- err
+	}()
+
+	// Keep clearing until the reader notices; the reader might not be
+	// waiting on the first attempt.
+	for {
+		select {
+		case err := <-result:
+			assert.Equal(t, hc.ErrTableReset, err)
+			assert.Equal(t, 0, table.Base())
+			assert.Equal(t, hc.TableCapacity(0), table.Used())
+			assert.Equal(t, hc.TableCapacity(256), table.Capacity())
+			return
+		case <-time.After(10 * time.Millisecond):
+			table.Clear()
+		}
+	}
+}
+
+func TestReadHeaderBlockContext(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := decoder.ReadHeaderBlockContext(ctx,
+			bytes.NewReader([]byte{0x03, 0x00, 0x81, 0x80}), 1)
+		result <- err
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-result)
+
+	// A deadline works too.
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := decoder.ReadHeaderBlockContext(ctx,
+		bytes.NewReader([]byte{0x03, 0x00, 0x81, 0x80}), 2)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// A block that doesn't need to wait isn't affected by the context.
+	headers, err := decoder.ReadHeaderBlockContext(ctx, bytes.NewReader([]byte{0x00, 0x00, 0xd1}), 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: ":method", Value: "GET"}}, headers)
+}
+
+func TestCloseWhileWaiting(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+
+	result := make(chan error)
+	go func() {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x81, 0x80}), 1)
+		result <- err
+	}()
+
+	waitForBlocked(decoder, 1)
+	assert.Nil(t, decoder.Close())
+	select {
+	case err := <-result:
+		assert.Equal(t, hc.ErrDecoderClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("header block still waiting after Close")
+	}
+
+	// Closing again is harmless.
+	assert.Nil(t, decoder.Close())
+}
+
+func TestReadTableUpdatesAfterClose(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	assert.Nil(t, decoder.Close())
+
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f")
+	assert.Nil(t, err)
+	err = decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Equal(t, hc.ErrDecoderClosed, err)
+
+	// A header block that needs the dynamic table fails straight away.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x02, 0x00, 0x80}), 1)
+	assert.Equal(t, hc.ErrDecoderClosed, err)
+}
+
+func TestOversizeInsertWhileWaiting(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 100)
+	defer decoder.Close()
+
+	result := make(chan error)
+	go func() {
+		// This needs the first entry.
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x02, 0x00, 0x80}), 1)
+		result <- err
+	}()
+
+	waitForBlocked(decoder, 1)
+	// Insert With Literal Name: a 133 byte entry doesn't fit.
+	updates := append([]byte{0x41, 'n', 0x64}, bytes.Repeat([]byte{'x'}, 100)...)
+	err := decoder.ReadTableUpdates(bytes.NewReader(updates))
+	assert.Equal(t, hc.ErrTableOverflow, err)
+	assert.Equal(t, hc.ErrTableOverflow, <-result)
+
+	// Later header blocks that need entries fail too.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x02, 0x00, 0x80}), 2)
+	assert.Equal(t, hc.ErrTableOverflow, err)
+}
+
+func TestFlushUpdates(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	assert.Nil(t, encoder.FlushUpdates())
+	assert.Equal(t, 0, updateBuf.Len())
+
+	encoder.SetMaxBlockedStreams(1)
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+	assert.Nil(t, encoder.FlushUpdates())
+
+	// Everything is written and the stream ends cleanly on an instruction.
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+	assert.Equal(t, 2, decoder.Table.Base())
+}
+
+// TestEncoderSetCapacity reduces the capacity after inserts and checks that
+// the decoder follows.
+func TestEncoderSetCapacity(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(1)
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"})
+	assert.Nil(t, err)
+
+	// The entries are referenced by an unacknowledged header block.
+	assert.Equal(t, hc.ErrEvictionBlocked, encoder.SetCapacity(50))
+	assert.Equal(t, hc.TableCapacity(256), encoder.Table.Capacity())
+	assert.Equal(t, 2, encoder.Table.Base())
+
+	assert.Nil(t, encoder.AcknowledgeHeader(1))
+	assert.Nil(t, encoder.SetCapacity(50))
+	assert.Equal(t, hc.TableCapacity(50), encoder.Table.Capacity())
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{
+		{"name2", "value2"},
+	})
+
+	// The capacity can't exceed the initial maximum.
+	assert.Nil(t, encoder.SetCapacity(1000))
+	assert.Equal(t, hc.TableCapacity(256), encoder.Table.Capacity())
+	assert.Nil(t, encoder.SetCapacity(50))
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+	assert.Equal(t, hc.TableCapacity(50), decoder.Table.Capacity())
+	assert.Equal(t, 2, decoder.Table.Base())
+	checkDynamicTable(t, decoder.Table, &[]dynamicTableEntry{
+		{"name2", "value2"},
+	})
+}
+
+func TestBlockedStreamLimit(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	decoder.SetMaxBlockedStreams(1)
+
+	// Both of these header blocks need two inserts, so one of them is rejected.
+	result := make(chan error)
+	for id := uint64(1); id <= 2; id++ {
+		go func(id uint64) {
+			_, err := decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x81, 0x80}), id)
+			result <- err
+		}(id)
+	}
+	assert.Equal(t, hc.ErrBlockedStreamLimit, <-result)
+
+	// The other completes once the inserts arrive.
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+	assert.Nil(t, <-result)
+}
+
+// waitForBlocked waits until `n` header blocks are blocked.
+func waitForBlocked(decoder *hc.QpackDecoder, n int) {
+	for decoder.BlockedStreams() != n {
+		runtime.Gosched()
+	}
+}
+
+// TestBlockedStreamLimitRelease checks that header blocks that don't need to
+// wait aren't counted, and that the limit is released when a block unblocks.
+func TestBlockedStreamLimitRelease(t *testing.T) {
+	ackChecker := newAckChecker(t)
+	decoder := hc.NewQpackDecoder(ackChecker, 256)
+	defer decoder.Close()
+	decoder.SetMaxBlockedStreams(1)
+
+	updates, err := hex.DecodeString("64a874943f85ee3a2d287f")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+	ackChecker.WaitForBase(1)
+	assert.Equal(t, 0, decoder.BlockedStreams())
+
+	// This needs the second insert, so it blocks.
+	blockedBlock := []byte{0x03, 0x00, 0x80}
+	result := make(chan error)
+	go func() {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader(blockedBlock), 1)
+		result <- err
+	}()
+	waitForBlocked(decoder, 1)
+
+	// This only needs the first insert, so it doesn't block.
+	block := []byte{0x02, 0x00, 0x80}
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader(block), 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "name1", Value: "value1"}}, headers)
+	ackChecker.WaitForHeaderBlock(2, block)
+	assert.Equal(t, 1, decoder.BlockedStreams())
+
+	// Another block that needs to wait exceeds the limit.
+	_, err = decoder.ReadHeaderBlock(bytes.NewReader([]byte{0x03, 0x00, 0x80}), 3)
+	assert.Equal(t, hc.ErrBlockedStreamLimit, err)
+	assert.Equal(t, 1, decoder.BlockedStreams())
+
+	// The second insert releases the blocked stream.
+	updates, err = hex.DecodeString("64a874945f85ee3a2d28bf")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+	assert.Nil(t, <-result)
+	ackChecker.WaitForHeaderBlock(1, blockedBlock)
+	assert.Equal(t, 0, decoder.BlockedStreams())
+
+	// With nothing blocked, another block can wait.
+	blockedBlock = []byte{0x04, 0x00, 0x80}
+	go func() {
+		_, err := decoder.ReadHeaderBlock(bytes.NewReader(blockedBlock), 4)
+		result <- err
+	}()
+	waitForBlocked(decoder, 1)
+	updates, err = hex.DecodeString("64a874959f85ee3a2d2b3f")
+	assert.Nil(t, err)
+	assert.Nil(t, decoder.ReadTableUpdates(bytes.NewReader(updates)))
+	assert.Nil(t, <-result)
+	ackChecker.WaitForHeaderBlock(4, blockedBlock)
+	assert.Equal(t, 0, decoder.BlockedStreams())
+}
+
+func TestQpackHuffmanAuto(t *testing.T) {
+	headers := []hc.HeaderField{
+		// This shrinks with Huffman coding.
+		{Name: "custom-key", Value: "custom-value"},
+		// This grows with Huffman coding.
+		{Name: "cookie", Value: "~^|{}~^|{}"},
+	}
+
+	encode := func(huffman hc.HuffmanCodingChoice) []byte {
+		encoder := hc.NewQpackEncoder(&bytes.Buffer{}, 0, 0)
+		encoder.HuffmanPreference = huffman
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken, headers...)
+		assert.Nil(t, err)
+		return headerBuf.Bytes()
+	}
+	auto := encode(hc.HuffmanCodingAuto)
+	always := encode(hc.HuffmanCodingAlways)
+	never := encode(hc.HuffmanCodingNever)
+	t.Logf("auto: %x", auto)
+	t.Logf("always: %x", always)
+	t.Logf("never: %x", never)
+	assert.True(t, len(auto) < len(always))
+	assert.True(t, len(auto) < len(never))
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 0)
+	defer decoder.Close()
+	decoded, err := decoder.ReadHeaderBlock(bytes.NewReader(auto), defaultToken)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+}
+
+// orderLog records writes to the encoder stream and header frames in the
+// order that they happen.
+type orderLog struct {
+	writes []string
+}
+
+type orderLogUpdates struct {
+	log *orderLog
+}
+
+func (w orderLogUpdates) Write(p []byte) (int, error) {
+	w.log.writes = append(w.log.writes, "insert")
+	return len(p), nil
+}
+
+func (log *orderLog) WriteHeaderFrame(block []byte) error {
+	log.writes = append(log.writes, "header")
+	return nil
+}
+
+func TestWriteHeaderFrameOrder(t *testing.T) {
+	var log orderLog
+	encoder := hc.NewQpackEncoder(orderLogUpdates{&log}, 256, 256)
+	encoder.SetMaxBlockedStreams(1)
+	err := encoder.WriteHeaderFrame(&log, 1, hc.HeaderField{Name: "name1", Value: "value1"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, encoder.Table.Base())
+
+	assert.True(t, len(log.writes) > 1)
+	for _, w := range log.writes[:len(log.writes)-1] {
+		assert.Equal(t, "insert", w)
+	}
+	assert.Equal(t, "header", log.writes[len(log.writes)-1])
+}
+
+// blockableUpdates is an encoder stream that can pretend to be blocked.
+type blockableUpdates struct {
+	bytes.Buffer
+	blocked bool
+}
+
+func (b *blockableUpdates) WouldBlock() bool {
+	return b.blocked
+}
+
+type headerFrames [][]byte
+
+func (frames *headerFrames) WriteHeaderFrame(block []byte) error {
+	*frames = append(*frames, block)
+	return nil
+}
+
+func TestSkipBlockedInserts(t *testing.T) {
+	updates := &blockableUpdates{blocked: true}
+	encoder := hc.NewQpackEncoder(updates, 256, 256)
+	encoder.SetMaxBlockedStreams(2)
+	encoder.SetSkipBlockedInserts(true)
+
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: "name1", Value: "value1"},
+	}
+	var frames headerFrames
+	err := encoder.WriteHeaderFrame(&frames, 1, headers...)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, []byte{0x00, 0x00}, frames[0][:2])
+	assert.Equal(t, 0, updates.Len())
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	decoded, err := decoder.ReadHeaderBlock(bytes.NewReader(frames[0]), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, headers, decoded)
+
+	// Once the encoder stream is writable, inserts happen again.
+	updates.blocked = false
+	err = encoder.WriteHeaderFrame(&frames, 2, headers...)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(frames))
+	assert.True(t, updates.Len() > 0)
+	assert.Equal(t, 1, encoder.Table.Base())
+}
+
+func TestWriteHeaderBlocks(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(2)
+
+	blocks := []hc.HeaderBlock{
+		{ID: 1, Headers: []hc.HeaderField{{Name: "name1", Value: "value1"}}},
+		{ID: 2, Headers: []hc.HeaderField{
+			{Name: ":method", Value: "GET"},
+			{Name: "name1", Value: "value1"},
+		}},
+	}
+	encoded, err := encoder.WriteHeaderBlocks(blocks...)
+	assert.Nil(t, err)
+	assert.Equal(t, len(blocks), len(encoded))
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+	for i, block := range blocks {
+		headers, err := decoder.ReadHeaderBlock(bytes.NewReader(encoded[i]), block.ID)
+		assert.Nil(t, err)
+		assert.Equal(t, block.Headers, headers)
+	}
+}
+
+func TestValidateOnEncode(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(1)
+	assert.True(t, encoder.ValidateOnEncode)
+
+	h := hc.HeaderField{Name: "name1", Value: "value1\r\nname2: value2"}
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1, h)
+	assert.Equal(t, hc.ErrInvalidHeaderValue, err)
+	assert.Equal(t, 0, headerBuf.Len())
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, 0, encoder.Table.Base())
+
+	encoder.ValidateOnEncode = false
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, h))
+}
+
+func TestConnectionHeaders(t *testing.T) {
+	status := hc.HeaderField{Name: ":status", Value: "200"}
+	cases := []struct {
+		h   hc.HeaderField
+		err error
+	}{
+		{hc.HeaderField{Name: "connection", Value: "close"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "keep-alive", Value: "timeout=5"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "proxy-connection", Value: "keep-alive"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "transfer-encoding", Value: "chunked"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "upgrade", Value: "websocket"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "Connection", Value: "close"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "te", Value: "gzip"}, hc.ErrConnectionHeader},
+		{hc.HeaderField{Name: "te", Value: "trailers"}, nil},
+	}
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 0)
+	defer decoder.Close()
+	for _, tc := range cases {
+		t.Logf("%v", tc.h)
+		assert.Equal(t, tc.err, hc.ValidateConnectionHeaders([]hc.HeaderField{status, tc.h}))
+
+		var headerBuf bytes.Buffer
+		encoder := hc.NewQpackEncoder(&bytes.Buffer{}, 0, 0)
+		err := encoder.WriteHeaderBlock(&headerBuf, defaultToken, status, tc.h)
+		assert.Equal(t, tc.err, err)
+
+		// Encode without validation to check that the decoder rejects these.
+		headerBuf.Reset()
+		encoder.ValidateOnEncode = false
+		assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, defaultToken, status, tc.h))
+		_, err = decoder.ReadHeaderBlockValidated(&headerBuf, defaultToken, hc.ValidateResponse)
+		assert.Equal(t, tc.err, err)
+	}
+}
+
+// A decoder can cancel a stream without knowing whether the header blocks on
+// it referenced the dynamic table.
+func TestAcknowledgeResetUnknown(t *testing.T) {
+	var updateBuf, headerBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	assert.Nil(t, encoder.AcknowledgeReset(1))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 2, hc.HeaderField{Name: "name1", Value: "value1"}))
+	assert.Nil(t, encoder.AcknowledgeReset(2))
+	assert.Nil(t, encoder.AcknowledgeReset(2))
+}
+
+func TestRecommendCapacity(t *testing.T) {
+	// A workload that repeats 20 header fields, which need about 1300 bytes of
+	// table space, benefits from a table that holds all of them.
+	var fields []hc.HeaderField
+	var total hc.TableCapacity
+	for i := 0; i < 20; i++ {
+		f := hc.HeaderField{Name: "x-field-" + strconv.Itoa(i),
+			Value: "some value that repeats " + strconv.Itoa(i)}
+		fields = append(fields, f)
+		total += hc.TableCapacity(len(f.Name) + len(f.Value) + 32)
+	}
+	var blocks [][]hc.HeaderField
+	for i := 0; i < 100; i++ {
+		blocks = append(blocks, fields)
+	}
+	capacity := hc.RecommendCapacity(blocks)
+	assert.True(t, capacity >= total, "recommended capacity is too small")
+	assert.True(t, capacity <= 2*total, "recommended capacity is too large")
+
+	// Header field names that never repeat don't benefit from the table.
+	blocks = nil
+	for i := 0; i < 100; i++ {
+		blocks = append(blocks, []hc.HeaderField{{Name: "x-unique-" + strconv.Itoa(i), Value: "value"}})
+	}
+	assert.Equal(t, hc.TableCapacity(0), hc.RecommendCapacity(blocks))
+}
+
+func TestReplayLog(t *testing.T) {
+	var updateBuf bytes.Buffer
+	var replayLog bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetReplayLog(&replayLog)
+	encoder.SetMaxBlockedStreams(2)
+
+	var headerBuf bytes.Buffer
+	h1 := hc.HeaderField{Name: "name1", Value: "value1"}
+	h2 := hc.HeaderField{Name: "name2", Value: "value2"}
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, h1))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 2, h1, h2))
+	assert.Nil(t, encoder.AcknowledgeInsert(1))
+	assert.Nil(t, encoder.AcknowledgeHeader(1))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 3, h2,
+		hc.HeaderField{Name: "name3", Value: "value3"}))
+	assert.Nil(t, encoder.AcknowledgeReset(2))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 4, h1, h2))
+
+	var replayUpdateBuf bytes.Buffer
+	replayEncoder := hc.NewQpackEncoder(&replayUpdateBuf, 256, 256)
+	err := hc.ReplayQpackEncoder(bytes.NewReader(replayLog.Bytes()), replayEncoder)
+	assert.Nil(t, err)
+	assert.Equal(t, updateBuf.Bytes(), replayUpdateBuf.Bytes())
+	assert.Equal(t, encoder.Table.Base(), replayEncoder.Table.Base())
+
+	// An encoder that is configured differently produces different output.
+	var otherUpdateBuf bytes.Buffer
+	otherEncoder := hc.NewQpackEncoder(&otherUpdateBuf, 128, 128)
+	err = hc.ReplayQpackEncoder(bytes.NewReader(replayLog.Bytes()), otherEncoder)
+	assert.Equal(t, hc.ErrReplayMismatch, err)
+}
+
+func TestPreload(t *testing.T) {
+	var updateBuf bytes.Buffer
+	var replayLog bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetReplayLog(&replayLog)
+	encoder.SetMaxBlockedStreams(10)
+
+	common := []hc.HeaderField{
+		{Name: ":authority", Value: "example.com"},
+		{Name: "user-agent", Value: "minhq"},
+		// These aren't inserted: the default is not to index date, and
+		// sensitive values are never indexed.
+		{Name: "date", Value: "Mon, 1 Jan 2018 00:00:00 GMT"},
+		{Name: "authorization", Value: "secret", Sensitive: true},
+	}
+	base, err := encoder.Preload(common...)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, base)
+	assert.True(t, updateBuf.Len() > 0)
+	checkDynamicTable(t, encoder.Table, &[]dynamicTableEntry{
+		{"user-agent", "minhq"},
+		{":authority", "example.com"},
+	})
+
+	// Preloading the same fields again does nothing.
+	updateBuf.Reset()
+	base, err = encoder.Preload(common[:2]...)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, base)
+	assert.Equal(t, 0, updateBuf.Len())
+
+	// A header block references the preloaded entries without inserting.
+	var headerBuf bytes.Buffer
+	err = encoder.WriteHeaderBlock(&headerBuf, 1, common[:2]...)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, updateBuf.Len())
+	assert.Equal(t, uint64(2), encoder.Stats().Indexed)
+
+	var replayUpdateBuf bytes.Buffer
+	replayEncoder := hc.NewQpackEncoder(&replayUpdateBuf, 4096, 4096)
+	err = hc.ReplayQpackEncoder(bytes.NewReader(replayLog.Bytes()), replayEncoder)
+	assert.Nil(t, err)
+	assert.Equal(t, encoder.Table.Base(), replayEncoder.Table.Base())
+}
+
+func TestRestoreState(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 4096, 4096)
+	encoder.SetMaxBlockedStreams(1)
+
+	assert.Equal(t, hc.ErrInvalidRestore, encoder.RestoreState(2, 3))
+	assert.Equal(t, hc.ErrInvalidRestore, encoder.RestoreState(2, -1))
+	assert.Nil(t, encoder.RestoreState(10, 8))
+	assert.Equal(t, 10, encoder.Table.Base())
+	assert.Equal(t, 8, encoder.KnownReceivedCount())
+
+	// The first stream can block, so this inserts and references a new entry.
+	headers := []hc.HeaderField{{Name: "custom", Value: "value"}}
+	var headerBuf bytes.Buffer
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, headers...))
+	assert.Equal(t, 11, encoder.Table.Base())
+	assert.NotEqual(t, byte(0), headerBuf.Bytes()[0])
+
+	// A second stream can't block, so it can't use the new entry.
+	headerBuf.Reset()
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 2, headers...))
+	assert.Equal(t, byte(0), headerBuf.Bytes()[0])
+
+	// Acknowledging inserts from before the restore is fine.
+	assert.Nil(t, encoder.AcknowledgeInsert(3))
+	assert.Equal(t, 11, encoder.KnownReceivedCount())
+
+	// Now the entry can be used without blocking.
+	headerBuf.Reset()
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 3, headers...))
+	assert.NotEqual(t, byte(0), headerBuf.Bytes()[0])
+
+	// An encoder that has been used can't be restored.
+	assert.Equal(t, hc.ErrInvalidRestore, encoder.RestoreState(20, 20))
+}
+
+func TestCookieCrumbling(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(1)
+	encoder.CrumbleCookies = true
+	cookie := hc.HeaderField{Name: "Cookie", Value: "a=1; b=2; c=3"}
+	var headerBuf bytes.Buffer
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, cookie))
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	assert.Nil(t, decoder.ReadTableUpdates(&updateBuf))
+	block := headerBuf.Bytes()
+
+	// Each crumb is a separate field on the wire.
+	headers, err := decoder.ReadHeaderBlock(bytes.NewReader(block), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{
+		{Name: "cookie", Value: "a=1"},
+		{Name: "cookie", Value: "b=2"},
+		{Name: "cookie", Value: "c=3"},
+	}, headers)
+
+	decoder.JoinCookies = true
+	headers, err = decoder.ReadHeaderBlock(bytes.NewReader(block), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.HeaderField{{Name: "cookie", Value: "a=1; b=2; c=3"}}, headers)
+}
+
+func TestMaxUnacknowledgedSize(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 1024, 1024)
+	encoder.SetMaxBlockedStreams(10)
+	// Each of these entries is 43 bytes, so only two fit.
+	encoder.SetMaxUnacknowledgedSize(90)
+
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, 1,
+		hc.HeaderField{Name: "name1", Value: "value1"},
+		hc.HeaderField{Name: "name2", Value: "value2"},
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, encoder.Table.Base())
+	assert.Equal(t, uint64(2), encoder.Stats().Inserts)
+	assert.Equal(t, uint64(1), encoder.Stats().LiteralNames)
+
+	// Still nothing is inserted.
+	err = encoder.WriteHeaderBlock(&headerBuf, 2,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, encoder.Table.Base())
+
+	// Once the inserts are acknowledged, there is space again.
+	assert.Nil(t, encoder.AcknowledgeInsert(2))
+	err = encoder.WriteHeaderBlock(&headerBuf, 3,
+		hc.HeaderField{Name: "name3", Value: "value3"})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, encoder.Table.Base())
+}
+
+func TestAckObserver(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(2)
+	var events []hc.AckEvent
+	encoder.SetAckObserver(func(e hc.AckEvent) {
+		events = append(events, e)
+	})
+
+	h := hc.HeaderField{Name: "name1", Value: "value1"}
+	var headerBuf bytes.Buffer
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, h))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 2, h))
+
+	// Insert Count Increment of 1, Header Acknowledgment for stream 1, then
+	// Stream Cancellation for stream 2.
+	err := encoder.ServiceAcknowledgments(bytes.NewReader([]byte{0x01, 0x81, 0x42}))
+	assert.Nil(t, err)
+	assert.Equal(t, []hc.AckEvent{
+		{Type: hc.AckInsert, Value: 1},
+		{Type: hc.AckHeader, Value: 1},
+		{Type: hc.AckReset, Value: 2},
+	}, events)
+}
+
+func TestServiceAcknowledgmentsEnd(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+
+	// An empty stream is fine.
+	assert.Nil(t, encoder.ServiceAcknowledgments(bytes.NewReader([]byte{})))
+
+	// A stream that ends partway through an instruction is not.
+	err := encoder.ServiceAcknowledgments(bytes.NewReader([]byte{0xff}))
+	assert.NotNil(t, err)
+}
+
+func TestAcknowledgeHeaderWithoutReferences(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(2)
+
+	// This only uses the static table.
+	h := hc.HeaderField{Name: ":method", Value: "GET"}
+	var headerBuf bytes.Buffer
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 1, h))
+	assert.Nil(t, encoder.WriteHeaderBlock(&headerBuf, 3, h))
+	assert.Equal(t, 0, updateBuf.Len())
+
+	assert.Nil(t, encoder.AcknowledgeHeader(1))
+	err := encoder.ServiceAcknowledgments(bytes.NewReader([]byte{0x83}))
+	assert.Nil(t, err)
+
+	// A stream that was never used is still an error.
+	assert.Equal(t, hc.ErrIndexError, encoder.AcknowledgeHeader(7))
+	err = encoder.ServiceAcknowledgments(bytes.NewReader([]byte{0x87}))
+	assert.Equal(t, hc.ErrIndexError, err)
+}
+
+// writeMultiplexedFrame writes a frame in the format that ServiceMultiplexed
+// reads: a 64-bit stream ID and 32-bit length, then the contents.
+func writeMultiplexedFrame(t *testing.T, w *hc.Writer, id uint64, p []byte) {
+	assert.Nil(t, w.WriteBits(id, 64))
+	assert.Nil(t, w.WriteBits(uint64(len(p)), 32))
+	_, err := w.Write(p)
+	assert.Nil(t, err)
+}
+
+func TestServiceMultiplexed(t *testing.T) {
+	var updateBuf bytes.Buffer
+	encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+	encoder.SetMaxBlockedStreams(3)
+
+	blocks := []hc.HeaderBlock{
+		{ID: 4, Headers: []hc.HeaderField{{Name: "name1", Value: "value1"}}},
+		{ID: 8, Headers: []hc.HeaderField{
+			{Name: "name1", Value: "value1"},
+			{Name: "name2", Value: "value2"},
+		}},
+		{ID: 12, Headers: []hc.HeaderField{{Name: "accept", Value: "*/*"}}},
+	}
+
+	// Put each header block ahead of the table updates it depends on, so
+	// that the decoder has to wait for those.
+	var source bytes.Buffer
+	w := hc.NewWriter(&source)
+	for _, block := range blocks {
+		var headerBuf bytes.Buffer
+		err := encoder.WriteHeaderBlock(&headerBuf, block.ID, block.Headers...)
+		assert.Nil(t, err)
+		writeMultiplexedFrame(t, w, block.ID, headerBuf.Bytes())
+		if updateBuf.Len() > 0 {
+			writeMultiplexedFrame(t, w, 0, updateBuf.Bytes())
+			updateBuf.Reset()
+		}
+	}
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	decoded, err := decoder.ServiceMultiplexed(&source)
+	assert.Nil(t, err)
+	assert.Equal(t, blocks, decoded)
+}
+
+func TestServiceMultiplexedMissingUpdates(t *testing.T) {
+	var source bytes.Buffer
+	w := hc.NewWriter(&source)
+	writeMultiplexedFrame(t, w, 4, []byte{0x00, 0x00, 0xd1})
+	// This needs an insert that never arrives.
+	writeMultiplexedFrame(t, w, 8, []byte{0x02, 0x00, 0x80})
+
+	decoder := hc.NewQpackDecoder(newAckChecker(t), 256)
+	defer decoder.Close()
+	decoded, err := decoder.ServiceMultiplexed(&source)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, []hc.HeaderBlock{
+		{ID: 4, Headers: []hc.HeaderField{{Name: ":method", Value: "GET"}}},
+	}, decoded)
+}
+
+func benchmarkFirstEncode(b *testing.B, warmup bool) {
+	headers := []hc.HeaderField{
+		{Name: ":method", Value: "GET"},
+		{Name: ":scheme", Value: "https"},
+		{Name: ":authority", Value: "example.com"},
+		{Name: ":path", Value: "/"},
+		{Name: "accept", Value: "*/*"},
+	}
+	var updateBuf, headerBuf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		encoder := hc.NewQpackEncoder(&updateBuf, 256, 256)
+		if warmup {
+			encoder.Warmup()
+		}
+		updateBuf.Reset()
+		headerBuf.Reset()
+		b.StartTimer()
+		err := encoder.WriteHeaderBlock(&headerBuf, 4, headers...)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFirstEncode(b *testing.B) {
+	b.Run("cold", func(b *testing.B) { benchmarkFirstEncode(b, false) })
+	b.Run("warm", func(b *testing.B) { benchmarkFirstEncode(b, true) })
+}
@@ -0,0 +1,66 @@
+package hc
+
+import (
+	"io/ioutil"
+)
+
+// recommendCapacityTolerance is how close, as a fraction of the smallest
+// output, the output for a recommended capacity needs to be.
+const recommendCapacityTolerance = 100
+
+// recommendCapacityCandidates are the capacities that RecommendCapacity tries.
+func recommendCapacityCandidates() []TableCapacity {
+	candidates := []TableCapacity{0}
+	for c := TableCapacity(64); c <= 1<<16; c <<= 1 {
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
+
+// encodedSize encodes the header blocks with a table of the given capacity and
+// returns the number of bytes written to both header blocks and the encoder
+// stream.  The simulated decoder acknowledges everything as soon as each
+// header block is written.
+func encodedSize(blocks [][]HeaderField, capacity TableCapacity) uint64 {
+	encoder := NewQpackEncoder(ioutil.Discard, capacity, capacity)
+	acknowledged := 0
+	for i, headers := range blocks {
+		id := uint64(i)
+		// Errors are ignored; a header block that can't be encoded doesn't
+		// count at any capacity.
+		_ = encoder.WriteHeaderBlock(ioutil.Discard, id, headers...)
+		base := encoder.Table.Base()
+		if base > acknowledged {
+			_ = encoder.AcknowledgeInsert(base - acknowledged)
+			acknowledged = base
+		}
+		_ = encoder.AcknowledgeHeader(id)
+	}
+	stats := encoder.Stats()
+	return stats.HeaderBytes + stats.UpdateBytes
+}
+
+// RecommendCapacity suggests a table capacity for a workload.  This encodes
+// `blocks` at a range of table capacities, counting what is written to both
+// header blocks and the encoder stream.  It returns the smallest capacity that
+// produces output within 1% of the smallest output, which is the point where
+// a larger table stops improving compression.  This assumes that the decoder
+// acknowledges each header block immediately, so it doesn't account for
+// blocking.
+func RecommendCapacity(blocks [][]HeaderField) TableCapacity {
+	candidates := recommendCapacityCandidates()
+	sizes := make([]uint64, len(candidates))
+	best := ^uint64(0)
+	for i, capacity := range candidates {
+		sizes[i] = encodedSize(blocks, capacity)
+		if sizes[i] < best {
+			best = sizes[i]
+		}
+	}
+	for i, capacity := range candidates {
+		if sizes[i] <= best+best/recommendCapacityTolerance {
+			return capacity
+		}
+	}
+	return candidates[len(candidates)-1]
+}
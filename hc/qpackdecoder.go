@@ -1,8 +1,12 @@
 package hc
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -10,6 +14,48 @@ import (
 // Unlike HPACK, QPACK doesn't allow this.
 var ErrTableOverflow = errors.New("inserting entry that is too large for the table")
 
+// ErrCapacityTooLarge is raised when the encoder sets a table capacity that is
+// larger than the decoder permits.
+var ErrCapacityTooLarge = errors.New("table capacity exceeds the maximum")
+
+// ErrHeaderListTooLarge is raised when a header block decodes to more than the
+// maximum header list size, or when an encoder is asked to encode a header
+// list that is larger than the peer accepts.
+var ErrHeaderListTooLarge = errors.New("header list exceeds the maximum size")
+
+// ErrFieldValueTooLong is raised when a header block includes a field with a
+// value that is longer than the maximum field value length.
+var ErrFieldValueTooLong = errors.New("field value exceeds the maximum length")
+
+// ErrDecoderClosed is returned by a decoder after it is closed, including to
+// any header blocks that were waiting for table updates.
+var ErrDecoderClosed = errors.New("decoder was closed")
+
+// QpackError describes a QPACK instruction that couldn't be decoded.  Err is
+// the error that caused the failure, such as ErrIndexError.
+type QpackError struct {
+	Err error
+	// Offset is the octet offset of the instruction, from the start of the
+	// header block or the table updates.
+	Offset int
+	// Instruction is the name of the instruction.
+	Instruction string
+	// Index is the index that the instruction referenced.
+	Index int
+	// Base is the base that Index is relative to.
+	Base int
+}
+
+func (e *QpackError) Error() string {
+	return fmt.Sprintf("%v: %s at offset %d (index %d, base %d)",
+		e.Err, e.Instruction, e.Offset, e.Index, e.Base)
+}
+
+// Unwrap returns the error that caused the failure.
+func (e *QpackError) Unwrap() error {
+	return e.Err
+}
+
 type headerBlockAck struct {
 	id               uint64
 	largestReference int
@@ -21,33 +67,75 @@ type headerBlockAck struct {
 // only run on one thread at a time.
 type QpackDecoder struct {
 	decoderCommon
+	// DraftVersion is the QPACK draft that the decoder follows.  This
+	// defaults to QpackDraft05.  Change this before reading header blocks.
+	DraftVersion QpackDraftVersion
+
 	table        *QpackDecoderTable
 	acknowledged chan<- *headerBlockAck
 	cancelled    chan<- uint64
 	available    chan<- int
 	ackDelay     time.Duration
+	// done is closed when the decoder is closed.
+	done      chan struct{}
+	closeOnce sync.Once
+	// maxCapacity is the largest capacity that the encoder can set.
+	maxCapacity TableCapacity
+	// maxHeaderListSize is the largest header list that will be decoded.
+	maxHeaderListSize uint64
+	// maxFieldValueLength is the longest field value that will be decoded.
+	maxFieldValueLength int
+	// ackObserver, if set, is told about each instruction that is written to
+	// the decoder stream.
+	ackObserverLock sync.Mutex
+	ackObserver     func(AckEvent, []byte)
 }
 
 // NewQpackDecoder makes and sets up a QpackDecoder.
 func NewQpackDecoder(aw io.WriteCloser, capacity TableCapacity) *QpackDecoder {
 	decoder := new(QpackDecoder)
 	decoder.table = NewQpackDecoderTable(capacity)
+	decoder.maxCapacity = capacity
 	decoder.Table = decoder.table
+	decoder.DraftVersion = QpackDraft05
 	available := make(chan int)
 	decoder.available = available
 	acknowledged := make(chan *headerBlockAck)
 	decoder.acknowledged = acknowledged
 	cancelled := make(chan uint64)
 	decoder.cancelled = cancelled
+	decoder.done = make(chan struct{})
 	decoder.initLogging(nil)
 	go decoder.writeAcknowledgements(aw, available, acknowledged, cancelled)
 	return decoder
 }
 
+// SetAckObserver sets a function that is called for each instruction that the
+// decoder writes to its stream, after it is written.  This is passed a copy of
+// the encoded instruction.  This is called from the goroutine that writes
+// instructions, so it shouldn't block.  Set this to nil to stop observing.
+func (decoder *QpackDecoder) SetAckObserver(observer func(AckEvent, []byte)) {
+	defer decoder.ackObserverLock.Unlock()
+	decoder.ackObserverLock.Lock()
+	decoder.ackObserver = observer
+}
+
+func (decoder *QpackDecoder) observeAck(t AckType, v uint64, p []byte) {
+	decoder.ackObserverLock.Lock()
+	observer := decoder.ackObserver
+	decoder.ackObserverLock.Unlock()
+	if observer != nil {
+		observer(AckEvent{t, v}, p)
+	}
+}
+
 func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available <-chan int,
 	acknowledged <-chan *headerBlockAck, cancelled <-chan uint64) {
 	defer aw.Close()
-	w := NewWriter(aw)
+	// Each instruction is encoded here before it is written, so that it can
+	// be passed to the observer.
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
 
 	// These values are used to track whether to send Table State Synchronize, which we do on a delayed timer.
 	var largestAcknowledged int
@@ -58,12 +146,18 @@ func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available
 		var v uint64
 		var err error
 		var remaining byte
+		var t AckType
 
 		select {
 		case ack := <-acknowledged:
-			largestAcknowledged = ack.largestReference
+			// Header blocks on different streams can be acknowledged out of
+			// order, so this might not increase.
+			if ack.largestReference > largestAcknowledged {
+				largestAcknowledged = ack.largestReference
+			}
 			v = ack.id
 			remaining = 7
+			t = AckHeader
 			// Header Acknowledgment: instruction = b1
 			err = w.WriteBit(1)
 			decoder.logger.Printf("ack header block %v", v)
@@ -71,15 +165,16 @@ func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available
 		case cancel := <-cancelled:
 			v = cancel
 			remaining = 6
+			t = AckReset
 			// Stream Cancellation: instruction = b01
 			err = w.WriteBits(1, 2)
 			decoder.logger.Printf("ack stream cancellation %v", v)
 
-		case entry, ok := <-available:
-			if !ok {
-				decoder.logger.Printf("ack closing")
-				return // The available channel closed.
-			}
+		case <-decoder.done:
+			decoder.logger.Printf("ack closing")
+			return
+
+		case entry := <-available:
 			if syncLargest < entry {
 				syncLargest = entry
 				if delayTss {
@@ -87,7 +182,10 @@ func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available
 					delayTss = false
 					go func() {
 						<-time.After(decoder.ackDelay)
-						tss <- struct{}{}
+						select {
+						case tss <- struct{}{}:
+						case <-decoder.done:
+						}
 					}()
 				}
 			}
@@ -102,6 +200,7 @@ func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available
 			v = uint64(syncLargest - largestAcknowledged)
 			largestAcknowledged = syncLargest
 			remaining = 6
+			t = AckInsert
 			// Table State Synchronize: instruction = b00
 			err = w.WriteBits(0, 2)
 			decoder.logger.Printf("table state synchronize %v", v)
@@ -114,6 +213,12 @@ func (decoder *QpackDecoder) writeAcknowledgements(aw io.WriteCloser, available
 		if err != nil {
 			return
 		}
+		_, err = aw.Write(buf.Bytes())
+		if err != nil {
+			return
+		}
+		decoder.observeAck(t, v, append([]byte(nil), buf.Bytes()...))
+		buf.Reset()
 	}
 }
 
@@ -123,21 +228,89 @@ func (decoder *QpackDecoder) SetAckDelay(delay time.Duration) {
 	decoder.ackDelay = delay
 }
 
+// SetMaxBlockedStreams limits the number of header blocks that can be blocked
+// waiting for table updates at the same time.  Header blocks that would exceed
+// this limit fail with ErrBlockedStreamLimit, because the encoder is only
+// permitted to block this many streams.  By default, there is no limit.
+func (decoder *QpackDecoder) SetMaxBlockedStreams(m int) {
+	decoder.table.SetMaxBlocked(m)
+}
+
+// BlockedStreams returns the number of header blocks that are blocked waiting
+// for table updates.
+func (decoder *QpackDecoder) BlockedStreams() int {
+	return decoder.table.Blocked()
+}
+
+// SetMaxCapacity sets the table capacity, and the largest capacity that the
+// encoder is permitted to set.  This starts out as the capacity that the
+// decoder was created with.  Only use this before any table updates are read.
+func (decoder *QpackDecoder) SetMaxCapacity(capacity TableCapacity) {
+	decoder.maxCapacity = capacity
+	decoder.Table.SetCapacity(capacity)
+}
+
+// ReduceCapacity shrinks the table to save memory, evicting entries as
+// needed.  No instruction is sent, so see QpackDecoderTable.ReduceCapacity
+// for the consequences.
+func (decoder *QpackDecoder) ReduceCapacity(capacity TableCapacity) {
+	decoder.table.ReduceCapacity(capacity)
+}
+
+// SetMaxHeaderListSize limits the size of the header list that a header block
+// can decode to.  The size of a header list is the sum of the size of each
+// field, which is 32 more than the length of the name and value.  Header blocks
+// that exceed this fail with ErrHeaderListTooLarge.  A value of 0, the default,
+// means that there is no limit.
+func (decoder *QpackDecoder) SetMaxHeaderListSize(size uint64) {
+	decoder.maxHeaderListSize = size
+}
+
+// SetMaxFieldValueLength limits the length of the value of any field in a
+// header block.  Unlike MaxStringLength, this applies to the decoded value,
+// including values that come from the table.  Header blocks with a longer
+// value fail with ErrFieldValueTooLong.  A value of 0, the default, means that
+// there is no limit.
+func (decoder *QpackDecoder) SetMaxFieldValueLength(n int) {
+	decoder.maxFieldValueLength = n
+}
+
+// TableSnapshot returns a copy of the entries in the dynamic table, newest
+// first.  This is intended for debugging.  It is safe to call this while
+// table updates are being read.
+func (decoder *QpackDecoder) TableSnapshot() []HeaderField {
+	return decoder.table.snapshot()
+}
+
 func (decoder *QpackDecoder) readValueAndInsert(reader *Reader, name string) error {
 	value, err := reader.ReadString(7)
 	if err != nil {
 		return err
 	}
 	if tableOverhead+TableCapacity(len(name)+len(value)) > decoder.Table.Capacity() {
+		// Header blocks that need this entry would wait forever, so fail
+		// anything that is waiting, or will wait, for more entries.
+		decoder.table.CloseWithError(ErrTableOverflow)
 		return ErrTableOverflow
 	}
 	added := decoder.Table.Insert(name, value, nil)
 	decoder.logger.Printf("inserted %v = %v @ %v", name, value, added.Base())
-	decoder.available <- added.Base()
-	return nil
+	return decoder.notifyAvailable(added.Base())
+}
+
+// notifyAvailable tells the goroutine that writes acknowledgments about an
+// insert.  This returns ErrDecoderClosed if the decoder is closed.
+func (decoder *QpackDecoder) notifyAvailable(base int) error {
+	select {
+	case decoder.available <- base:
+		return nil
+	case <-decoder.done:
+		return ErrDecoderClosed
+	}
 }
 
 func (decoder *QpackDecoder) readInsertWithNameReference(reader *Reader, base int) error {
+	offset := reader.Offset()
 	static, err := reader.ReadBit()
 	if err != nil {
 		return err
@@ -154,7 +327,7 @@ func (decoder *QpackDecoder) readInsertWithNameReference(reader *Reader, base in
 		nameEntry = decoder.table.GetDynamic(nameIndex, base)
 	}
 	if nameEntry == nil {
-		return ErrIndexError
+		return &QpackError{ErrIndexError, offset, "Insert With Name Reference", nameIndex, base}
 	}
 	return decoder.readValueAndInsert(reader, nameEntry.Name())
 }
@@ -168,6 +341,7 @@ func (decoder *QpackDecoder) readInsertWithNameLiteral(reader *Reader, base int)
 }
 
 func (decoder *QpackDecoder) readDuplicate(reader *Reader, base int) error {
+	offset := reader.Offset()
 	index, err := reader.ReadIndex(5)
 	if err != nil {
 		return err
@@ -175,11 +349,10 @@ func (decoder *QpackDecoder) readDuplicate(reader *Reader, base int) error {
 	decoder.logger.Printf("duplicate %v", index)
 	entry := decoder.Table.GetDynamic(index, base)
 	if entry == nil {
-		return ErrIndexError
+		return &QpackError{ErrIndexError, offset, "Duplicate", index, base}
 	}
 	added := decoder.table.Insert(entry.Name(), entry.Value(), nil)
-	decoder.available <- added.Base()
-	return nil
+	return decoder.notifyAvailable(added.Base())
 }
 
 func (decoder *QpackDecoder) readDynamicUpdate(reader *Reader) error {
@@ -188,16 +361,23 @@ func (decoder *QpackDecoder) readDynamicUpdate(reader *Reader) error {
 		return err
 	}
 	decoder.logger.Printf("update capacity %v", capacity)
+	if TableCapacity(capacity) > decoder.maxCapacity {
+		return ErrCapacityTooLarge
+	}
 	decoder.Table.SetCapacity(TableCapacity(capacity))
 	return nil
 }
 
 // ReadTableUpdates reads a single block of table updates.  If you use ServiceUpdates,
-// this function should need to be used at all.
+// this function should need to be used at all.  This returns ErrDecoderClosed
+// if there are more instructions after the decoder is closed.
 func (decoder *QpackDecoder) ReadTableUpdates(r io.Reader) error {
-	reader := NewReader(r)
+	reader := decoder.newReader(r)
 
 	for {
+		// Read the base afresh for each instruction.  Relative indices are
+		// relative to the table state at the start of the instruction, which
+		// depends on any inserts, evictions, or capacity changes before it.
 		base := decoder.Table.Base()
 		b, err := reader.ReadBit()
 		if err == io.EOF {
@@ -206,6 +386,11 @@ func (decoder *QpackDecoder) ReadTableUpdates(r io.Reader) error {
 		if err != nil {
 			return err
 		}
+		select {
+		case <-decoder.done:
+			return ErrDecoderClosed
+		default:
+		}
 
 		if b == 1 {
 			err = decoder.readInsertWithNameReference(reader, base)
@@ -241,7 +426,8 @@ func (decoder *QpackDecoder) ReadTableUpdates(r io.Reader) error {
 	return nil
 }
 
-func (decoder *QpackDecoder) readIndexed(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readIndexed(reader *Reader, base int, stats *HeaderBlockStats) (*HeaderField, error) {
+	offset := reader.Offset()
 	static, err := reader.ReadBit()
 	if err != nil {
 		return nil, err
@@ -254,16 +440,19 @@ func (decoder *QpackDecoder) readIndexed(reader *Reader, base int) (*HeaderField
 	var entry Entry
 	if static == 1 {
 		entry = decoder.Table.GetStatic(index)
+		stats.addStatic(index)
 	} else {
 		entry = decoder.Table.GetDynamic(index, base)
+		stats.addDynamic()
 	}
 	if entry == nil {
-		return nil, ErrIndexError
+		return nil, &QpackError{ErrIndexError, offset, "Indexed Header Field", index, base}
 	}
 	return &HeaderField{entry.Name(), entry.Value(), false}, nil
 }
 
 func (decoder *QpackDecoder) readPostBaseIndexed(reader *Reader, base int) (*HeaderField, error) {
+	offset := reader.Offset()
 	postBase, err := reader.ReadIndex(4)
 	if err != nil {
 		return nil, err
@@ -271,13 +460,14 @@ func (decoder *QpackDecoder) readPostBaseIndexed(reader *Reader, base int) (*Hea
 	decoder.logger.Printf("post-base indexed %v", postBase)
 	entry := decoder.Table.GetDynamic(-1-postBase, base)
 	if entry == nil {
-		return nil, ErrIndexError
+		return nil, &QpackError{ErrIndexError, offset, "Indexed Header Field With Post-Base Index", postBase, base}
 	}
 	decoder.logger.Printf("entry %v", entry)
 	return &HeaderField{entry.Name(), entry.Value(), false}, nil
 }
 
-func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base int) (*HeaderField, error) {
+func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base int, stats *HeaderBlockStats) (*HeaderField, error) {
+	offset := reader.Offset()
 	neverIndex, err := reader.ReadBit()
 	if err != nil {
 		return nil, err
@@ -295,11 +485,13 @@ func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base i
 	var nameEntry Entry
 	if static == 1 {
 		nameEntry = decoder.Table.GetStatic(nameIndex)
+		stats.addStatic(nameIndex)
 	} else {
 		nameEntry = decoder.Table.GetDynamic(nameIndex, base)
+		stats.addDynamic()
 	}
 	if nameEntry == nil {
-		return nil, ErrIndexError
+		return nil, &QpackError{ErrIndexError, offset, "Literal Header Field With Name Reference", nameIndex, base}
 	}
 
 	value, err := reader.ReadString(7)
@@ -310,6 +502,7 @@ func (decoder *QpackDecoder) readLiteralWithNameReference(reader *Reader, base i
 }
 
 func (decoder *QpackDecoder) readLiteralWithPostBaseNameReference(reader *Reader, base int) (*HeaderField, error) {
+	offset := reader.Offset()
 	neverIndex, err := reader.ReadBit()
 	if err != nil {
 		return nil, err
@@ -320,9 +513,9 @@ func (decoder *QpackDecoder) readLiteralWithPostBaseNameReference(reader *Reader
 	}
 	decoder.logger.Printf("literal name ref (sensitive=%v) %v",
 		neverIndex == 1, postBase)
-	nameEntry := decoder.Table.GetDynamic(-1*postBase, base)
+	nameEntry := decoder.Table.GetDynamic(-1-postBase, base)
 	if nameEntry == nil {
-		return nil, ErrIndexError
+		return nil, &QpackError{ErrIndexError, offset, "Literal Header Field With Post-Base Name Reference", postBase, base}
 	}
 
 	value, err := reader.ReadString(7)
@@ -348,17 +541,17 @@ func (decoder *QpackDecoder) readLiteralWithNameLiteral(reader *Reader, base int
 	return &HeaderField{name, value, neverIndex == 1}, nil
 }
 
-func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64) int {
+func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64, tableBase int) int {
 	decoder.logger.Printf("largest reference %v, current base %v",
-		lrRaw, decoder.Table.Base())
-	if lrRaw == 0 {
-		return 0
+		lrRaw, tableBase)
+	if lrRaw == 0 || !decoder.DraftVersion.reducesLargestReference() {
+		return int(lrRaw)
 	}
-	maxEntries := uint64(decoder.Table.Capacity() / entryOverhead)
+	maxEntries := uint64(decoder.table.referenceCapacity() / entryOverhead)
 	fullRange := maxEntries * 2
 
 	// Determine the maximum possible value, which is base + maxEntries
-	maxValue := uint64(decoder.Table.Base()) + maxEntries
+	maxValue := uint64(tableBase) + maxEntries
 	// Then round down to a multiple of the full range.
 	rounded := maxValue / fullRange * fullRange
 	// Now add the value (less 1) to this baseline.
@@ -376,44 +569,210 @@ func (decoder *QpackDecoder) decodeLargestBase(lrRaw uint64) int {
 
 // readBase reads the header block header and blocks until the decoder is
 // ready to process the remainder of the block.
-func (decoder *QpackDecoder) readBase(reader *Reader) (int, int, error) {
+func (decoder *QpackDecoder) readBase(ctx context.Context, reader *Reader) (int, int, error) {
 	lrRaw, err := reader.ReadInt(8)
 	if err != nil {
 		return 0, 0, err
 	}
-	largestBase := decoder.decodeLargestBase(lrRaw)
+	largestBase := decoder.decodeLargestBase(lrRaw, decoder.Table.Base())
 	decoder.logger.Printf("wait for %v", largestBase)
 	// This blocks until the dynamic table is ready.
-	decoder.table.WaitForEntry(largestBase)
+	err = decoder.table.WaitForEntryContext(ctx, largestBase)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	sign, err := reader.ReadBit()
+	base, err := decoder.readBaseDelta(reader, largestBase)
 	if err != nil {
 		return 0, 0, err
 	}
+	return largestBase, base, nil
+}
+
+// readBaseDelta reads the delta from the largest reference and uses that to
+// determine the base index for the header block.
+func (decoder *QpackDecoder) readBaseDelta(reader *Reader, largestBase int) (int, error) {
+	sign, err := reader.ReadBit()
+	if err != nil {
+		return 0, err
+	}
 	delta, err := reader.ReadIndex(7)
 	if err != nil {
-		return 0, 0, err
+		return 0, err
 	}
 	if sign == 1 && delta == 0 {
-		return 0, 0, errors.New("invalid delta for base index")
+		return 0, errors.New("invalid delta for base index")
 	}
 	decoder.logger.Printf("base delta %v %v", sign, delta)
 	// Sign: 1 means negative, 0 means positive.
 	base := largestBase + (delta * (1 - 2*int(sign)))
 	decoder.logger.Printf("base %v", base)
-	return largestBase, base, nil
+	return base, nil
 }
 
 // ReadHeaderBlock decodes header fields as they arrive.
 func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderField, error) {
-	reader := NewReader(r)
-	largestBase, base, err := decoder.readBase(reader)
+	return decoder.ReadHeaderBlockContext(context.Background(), r, id)
+}
+
+// ReadHeaderBlockContext is like ReadHeaderBlock, except that if the header
+// block is blocked waiting for table updates, it stops waiting and returns
+// ctx.Err() when `ctx` is done.
+func (decoder *QpackDecoder) ReadHeaderBlockContext(ctx context.Context, r io.Reader, id uint64) ([]HeaderField, error) {
+	headers, err := decoder.readHeaderBlock(ctx, r, id, nil)
 	if err != nil {
 		return nil, err
 	}
+	return decoder.checkPseudoHeaders(decoder.joinCookies(headers))
+}
+
+// DecodeHeaderBlockWithStats is like ReadHeaderBlock, except that it also
+// describes how each header field was encoded.  Cookie header fields are not
+// joined, so that the header fields match the description.
+func (decoder *QpackDecoder) DecodeHeaderBlockWithStats(r io.Reader, id uint64) ([]HeaderField, *HeaderBlockStats, error) {
+	stats := &HeaderBlockStats{}
+	headers, err := decoder.readHeaderBlock(context.Background(), r, id, stats)
+	if err != nil {
+		return nil, nil, err
+	}
+	headers, err = decoder.checkPseudoHeaders(headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return headers, stats, nil
+}
+
+// ReadHeaderBlockValidated is like ReadHeaderBlock, except that the pseudo
+// header fields are checked according to `validation`.  Use ValidateNone to
+// skip checking entirely.
+func (decoder *QpackDecoder) ReadHeaderBlockValidated(r io.Reader, id uint64,
+	validation PseudoHeaderValidation) ([]HeaderField, error) {
+	headers, err := decoder.readHeaderBlock(context.Background(), r, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.validatePseudoHeaders(decoder.joinCookies(headers), validation)
+}
+
+func (decoder *QpackDecoder) readHeaderBlock(ctx context.Context, r io.Reader, id uint64,
+	stats *HeaderBlockStats) ([]HeaderField, error) {
+	reader := decoder.newReader(r)
+	largestBase, base, err := decoder.readBase(ctx, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := decoder.readHeaderFields(reader, base, stats)
+	// A header list that is too large is still decoded completely, so it can
+	// be acknowledged.  That allows the encoder to release its references.
+	if err != nil && err != ErrHeaderListTooLarge && err != ErrFieldValueTooLong {
+		return nil, err
+	}
 
+	if largestBase > 0 {
+		// Nothing is acknowledged after the decoder is closed.
+		select {
+		case decoder.acknowledged <- &headerBlockAck{id, largestBase}:
+		case <-decoder.done:
+		}
+	}
+	return headers, err
+}
+
+// DecodeAtBase decodes a captured header block on the assumption that the
+// table has had exactly `base` inserts.  This doesn't wait for table updates
+// and doesn't acknowledge the header block, so it can be used to replay
+// captured header blocks for diagnostic purposes.  Entries that have been
+// evicted from the table since `base` can't be decoded.
+func (decoder *QpackDecoder) DecodeAtBase(p []byte, base int) ([]HeaderField, error) {
+	reader := decoder.newReader(bytes.NewReader(p))
+	lrRaw, err := reader.ReadInt(8)
+	if err != nil {
+		return nil, err
+	}
+	largestBase := decoder.decodeLargestBase(lrRaw, base)
+	if largestBase > base || largestBase > decoder.Table.Base() {
+		return nil, ErrIndexError
+	}
+	blockBase, err := decoder.readBaseDelta(reader, largestBase)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.readHeaderFields(reader, blockBase, nil)
+}
+
+// HeaderBlockStats describes how the fields in a header block were encoded.
+type HeaderBlockStats struct {
+	// StaticIndices lists the static table entries that were referenced, in
+	// order.  This includes entries that were only used for their name.
+	StaticIndices []int
+	// Literals lists the position of each header field that had a literal
+	// value, counting in the order that fields appear in the header block.
+	Literals []int
+	// StaticRefs counts references to the static table, including names.
+	StaticRefs int
+	// DynamicRefs counts references to the dynamic table relative to the
+	// base, including names.
+	DynamicRefs int
+	// PostBaseRefs counts post-base references to the dynamic table,
+	// including names.
+	PostBaseRefs int
+}
+
+// These methods do nothing if stats is nil.
+func (stats *HeaderBlockStats) addStatic(index int) {
+	if stats != nil {
+		stats.StaticIndices = append(stats.StaticIndices, index)
+		stats.StaticRefs++
+	}
+}
+
+func (stats *HeaderBlockStats) addDynamic() {
+	if stats != nil {
+		stats.DynamicRefs++
+	}
+}
+
+func (stats *HeaderBlockStats) addPostBase() {
+	if stats != nil {
+		stats.PostBaseRefs++
+	}
+}
+
+func (stats *HeaderBlockStats) addLiteral(i int) {
+	if stats != nil {
+		stats.Literals = append(stats.Literals, i)
+	}
+}
+
+// readHeaderFields reads the header fields from a header block.  If `stats`
+// isn't nil, it is updated to describe the header block.  If the header list
+// is too large, or a value is too long, the remainder of the block is read,
+// but fields are discarded and ErrHeaderListTooLarge or ErrFieldValueTooLong
+// is returned.
+func (decoder *QpackDecoder) readHeaderFields(reader *Reader, base int, stats *HeaderBlockStats) ([]HeaderField, error) {
 	headers := []HeaderField{}
+	var listSize uint64
+	count := 0
+	var failure error
 	addHeader := func(h *HeaderField) {
+		count++
+		if failure != nil {
+			return
+		}
+		if decoder.maxFieldValueLength > 0 && len(h.Value) > decoder.maxFieldValueLength {
+			decoder.logger.Printf("field value too long at %v", h.Name)
+			failure = ErrFieldValueTooLong
+			headers = nil
+			return
+		}
+		listSize += uint64(h.size())
+		if decoder.maxHeaderListSize > 0 && listSize > decoder.maxHeaderListSize {
+			decoder.logger.Printf("header list too large at %v", h)
+			failure = ErrHeaderListTooLarge
+			headers = nil
+			return
+		}
 		decoder.logger.Printf("add %v", h)
 		headers = append(headers, *h)
 	}
@@ -427,7 +786,7 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 			return nil, err
 		}
 		if b == 1 {
-			h, err := decoder.readIndexed(reader, base)
+			h, err := decoder.readIndexed(reader, base, stats)
 			if err != nil {
 				return nil, err
 			}
@@ -440,10 +799,11 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 			return nil, err
 		}
 		if b == 1 {
-			h, err := decoder.readLiteralWithNameReference(reader, base)
+			h, err := decoder.readLiteralWithNameReference(reader, base, stats)
 			if err != nil {
 				return nil, err
 			}
+			stats.addLiteral(count)
 			addHeader(h)
 			continue
 		}
@@ -457,6 +817,7 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 			if err != nil {
 				return nil, err
 			}
+			stats.addLiteral(count)
 			addHeader(h)
 			continue
 		}
@@ -470,15 +831,16 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 			h, err = decoder.readPostBaseIndexed(reader, base)
 		} else {
 			h, err = decoder.readLiteralWithPostBaseNameReference(reader, base)
+			stats.addLiteral(count)
 		}
 		if err != nil {
 			return nil, err
 		}
+		stats.addPostBase()
 		addHeader(h)
 	}
-
-	if largestBase > 0 {
-		decoder.acknowledged <- &headerBlockAck{id, largestBase}
+	if failure != nil {
+		return nil, failure
 	}
 	return headers, nil
 }
@@ -487,12 +849,20 @@ func (decoder *QpackDecoder) ReadHeaderBlock(r io.Reader, id uint64) ([]HeaderFi
 // informs the encoder about this.  This ensures that the encoder can know
 // to release any references that might not have been acknowledged.
 func (decoder *QpackDecoder) Cancelled(id uint64) {
-	decoder.cancelled <- id
+	select {
+	case decoder.cancelled <- id:
+	case <-decoder.done:
+	}
 }
 
 // Close tells the decoder to stop.  Mostly this is so it can stop providing
-// acknowledgments.
+// acknowledgments.  Any header blocks that are waiting for table updates fail
+// with ErrDecoderClosed, as does ReadTableUpdates.  Closing more than once is
+// harmless.
 func (decoder *QpackDecoder) Close() error {
-	close(decoder.available)
+	decoder.closeOnce.Do(func() {
+		decoder.table.CloseWithError(ErrDecoderClosed)
+		close(decoder.done)
+	})
 	return nil
 }
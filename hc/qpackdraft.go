@@ -0,0 +1,28 @@
+package hc
+
+import (
+	"strconv"
+)
+
+// QpackDraftVersion selects the QPACK draft that an encoder or decoder follows.
+// Only the parts of the encoding that changed between drafts are affected.
+type QpackDraftVersion int
+
+const (
+	// QpackDraft04 sends the largest reference in the header block prefix
+	// as the number of inserts, without any reduction.
+	QpackDraft04 = QpackDraftVersion(4)
+	// QpackDraft05 sends the largest reference modulo twice the number of
+	// entries that the table can hold, plus one.  This is the default.
+	QpackDraft05 = QpackDraftVersion(5)
+)
+
+func (v QpackDraftVersion) String() string {
+	return "draft-" + strconv.Itoa(int(v))
+}
+
+// reducesLargestReference is true if the largest reference is sent modulo
+// twice the number of entries that the table can hold.
+func (v QpackDraftVersion) reducesLargestReference() bool {
+	return v != QpackDraft04
+}
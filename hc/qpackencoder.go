@@ -1,13 +1,27 @@
 package hc
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const intMax = int(^uint(0) >> 1)
 
+// ErrEvictionBlocked is returned when the table capacity can't be reduced
+// because entries that would need to be evicted are still needed.
+var ErrEvictionBlocked = errors.New("unable to evict entries to reduce table capacity")
+
+// ErrInvalidRestore is returned by RestoreState if the state is inconsistent
+// or the encoder has already been used.
+var ErrInvalidRestore = errors.New("invalid state for restoring an encoder")
+
 // This is used by the writer to track which table entries are needed to write
 // out a particular header field.
 type qpackWriterState struct {
@@ -20,6 +34,9 @@ type qpackWriterState struct {
 	// being evicted.
 	largestBase  int
 	smallestBase int
+	// base is the base that references in the header block are relative to.
+	// This is set by chooseBase.
+	base int
 
 	// wasBlocked records if the record was originally blocked.
 	wasBlocked bool
@@ -27,6 +44,9 @@ type qpackWriterState struct {
 	maxBase int
 	// uses is the usage tracker for the header block we're producing.
 	uses *qpackHeaderBlockUsage
+	// capacity is the capacity of the table when table changes were written.
+	// This is used to encode the largest reference.
+	capacity TableCapacity
 }
 
 func (state *qpackWriterState) initHeaders(headers []HeaderField) {
@@ -95,6 +115,16 @@ func (state *qpackWriterState) updateBase(e Entry, match bool) {
 	}
 }
 
+// references returns true if the header block references the entry.
+func (state *qpackWriterState) references(e Entry) bool {
+	for _, m := range state.matches {
+		if m == e {
+			return true
+		}
+	}
+	return false
+}
+
 func (state *qpackWriterState) isNewlyBlocked(highestAcknowledged int) bool {
 	// A stream that was already blocking can't cause more blocking.
 	if state.wasBlocked {
@@ -103,6 +133,113 @@ func (state *qpackWriterState) isNewlyBlocked(highestAcknowledged int) bool {
 	return state.largestBase > highestAcknowledged
 }
 
+// intLength is the number of bytes an integer with the given prefix uses.
+func intLength(v uint64, prefix byte) int {
+	ones := (uint64(1) << prefix) - 1
+	if v < ones {
+		return 1
+	}
+	v -= ones
+	n := 2
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// referenceBases holds the bases of the dynamic table entries that a header
+// block references, sorted.  These are split by how they are referenced,
+// because that determines the length of the integer prefix.
+type referenceBases struct {
+	indexed []int
+	names   []int
+}
+
+func (state *qpackWriterState) referenceBases() *referenceBases {
+	var refs referenceBases
+	for i := range state.headers {
+		if e, ok := state.matches[i].(DynamicEntry); ok {
+			refs.indexed = append(refs.indexed, e.Base())
+		} else if e, ok := state.nameMatches[i].(DynamicEntry); ok && state.matches[i] == nil {
+			refs.names = append(refs.names, e.Base())
+		}
+	}
+	sort.Ints(refs.indexed)
+	sort.Ints(refs.names)
+	return &refs
+}
+
+// relativeCost is the number of bytes needed for relative indices to the
+// entries in `bases` that are at or below `base`.  intLength increases by one
+// each time the index reaches one of a few thresholds, so this counts the
+// entries that reach each threshold rather than visiting each entry.
+func relativeCost(bases []int, base int, prefix byte) int {
+	ones := (1 << prefix) - 1
+	cost := sort.SearchInts(bases, base+1)
+	threshold := ones
+	for shift := uint(7); threshold <= base; shift += 7 {
+		cost += sort.SearchInts(bases, base-threshold+1)
+		threshold = ones + 1<<shift
+	}
+	return cost
+}
+
+// postBaseCost is the number of bytes needed for post-base indices to the
+// entries in `bases` that are above `base`.  This works like relativeCost.
+func postBaseCost(bases []int, base int, prefix byte) int {
+	if len(bases) == 0 {
+		return 0
+	}
+	ones := (1 << prefix) - 1
+	last := bases[len(bases)-1]
+	cost := len(bases) - sort.SearchInts(bases, base+1)
+	threshold := ones
+	for shift := uint(7); base+1+threshold <= last; shift += 7 {
+		cost += len(bases) - sort.SearchInts(bases, base+1+threshold)
+		threshold = ones + 1<<shift
+	}
+	return cost
+}
+
+// cost is the number of bytes needed for the references in the header block
+// if `base` is used as the base, given that `largestBase` is the largest
+// reference.
+func (refs *referenceBases) cost(base int, largestBase int) int {
+	return intLength(uint64(largestBase-base), 7) +
+		relativeCost(refs.indexed, base, 6) +
+		relativeCost(refs.names, base, 4) +
+		postBaseCost(refs.indexed, base, 4) +
+		postBaseCost(refs.names, base, 3)
+}
+
+// chooseBase picks the base for the header block.  A base below the largest
+// reference means that the newest references use post-base indexing.  That
+// can be smaller when the header block references entries that are far
+// apart.  The largest base is used unless another base is strictly better.
+func (state *qpackWriterState) chooseBase() {
+	state.base = state.largestBase
+	if state.largestBase == 0 {
+		return
+	}
+	refs := state.referenceBases()
+	best := refs.cost(state.base, state.largestBase)
+	for i := range state.headers {
+		e, ok := state.matches[i].(DynamicEntry)
+		if !ok {
+			e, ok = state.nameMatches[i].(DynamicEntry)
+			if !ok {
+				continue
+			}
+		}
+		cost := refs.cost(e.Base(), state.largestBase)
+		if cost < best {
+			best = cost
+			state.base = e.Base()
+		}
+	}
+}
+
 func (state *qpackWriterState) CanEvict(e DynamicEntry) bool {
 	return e.Base() < state.smallestBase
 }
@@ -127,6 +264,10 @@ type QpackEncoder struct {
 	table *QpackEncoderTable
 	mutex sync.RWMutex
 
+	// DraftVersion is the QPACK draft that the encoder follows.  This
+	// defaults to QpackDraft05.  Change this before writing header blocks.
+	DraftVersion QpackDraftVersion
+
 	// updatesWriter is where header table updates are written
 	updatesWriter *Writer
 
@@ -141,9 +282,88 @@ type QpackEncoder struct {
 	highestAcknowledged int
 	// unacknowledgedSize is the amount of space taken by unacknowledged entries
 	unacknowledgedSize TableCapacity
+	// maxUnacknowledgedSize limits unacknowledgedSize, if it isn't zero.
+	maxUnacknowledgedSize TableCapacity
+	// duplicationPolicy and duplicationMinFree decide whether entries that
+	// haven't been acknowledged can be duplicated.
+	duplicationPolicy  DuplicationPolicy
+	duplicationMinFree TableCapacity
 	// blockedStreams is the number of streams that are currently
 	// potentially blocked.
 	blockedStreams int
+	// maxCapacity is the largest capacity that the decoder permits.
+	maxCapacity TableCapacity
+	// ackObserver, if set, is told about each acknowledgment that is read.
+	ackObserver func(AckEvent)
+	// stateless prevents the use of the dynamic table.
+	stateless bool
+	// staticOnly is set for encoders that never have a dynamic table.  These
+	// only need a read lock to write header blocks.
+	staticOnly bool
+	// updatesBlocker is the encoder stream, if it can report that writing
+	// would block.
+	updatesBlocker WriteBlocker
+	// skipBlockedInserts causes header blocks to only use the static table
+	// when writing to the encoder stream would block.
+	skipBlockedInserts bool
+	// maxHeaderListSize is the largest header list that the peer accepts.
+	maxHeaderListSize uint64
+	// stats counts what the encoder has written.  This is a pointer so that
+	// it is aligned for atomic access.
+	stats *QpackEncoderStats
+	// replay is where the replay log is written, if it is enabled.
+	replay *json.Encoder
+	// replayUpdates captures what is written to the encoder stream, if it
+	// isn't nil.
+	replayUpdates *bytes.Buffer
+}
+
+// QpackEncoderStats records counts of the instructions that a QpackEncoder
+// has written and the number of bytes that were written to each stream.
+type QpackEncoderStats struct {
+	// Inserts is the number of entries inserted into the table, not including
+	// duplicates.
+	Inserts uint64
+	// Duplicates is the number of existing entries that were duplicated.
+	Duplicates uint64
+	// Indexed is the number of header fields that referenced a table entry.
+	Indexed uint64
+	// LiteralNameReferences is the number of literal header fields that
+	// referenced a table entry for the name.
+	LiteralNameReferences uint64
+	// LiteralNames is the number of literal header fields that included the
+	// name as a literal.
+	LiteralNames uint64
+	// UpdateBytes is the number of bytes written to the encoder stream.
+	UpdateBytes uint64
+	// HeaderBytes is the number of bytes written in header blocks.
+	HeaderBytes uint64
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	w     io.Writer
+	count *uint64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddUint64(cw.count, uint64(n))
+	return n, err
+}
+
+// Stats returns a snapshot of the counters for this encoder.  This is safe to
+// call while other goroutines use the encoder.
+func (encoder *QpackEncoder) Stats() QpackEncoderStats {
+	return QpackEncoderStats{
+		Inserts:               atomic.LoadUint64(&encoder.stats.Inserts),
+		Duplicates:            atomic.LoadUint64(&encoder.stats.Duplicates),
+		Indexed:               atomic.LoadUint64(&encoder.stats.Indexed),
+		LiteralNameReferences: atomic.LoadUint64(&encoder.stats.LiteralNameReferences),
+		LiteralNames:          atomic.LoadUint64(&encoder.stats.LiteralNames),
+		UpdateBytes:           atomic.LoadUint64(&encoder.stats.UpdateBytes),
+		HeaderBytes:           atomic.LoadUint64(&encoder.stats.HeaderBytes),
+	}
 }
 
 // NewQpackEncoder creates a new QpackEncoder and sets it up.
@@ -155,41 +375,125 @@ type QpackEncoder struct {
 func NewQpackEncoder(hw io.Writer, capacity TableCapacity, referenceable TableCapacity) *QpackEncoder {
 	encoder := new(QpackEncoder)
 	encoder.table = NewQpackEncoderTable(capacity, referenceable)
+	encoder.maxCapacity = capacity
 	encoder.Table = encoder.table
-	encoder.updatesWriter = NewWriter(hw)
+	encoder.stats = new(QpackEncoderStats)
+	encoder.updatesWriter = NewWriter(countingWriter{replayCapture{encoder, hw}, &encoder.stats.UpdateBytes})
+	encoder.updatesBlocker, _ = hw.(WriteBlocker)
 	encoder.usage = make(map[uint64]*qpackStreamUsage)
+	// Each name and value uses whichever of Huffman or literal is smaller.
+	encoder.HuffmanPreference = HuffmanCodingAuto
+	encoder.ValidateOnEncode = true
+	encoder.DraftVersion = QpackDraft05
 	encoder.initLogging(nil)
 	return encoder
 }
 
+// NewStaticQpackEncoder makes a QpackEncoder that only ever uses the static
+// table.  This has no dynamic table and never writes to an encoder stream, so
+// it doesn't need acknowledgments.  Unlike SetStateless, header blocks are
+// written holding only a read lock, so this can be used from many goroutines
+// at once without contention.
+func NewStaticQpackEncoder() *QpackEncoder {
+	encoder := NewQpackEncoder(ioutil.Discard, 0, 0)
+	encoder.stateless = true
+	encoder.staticOnly = true
+	return encoder
+}
+
+// Warmup prepares the encoder so that the first header block isn't slower
+// than later ones.  Currently, this does nothing: the static table indexes
+// that Lookup uses are built when the package is initialized.  Calling this
+// keeps that true if any state is made lazy in future.
+func (encoder *QpackEncoder) Warmup() {
+}
+
+// AckType identifies the type of instruction on the decoder stream.
+type AckType byte
+
+const (
+	// AckHeader is the acknowledgment of a header block; the value is the stream ID.
+	AckHeader = AckType(iota)
+	// AckInsert is an increment to the insert count; the value is the increment.
+	AckInsert
+	// AckReset is a stream cancellation; the value is the stream ID.
+	AckReset
+)
+
+func (t AckType) String() string {
+	switch t {
+	case AckHeader:
+		return "Header"
+	case AckInsert:
+		return "Insert"
+	case AckReset:
+		return "Reset"
+	}
+	return "Unknown"
+}
+
+// AckEvent describes an acknowledgment that was read by ServiceAcknowledgments,
+// or written by a decoder.
+type AckEvent struct {
+	Type  AckType
+	Value uint64
+}
+
+// SetAckObserver sets a function that is called for each acknowledgment that
+// ServiceAcknowledgments reads, before the acknowledgment is processed.  Set
+// this to nil to stop observing acknowledgments.
+func (encoder *QpackEncoder) SetAckObserver(observer func(AckEvent)) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	encoder.ackObserver = observer
+}
+
+func (encoder *QpackEncoder) observeAck(t AckType, v uint64) {
+	encoder.mutex.RLock()
+	observer := encoder.ackObserver
+	encoder.mutex.RUnlock()
+	if observer != nil {
+		observer(AckEvent{t, v})
+	}
+}
+
 // ServiceAcknowledgments reads from the stream of acknowledgments and feeds those to the encoder.
+// This returns nil if the stream ends cleanly between instructions.
 func (encoder *QpackEncoder) ServiceAcknowledgments(ar io.Reader) error {
 	r := NewReader(ar)
 	for {
 		b, err := r.ReadBit()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
 		switch b {
 		case 1:
-			v, err := r.ReadInt(7)
+			var v uint64
+			v, err = r.ReadInt(7)
 			if err != nil {
 				return err
 			}
+			encoder.observeAck(AckHeader, v)
 			err = encoder.AcknowledgeHeader(v)
 		case 0:
 			b, err = r.ReadBit()
 			if err != nil {
 				return err
 			}
-			v, err := r.ReadInt(6)
+			var v uint64
+			v, err = r.ReadInt(6)
 			if err != nil {
 				return err
 			}
 			switch b {
 			case 0:
+				encoder.observeAck(AckInsert, v)
 				err = encoder.AcknowledgeInsert(int(v))
 			case 1:
+				encoder.observeAck(AckReset, v)
 				err = encoder.AcknowledgeReset(v)
 			}
 		}
@@ -200,8 +504,10 @@ func (encoder *QpackEncoder) ServiceAcknowledgments(ar io.Reader) error {
 }
 
 // insert wraps the Insert method of the table to ensure that new additions
-// are checked and accounted.
-func (encoder *QpackEncoder) insert(name string, value string, evict evictionCheck) DynamicEntry {
+// are checked and accounted.  `pending` is the size of the unacknowledged
+// entries that the new entry has to share the referenceable limit with.
+func (encoder *QpackEncoder) insert(name string, value string, evict evictionCheck,
+	pending TableCapacity) DynamicEntry {
 	// Make a temporary entry so that we can ask it how big it is.
 	var entry DynamicEntry = &BasicDynamicEntry{name, value, 0}
 	// We want to make sure that this entry is usable.  So we don't allow it
@@ -214,10 +520,15 @@ func (encoder *QpackEncoder) insert(name string, value string, evict evictionChe
 	// encoder adds to the dynamic table, but cannot use those entries until
 	// they are acknowledged.  If they are evicted before they can be used,
 	// the table updates are a total waste.
-	if entry.Size()+encoder.unacknowledgedSize > encoder.table.referenceableLimit {
+	if entry.Size()+pending > encoder.table.referenceableLimit {
 		encoder.logger.Printf("not adding entry of size %v", entry.Size())
 		return nil
 	}
+	if encoder.maxUnacknowledgedSize > 0 &&
+		entry.Size()+encoder.unacknowledgedSize > encoder.maxUnacknowledgedSize {
+		encoder.logger.Printf("not adding entry of size %v, too many unacknowledged inserts", entry.Size())
+		return nil
+	}
 	entry = encoder.Table.Insert(name, value, evict)
 	if entry != nil {
 		encoder.unacknowledgedSize += entry.Size()
@@ -227,7 +538,14 @@ func (encoder *QpackEncoder) insert(name string, value string, evict evictionChe
 
 // writeDuplicate duplicates the indicated entry.
 func (encoder *QpackEncoder) writeDuplicate(entry DynamicEntry, state *qpackWriterState, i int) error {
-	inserted := encoder.insert(entry.Name(), entry.Value(), state)
+	pending := encoder.unacknowledgedSize
+	if entry.Base() > encoder.highestAcknowledged {
+		// An unacknowledged entry that is duplicated is never referenced again,
+		// nor is anything else beyond the referenceable limit.  Entries that this
+		// header block references are being used.  Only count what remains.
+		pending = encoder.unusedSize(state)
+	}
+	inserted := encoder.insert(entry.Name(), entry.Value(), state, pending)
 	if inserted == nil {
 		// Leaving h unmodified causes a literal to be written.
 		return nil
@@ -242,16 +560,49 @@ func (encoder *QpackEncoder) writeDuplicate(entry DynamicEntry, state *qpackWrit
 	if err != nil {
 		return err
 	}
+	atomic.AddUint64(&encoder.stats.Duplicates, 1)
 	state.recordMatch(i, inserted, nil)
 	return nil
 }
 
+// canDuplicateUnacknowledged checks whether the duplication policy allows an
+// entry that hasn't been acknowledged to be duplicated.  That is only done if
+// the header block already depends on an unacknowledged entry, so that the
+// duplicate doesn't cause the stream to block.
+func (encoder *QpackEncoder) canDuplicateUnacknowledged(state *qpackWriterState) bool {
+	if encoder.duplicationPolicy != DuplicateWithFreeSpace {
+		return false
+	}
+	if !state.wasBlocked && state.largestBase <= encoder.highestAcknowledged {
+		return false
+	}
+	free := encoder.Table.Capacity() - encoder.Table.Used()
+	return free >= encoder.duplicationMinFree
+}
+
+// unusedSize is the size of unacknowledged entries that can be referenced, but
+// that the header block doesn't reference.
+func (encoder *QpackEncoder) unusedSize(state *qpackWriterState) TableCapacity {
+	n := encoder.Table.Base() - encoder.highestAcknowledged
+	if n > encoder.table.referenceable {
+		n = encoder.table.referenceable
+	}
+	var size TableCapacity
+	for i := 0; i < n; i++ {
+		entry := encoder.table.dynamic.get(i)
+		if !state.references(entry) {
+			size += entry.Size()
+		}
+	}
+	return size
+}
+
 // writeInsert writes the entry at state.xxx[i] to the control stream.
 // Note that only nameMatch is used for this insertion.
 func (encoder *QpackEncoder) writeInsert(state *qpackWriterState, i int,
 	nameMatch Entry) error {
 	h := state.headers[i]
-	inserted := encoder.insert(h.Name, h.Value, state)
+	inserted := encoder.insert(h.Name, h.Value, state, encoder.unacknowledgedSize)
 	if inserted == nil {
 		// Leaving h unmodified causes a literal to be written.
 		return nil
@@ -293,21 +644,30 @@ func (encoder *QpackEncoder) writeInsert(state *qpackWriterState, i int,
 		return err
 	}
 
+	atomic.AddUint64(&encoder.stats.Inserts, 1)
 	state.recordMatch(i, inserted, nil)
 	return nil
 }
 
 // writeTableChanges writes out the changes to the header table. It returns the
-// largest value of base that can be used for this to work.
+// largest value of base that can be used for this to work.  Only one goroutine
+// can update the table at once, so the caller needs to hold the lock.
 func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint64) error {
-	// Only one goroutine can update the table at once.
-	defer encoder.mutex.Unlock()
-	encoder.mutex.Lock()
-
 	// wasntBlocking tracks wheter this id was blocking previously.
 	streamUsage := encoder.usage.get(id)
+	state.capacity = encoder.Table.Capacity()
 	blockingAllowed := encoder.blockedStreams < encoder.maxBlockedStreams
 	state.setupUsage(streamUsage, encoder.highestAcknowledged, blockingAllowed)
+	staticOnly := encoder.stateless
+	if !staticOnly && encoder.skipBlockedInserts &&
+		encoder.updatesBlocker != nil && encoder.updatesBlocker.WouldBlock() {
+		encoder.logger.Printf("encoder stream would block, only using the static table")
+		staticOnly = true
+	}
+	if staticOnly {
+		// Only the static table can be referenced.
+		state.maxBase = 0
+	}
 
 	for i := range state.headers {
 		// Make sure to write into the slice rather than use a copy of each header.
@@ -333,13 +693,17 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		//     when inserting a new entry.
 		//     The at-risk lookup considers entries that are blocked by maxBase.
 		//     However, to avoid churn on the table, unacknowledged entries are not
-		//     duplicated.
+		//     duplicated unless the duplication policy allows it.
 
 		match, nameMatch := encoder.table.LookupReferenceable(h.Name, h.Value, state.maxBase)
 		if match != nil {
 			state.recordMatch(i, match, nameMatch)
 			continue
 		}
+		if staticOnly {
+			state.recordMatch(i, nil, nameMatch)
+			continue
+		}
 
 		if encoder.table.LookupBlocked(h.Name, h.Value, state.maxBase) {
 			continue
@@ -352,9 +716,10 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		var insertNameMatch Entry
 		duplicate, insertNameMatch := encoder.table.LookupExtra(h.Name, h.Value)
 		if duplicate != nil {
-			// Only duplicate acknowledged entries.  Refreshing entries more than
-			// once per round trip is going to churn the table too much.
-			if duplicate.Base() <= encoder.highestAcknowledged {
+			// Usually, only duplicate acknowledged entries.  Refreshing entries more
+			// than once per round trip is going to churn the table too much.
+			if duplicate.Base() <= encoder.highestAcknowledged ||
+				encoder.canDuplicateUnacknowledged(state) {
 				err := encoder.writeDuplicate(duplicate, state, i)
 				if err != nil {
 					return err
@@ -383,6 +748,11 @@ func (encoder *QpackEncoder) writeTableChanges(state *qpackWriterState, id uint6
 		encoder.blockedStreams++
 	}
 
+	// Register the use of every entry now, so that inserts for other streams
+	// can't evict them before the header block is written.
+	for i := range state.headers {
+		state.addUse(i)
+	}
 	state.recordUsage(streamUsage)
 	return nil
 }
@@ -394,7 +764,7 @@ func (encoder *QpackEncoder) writeIndexed(writer *Writer, state *qpackWriterStat
 	var prefix byte
 	dynamicEntry, ok := entry.(DynamicEntry)
 	if ok {
-		index = dynamicEntry.Index(state.largestBase)
+		index = dynamicEntry.Index(state.base)
 		if index < 0 {
 			// This is a post-base index.
 			prefix = 4
@@ -418,7 +788,7 @@ func (encoder *QpackEncoder) writeIndexed(writer *Writer, state *qpackWriterStat
 		return err
 	}
 
-	state.addUse(i)
+	atomic.AddUint64(&encoder.stats.Indexed, 1)
 	return nil
 }
 
@@ -429,7 +799,7 @@ func (encoder *QpackEncoder) writeLiteralNameReference(writer *Writer, state *qp
 	var err error
 	dynamicEntry, ok := nameMatch.(DynamicEntry)
 	if ok {
-		index = dynamicEntry.Index(state.largestBase)
+		index = dynamicEntry.Index(state.base)
 		if index < 0 {
 			// Post-base index
 			prefix = 3
@@ -461,8 +831,10 @@ func (encoder *QpackEncoder) writeLiteral(writer *Writer, state *qpackWriterStat
 	var err error
 	nameMatch := state.nameMatches[i]
 	if nameMatch != nil {
+		atomic.AddUint64(&encoder.stats.LiteralNameReferences, 1)
 		err = encoder.writeLiteralNameReference(writer, state, sensitive, nameMatch)
 	} else {
+		atomic.AddUint64(&encoder.stats.LiteralNames, 1)
 		err = writer.WriteBits(2|sensitive, 4)
 		if err != nil {
 			return err
@@ -473,42 +845,50 @@ func (encoder *QpackEncoder) writeLiteral(writer *Writer, state *qpackWriterStat
 		return err
 	}
 
-	err = writer.WriteStringRaw(h.Value, 7, encoder.HuffmanPreference)
-	if err != nil {
-		return err
-	}
-
-	state.addUse(i)
-	return nil
+	return writer.WriteStringRaw(h.Value, 7, encoder.HuffmanPreference)
 }
 
-func (encoder *QpackEncoder) encodeLargestReference(largestBase int) uint64 {
+func (encoder *QpackEncoder) encodeLargestReference(largestBase int, capacity TableCapacity) uint64 {
 	if largestBase == 0 {
 		return 0
 	}
 	// largestBase is the same thing as largestReference here - a count of the number of inserts.
 	// The spec is confused, but the resulting code is fine.
 	largestReference := uint64(largestBase)
-	maxEntries := uint64(encoder.Table.Capacity() / entryOverhead)
+	if !encoder.DraftVersion.reducesLargestReference() {
+		return largestReference
+	}
+	maxEntries := uint64(capacity / entryOverhead)
 	return (largestReference % (2 * maxEntries)) + 1
 }
 
+// writeHeaderBlock writes a header block.  This only uses what
+// writeTableChanges recorded in `state`, so it doesn't need the lock.  The
+// entries that the header block references can't be evicted, because
+// writeTableChanges registered their use.
 func (encoder *QpackEncoder) writeHeaderBlock(headerWriter io.Writer, state *qpackWriterState) error {
-	w := NewWriter(headerWriter)
-	err := w.WriteInt(encoder.encodeLargestReference(state.largestBase), 8)
+	w := NewWriter(countingWriter{headerWriter, &encoder.stats.HeaderBytes})
+	err := w.WriteInt(encoder.encodeLargestReference(state.largestBase, state.capacity), 8)
 	if err != nil {
 		return err
 	}
 
-	// This is the base index delta, which this code doesn't use.
-	err = w.WriteInt(0, 8)
+	// The base is never larger than the largest reference, so the sign bit
+	// is set if there is any difference.
+	state.chooseBase()
+	delta := uint64(state.largestBase - state.base)
+	var sign byte
+	if delta > 0 {
+		sign = 1
+	}
+	err = w.WriteBit(sign)
+	if err != nil {
+		return err
+	}
+	err = w.WriteInt(delta, 7)
 	if err != nil {
 		return err
 	}
-
-	// Make sure that we don't read over writes.
-	defer encoder.mutex.RUnlock()
-	encoder.mutex.RLock()
 
 	for i := range state.headers {
 		var err error
@@ -528,19 +908,247 @@ func (encoder *QpackEncoder) writeHeaderBlock(headerWriter io.Writer, state *qpa
 // `id` is an ID for the stream that this header block relates to. The caller
 // needs to pick a token that is unique among the tokens that are currently
 // unacknowledged. Using the same token twice without first acknowledging it can
-// result in errors.
+// result in errors.  Header blocks for different streams can be written
+// concurrently; only the changes to the table are serialized.
 func (encoder *QpackEncoder) WriteHeaderBlock(headerWriter io.Writer,
 	id uint64, headers ...HeaderField) error {
+	err := encoder.validateValues(headers)
+	if err != nil {
+		return err
+	}
+	headers = encoder.crumbleCookies(headers)
+	if encoder.staticOnly {
+		return encoder.writeStaticHeaderBlock(headerWriter, headers)
+	}
+	encoder.mutex.Lock()
+	err = encoder.checkHeaderListSize(headers)
+	if err != nil {
+		encoder.mutex.Unlock()
+		return err
+	}
+	if encoder.replay != nil {
+		// The entire header block is written while holding the lock so that
+		// the replay log records changes in order.
+		defer encoder.mutex.Unlock()
+		var block []byte
+		block, err = encoder.encodeHeaderBlock(id, headers)
+		if err != nil {
+			return err
+		}
+		_, err = headerWriter.Write(block)
+		return err
+	}
 	var state qpackWriterState
 	state.initHeaders(headers)
-	err := encoder.writeTableChanges(&state, id)
+	err = encoder.writeTableChanges(&state, id)
+	encoder.mutex.Unlock()
 	if err != nil {
 		return err
 	}
 
+	// Other streams can change the table from here on.
+	return encoder.writeHeaderBlock(headerWriter, &state)
+}
+
+// writeStaticHeaderBlock writes a header block that only uses the static table.
+// Only the check of the header list size needs a read lock, because nothing
+// else here touches state that changes.
+func (encoder *QpackEncoder) writeStaticHeaderBlock(headerWriter io.Writer, headers []HeaderField) error {
+	encoder.mutex.RLock()
+	err := encoder.checkHeaderListSize(headers)
+	encoder.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	var state qpackWriterState
+	state.initHeaders(headers)
+	for i, h := range state.headers {
+		if h.Sensitive {
+			continue
+		}
+		static := qpackStaticIndex
+		if !useQpackStaticTable {
+			static = hpackStaticIndex
+		}
+		match, nameMatch := static.lookup(h.Name, h.Value)
+		state.recordMatch(i, match, nameMatch)
+	}
 	return encoder.writeHeaderBlock(headerWriter, &state)
 }
 
+// HeaderBlock is a header block that is waiting to be encoded by
+// WriteHeaderBlocks.
+type HeaderBlock struct {
+	ID      uint64
+	Headers []HeaderField
+}
+
+// WriteHeaderBlocks encodes several header blocks at once, returning the
+// encoded blocks in the same order.  This only acquires the encoder lock once,
+// which reduces contention when many header blocks are written together.  As
+// with WriteHeaderFrame, any inserts that these header blocks depend on are
+// written to the encoder stream before this returns.
+func (encoder *QpackEncoder) WriteHeaderBlocks(blocks ...HeaderBlock) ([][]byte, error) {
+	for _, block := range blocks {
+		err := encoder.validateValues(block.Headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+
+	encoded := make([][]byte, len(blocks))
+	for i, block := range blocks {
+		var err error
+		headers := encoder.crumbleCookies(block.Headers)
+		err = encoder.checkHeaderListSize(headers)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i], err = encoder.encodeHeaderBlock(block.ID, headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encoded, nil
+}
+
+// checkHeaderListSize checks that a header list isn't larger than the peer
+// accepts.  The caller needs to hold at least a read lock.
+func (encoder *QpackEncoder) checkHeaderListSize(headers []HeaderField) error {
+	if encoder.maxHeaderListSize == 0 {
+		return nil
+	}
+	var listSize uint64
+	for _, h := range headers {
+		listSize += uint64(h.size())
+	}
+	if listSize > encoder.maxHeaderListSize {
+		encoder.logger.Printf("header list of size %v exceeds %v",
+			listSize, encoder.maxHeaderListSize)
+		return ErrHeaderListTooLarge
+	}
+	return nil
+}
+
+// encodeHeaderBlock writes table changes and returns the encoded header block.
+// The caller needs to hold the lock.
+func (encoder *QpackEncoder) encodeHeaderBlock(id uint64, headers []HeaderField) ([]byte, error) {
+	if encoder.replayUpdates != nil {
+		encoder.replayUpdates.Reset()
+	}
+	var state qpackWriterState
+	state.initHeaders(headers)
+	err := encoder.writeTableChanges(&state, id)
+	if err != nil {
+		return nil, err
+	}
+	var headerBuf bytes.Buffer
+	err = encoder.writeHeaderBlock(&headerBuf, &state)
+	if err != nil {
+		return nil, err
+	}
+	if encoder.replay != nil {
+		err = encoder.replay.Encode(&replayRecord{
+			Op:      replayHeader,
+			ID:      id,
+			Headers: headers,
+			Updates: encoder.replayUpdates.Bytes(),
+			Block:   headerBuf.Bytes(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return headerBuf.Bytes(), nil
+}
+
+// Preload inserts header fields into the dynamic table without writing a
+// header block, so that the first header blocks can reference them.  Fields
+// are skipped if they are sensitive, if shouldIndex rejects them, if they are
+// already in the table, or if there isn't space for them.  Preloaded entries
+// don't evict each other.  This returns the base of the table afterwards.
+func (encoder *QpackEncoder) Preload(fields ...HeaderField) (int, error) {
+	err := encoder.validateValues(fields)
+	if err != nil {
+		return 0, err
+	}
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if encoder.replayUpdates != nil {
+		encoder.replayUpdates.Reset()
+	}
+	err = encoder.preload(fields)
+	if err != nil {
+		return 0, err
+	}
+	if encoder.replay != nil {
+		err = encoder.replay.Encode(&replayRecord{
+			Op:      replayPreload,
+			Headers: fields,
+			Updates: encoder.replayUpdates.Bytes(),
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return encoder.Table.Base(), nil
+}
+
+// preload does the work for Preload.  The caller needs to hold the lock.
+func (encoder *QpackEncoder) preload(fields []HeaderField) error {
+	if encoder.stateless || encoder.staticOnly {
+		return nil
+	}
+	var state qpackWriterState
+	state.initHeaders(fields)
+	state.maxBase = intMax
+	for i, h := range state.headers {
+		if h.Sensitive || !encoder.shouldIndex(h) {
+			continue
+		}
+		match, nameMatch := encoder.table.LookupReferenceable(h.Name, h.Value, intMax)
+		if match != nil {
+			continue
+		}
+		err := encoder.writeInsert(&state, i, nameMatch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushUpdates writes out any partially written octet on the encoder stream,
+// padding it with zero bits.  Instructions always end on an octet boundary, so
+// this should never need to write anything, but it is harmless to call this
+// when the connection is idle or closing.
+func (encoder *QpackEncoder) FlushUpdates() error {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	return encoder.updatesWriter.Pad(0)
+}
+
+// HeaderFrameWriter writes a complete header block as a single frame.
+type HeaderFrameWriter interface {
+	WriteHeaderFrame(block []byte) error
+}
+
+// WriteHeaderFrame is like WriteHeaderBlock, except that the header block is
+// passed to `fw` once it is complete.  Any inserts that the header block
+// depends on are written to the encoder stream before `fw` is called, so the
+// header block can't be sent ahead of those inserts.
+func (encoder *QpackEncoder) WriteHeaderFrame(fw HeaderFrameWriter,
+	id uint64, headers ...HeaderField) error {
+	var headerBuf bytes.Buffer
+	err := encoder.WriteHeaderBlock(&headerBuf, id, headers...)
+	if err != nil {
+		return err
+	}
+	return fw.WriteHeaderFrame(headerBuf.Bytes())
+}
+
 // updateHighestAcknowledged increases the acknowledgment count.
 func (encoder *QpackEncoder) updateHighestAcknowledged(increment int) {
 	if increment <= 0 {
@@ -556,10 +1164,44 @@ func (encoder *QpackEncoder) updateHighestAcknowledged(increment int) {
 		// Use highestAcknowledged as the base to get entries
 		// starting at the highest acknowledged and working backwards.
 		entry := encoder.Table.GetDynamic(i, encoder.highestAcknowledged)
+		if entry == nil {
+			// This was inserted before RestoreState was called.
+			continue
+		}
 		encoder.unacknowledgedSize -= entry.Size()
 	}
 }
 
+// KnownReceivedCount returns the number of inserts that the decoder is known
+// to have received.
+func (encoder *QpackEncoder) KnownReceivedCount() int {
+	defer encoder.mutex.RUnlock()
+	encoder.mutex.RLock()
+	return encoder.highestAcknowledged
+}
+
+// RestoreState seeds a new encoder with the state of one that it replaces.
+// `base` is the number of inserts that were made, and `knownReceived` is the
+// number of those that the decoder is known to have received.  The table
+// starts out empty, as though every entry was evicted.  This returns
+// ErrInvalidRestore if `knownReceived` is more than `base`, or if the encoder
+// has already made inserts or written header blocks.  This is for tests and
+// for rebuilding an encoder from a checkpoint.  The values need to match what
+// the decoder has; if they don't, the encoder stream and header blocks will
+// be corrupted.
+func (encoder *QpackEncoder) RestoreState(base int, knownReceived int) error {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if knownReceived < 0 || knownReceived > base ||
+		encoder.Table.Base() != 0 || len(encoder.usage) != 0 {
+		return ErrInvalidRestore
+	}
+	encoder.logReplay(&replayRecord{Op: replayRestore, Value: uint64(base), ID: uint64(knownReceived)})
+	encoder.table.restoreBase(base)
+	encoder.highestAcknowledged = knownReceived
+	return nil
+}
+
 // AcknowledgeInsert acknowledges that the remote decoder has received a
 // new insert or duplicate instructions.
 func (encoder *QpackEncoder) AcknowledgeInsert(increment int) error {
@@ -569,6 +1211,7 @@ func (encoder *QpackEncoder) AcknowledgeInsert(increment int) error {
 
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayAckInsert, Value: uint64(increment)})
 	base := encoder.highestAcknowledged + increment
 	if base > encoder.Table.Base() {
 		return ErrIndexError
@@ -580,13 +1223,22 @@ func (encoder *QpackEncoder) AcknowledgeInsert(increment int) error {
 
 // AcknowledgeHeader is called when a header block has been acknowledged by the peer.
 // This allows dynamic table entries to be evicted as necessary on the next call.
+// Acknowledging a stream that had no references to the dynamic table is harmless,
+// but this returns ErrIndexError if no header block was written for the stream.
 func (encoder *QpackEncoder) AcknowledgeHeader(id uint64) error {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
-	removedLargest, newLargest := encoder.usage.ack(id)
-	if removedLargest == 0 {
+	encoder.logReplay(&replayRecord{Op: replayAckHeader, ID: id})
+	removedLargest, newLargest, ok := encoder.usage.ack(id)
+	if !ok {
 		return ErrIndexError
 	}
+	if removedLargest == 0 {
+		// The decoder only acknowledges header blocks that reference the
+		// dynamic table, so this is unexpected, but it is harmless.
+		encoder.logger.Printf("acknowledgment for %v, which has no references", id)
+		return nil
+	}
 	if removedLargest > encoder.highestAcknowledged && newLargest <= encoder.highestAcknowledged {
 		encoder.blockedStreams--
 		encoder.updateHighestAcknowledged(removedLargest - encoder.highestAcknowledged)
@@ -596,13 +1248,17 @@ func (encoder *QpackEncoder) AcknowledgeHeader(id uint64) error {
 
 // AcknowledgeReset is used when this side resets a stream.  When the decoder
 // discovers that it might not be able to acknowledge all the header blocks,
-// it sends a cancellation acknowledgment that we need to consume.
+// it sends a cancellation acknowledgment that we need to consume.  The decoder
+// can't know which streams have outstanding references, so a cancellation for
+// a stream without any is ignored.
 func (encoder *QpackEncoder) AcknowledgeReset(id uint64) error {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayAckReset, ID: id})
 	largest := encoder.usage.cancel(id)
 	if largest < 0 {
-		return ErrIndexError // unknown stream ID
+		encoder.logger.Printf("cancellation for %v, which has no references", id)
+		return nil
 	}
 	if largest > encoder.highestAcknowledged {
 		encoder.blockedStreams--
@@ -610,27 +1266,174 @@ func (encoder *QpackEncoder) AcknowledgeReset(id uint64) error {
 	return nil
 }
 
-// SetCapacity sets the table capacity. This panics if it is called when the
-// capacity has already been set to a non-zero value.
-func (encoder *QpackEncoder) SetCapacity(capacity TableCapacity) {
+// SetMaxCapacity sets the maximum table capacity that the decoder permits.
+// A decoder starts with this capacity, so the table capacity is set to this
+// value without sending an instruction.  If entries have already been
+// inserted, this can only reduce the capacity, which is signaled.
+func (encoder *QpackEncoder) SetMaxCapacity(capacity TableCapacity) error {
+	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayMaxCapacity, Value: uint64(capacity)})
+	encoder.maxCapacity = capacity
+	if encoder.table.Base() == 0 {
+		encoder.table.SetCapacity(capacity)
+		encoder.mutex.Unlock()
+		return nil
+	}
+	reduce := encoder.table.Capacity() > capacity
+	encoder.mutex.Unlock()
+	if reduce {
+		return encoder.SetCapacity(capacity)
+	}
+	return nil
+}
+
+// acknowledgedEvictionCheck prevents the eviction of unacknowledged entries.
+type acknowledgedEvictionCheck int
+
+func (highestAcknowledged acknowledgedEvictionCheck) CanEvict(e DynamicEntry) bool {
+	return e.Base() <= int(highestAcknowledged)
+}
+
+// SetCapacity changes the table capacity and writes a Set Dynamic Table
+// Capacity instruction to the encoder stream.  The capacity is limited to the
+// value set with SetMaxCapacity.  Reducing capacity evicts entries, which
+// fails with ErrEvictionBlocked if those entries are referenced by
+// unacknowledged header blocks or haven't been acknowledged themselves.
+func (encoder *QpackEncoder) SetCapacity(capacity TableCapacity) error {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
-	encoder.table.SetCapacity(capacity)
+	encoder.logReplay(&replayRecord{Op: replayCapacity, Value: uint64(capacity)})
+	if capacity > encoder.maxCapacity {
+		capacity = encoder.maxCapacity
+	}
+	if capacity == encoder.table.Capacity() {
+		return nil
+	}
+	if !encoder.table.resize(capacity, acknowledgedEvictionCheck(encoder.highestAcknowledged)) {
+		return ErrEvictionBlocked
+	}
+	encoder.logger.Printf("set capacity %v", capacity)
+	err := encoder.updatesWriter.WriteBits(1, 3)
+	if err != nil {
+		return err
+	}
+	return encoder.updatesWriter.WriteInt(uint64(capacity), 5)
 }
 
 // SetReferenceableLimit limits the space in the table that can be used.
 func (encoder *QpackEncoder) SetReferenceableLimit(limit TableCapacity) {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayReferenceable, Value: uint64(limit)})
 	encoder.table.SetReferenceableLimit(limit)
 }
 
+// SetStateless stops the encoder from using the dynamic table.  Each header
+// block only references the static table, so it can be decoded without any
+// state from the encoder stream.  Entries that are already in the table are
+// not referenced, but they remain in the table.  An encoder made with
+// NewStaticQpackEncoder is always stateless.
+func (encoder *QpackEncoder) SetStateless(stateless bool) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	var v uint64
+	if stateless {
+		v = 1
+	}
+	encoder.logReplay(&replayRecord{Op: replayStateless, Value: v})
+	encoder.stateless = stateless
+}
+
+// WriteBlocker is implemented by an encoder stream that can tell whether a
+// write would block, such as when flow control prevents sending.
+type WriteBlocker interface {
+	WouldBlock() bool
+}
+
+// SetSkipBlockedInserts causes the encoder to check whether writing to the
+// encoder stream would block before encoding each header block.  If it would,
+// that header block only references the static table, so that it can be sent
+// without waiting for the encoder stream.  This only works if the encoder
+// stream implements WriteBlocker.
+func (encoder *QpackEncoder) SetSkipBlockedInserts(skip bool) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	encoder.skipBlockedInserts = skip
+}
+
+// SetMaxHeaderListSize sets the size of the largest header list that the peer
+// will accept, as determined by SETTINGS_MAX_HEADER_LIST_SIZE.  The size is
+// calculated in the same way as QpackDecoder.SetMaxHeaderListSize.  Writing a
+// larger header block fails with ErrHeaderListTooLarge, without changing the
+// table.  A value of 0, the default, means that there is no limit.
+func (encoder *QpackEncoder) SetMaxHeaderListSize(size uint64) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayMaxHeaderList, Value: size})
+	encoder.maxHeaderListSize = size
+}
+
+// SetMaxUnacknowledgedSize limits the total size of entries that have been
+// inserted, but not acknowledged.  Once this limit is reached, header fields
+// are encoded without inserting new entries until the decoder acknowledges
+// earlier inserts.  This limits how much of the table is pinned by
+// unacknowledged entries.  A value of 0, the default, means no limit.
+func (encoder *QpackEncoder) SetMaxUnacknowledgedSize(size TableCapacity) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	encoder.logReplay(&replayRecord{Op: replayMaxUnacknowledged, Value: uint64(size)})
+	encoder.maxUnacknowledgedSize = size
+}
+
+// DuplicationPolicy decides which entries the encoder duplicates when they are
+// close to being evicted.
+type DuplicationPolicy byte
+
+const (
+	// DuplicateAcknowledged only duplicates entries that the decoder has
+	// acknowledged.  Duplicating other entries more than once per round trip
+	// can churn the table.  This is the default.
+	DuplicateAcknowledged = DuplicationPolicy(iota)
+	// DuplicateWithFreeSpace also duplicates entries that haven't been
+	// acknowledged, as long as the table has enough free space and the
+	// header block already depends on an entry that hasn't been acknowledged.
+	// With a large table, a duplicate is cheaper than a literal.
+	DuplicateWithFreeSpace
+)
+
+func (p DuplicationPolicy) String() string {
+	switch p {
+	case DuplicateAcknowledged:
+		return "acknowledged"
+	case DuplicateWithFreeSpace:
+		return "free space"
+	}
+	return "unknown"
+}
+
+// SetDuplicationPolicy sets the policy for duplicating entries.  With
+// DuplicateWithFreeSpace, entries that haven't been acknowledged are
+// duplicated only for a header block that is already blocked, and only when
+// at least `minFree` of the table is unused.  `minFree` is ignored for
+// DuplicateAcknowledged.
+func (encoder *QpackEncoder) SetDuplicationPolicy(policy DuplicationPolicy, minFree TableCapacity) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	op := replayDuplicateAcknowledged
+	if policy == DuplicateWithFreeSpace {
+		op = replayDuplicateWithFreeSpace
+	}
+	encoder.logReplay(&replayRecord{Op: op, Value: uint64(minFree)})
+	encoder.duplicationPolicy = policy
+	encoder.duplicationMinFree = minFree
+}
+
 // SetMaxBlockedStreams sets the number of streams that this can encode without blocking.
+// If this is less than the number of streams that are currently blocked, no
+// new streams will be blocked until enough of those streams are unblocked.
 func (encoder *QpackEncoder) SetMaxBlockedStreams(m int) {
 	defer encoder.mutex.Unlock()
 	encoder.mutex.Lock()
-	if m < encoder.blockedStreams {
-		panic("can't reduce the max blocked streams below the actual blocked streams")
-	}
+	encoder.logReplay(&replayRecord{Op: replayMaxBlocked, Value: uint64(m)})
 	encoder.maxBlockedStreams = m
 }
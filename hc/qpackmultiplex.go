@@ -0,0 +1,116 @@
+package hc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"sync"
+
+	bitio "github.com/martinthomson/minhq/io"
+)
+
+// readMultiplexedFrame reads the stream ID and contents of a single frame from
+// a multiplexed source.
+func readMultiplexedFrame(source bitio.BitReader) (uint64, []byte, error) {
+	id, err := source.ReadBits(64)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := source.ReadBits(32)
+	if err != nil {
+		return 0, nil, err
+	}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, &io.LimitedReader{R: source, N: int64(length)})
+	if err != nil {
+		return 0, nil, err
+	}
+	if n < int64(length) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return id, buf.Bytes(), nil
+}
+
+// ServiceMultiplexed reads table updates and header blocks from a single
+// source, as used by the QIF tool.  Each frame starts with a 64-bit stream ID
+// and a 32-bit length.  Frames on stream 0 are table updates; any other frame
+// is a header block for that stream.  Header blocks are decoded concurrently,
+// so a block that waits for table updates doesn't prevent later frames from
+// being read.  At the end of the source, header blocks that are still waiting
+// for table updates fail with context.Canceled.  This returns the header
+// blocks that were decoded, sorted by stream ID, and the first error.
+func (decoder *QpackDecoder) ServiceMultiplexed(source io.Reader) ([]HeaderBlock, error) {
+	input := bitio.NewBitReader(source)
+
+	// Table updates are read on another goroutine.  If that fails, writes to
+	// the pipe fail with the same error.
+	updatesReader, updatesWriter := io.Pipe()
+	updatesDone := make(chan error, 1)
+	go func() {
+		err := decoder.ReadTableUpdates(updatesReader)
+		updatesReader.CloseWithError(err)
+		updatesDone <- err
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var blocks []HeaderBlock
+	var firstErr error
+	fail := func(err error) {
+		defer mutex.Unlock()
+		mutex.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for {
+		id, p, err := readMultiplexedFrame(input)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+			break
+		}
+
+		if id == 0 {
+			_, err = updatesWriter.Write(p)
+			if err != nil {
+				fail(err)
+				break
+			}
+			continue
+		}
+
+		wg.Add(1)
+		go func(id uint64, p []byte) {
+			defer wg.Done()
+			headers, err := decoder.ReadHeaderBlockContext(ctx, bytes.NewReader(p), id)
+			if err != nil {
+				fail(err)
+				return
+			}
+			defer mutex.Unlock()
+			mutex.Lock()
+			blocks = append(blocks, HeaderBlock{id, headers})
+		}(id, p)
+	}
+
+	updatesWriter.Close()
+	err := <-updatesDone
+	if err != nil {
+		fail(err)
+	}
+	// No more table updates are coming, so stop anything that is waiting.
+	cancel()
+	wg.Wait()
+
+	sort.Slice(blocks, func(i int, j int) bool {
+		return blocks[i].ID < blocks[j].ID
+	})
+	return blocks, firstErr
+}
@@ -0,0 +1,193 @@
+package hc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// ErrReplayMismatch is returned by ReplayQpackEncoder when an encoder doesn't
+// produce the same output as the encoder that wrote the replay log.
+var ErrReplayMismatch = errors.New("replayed encoder output doesn't match the log")
+
+// These are the operations that the replay log records.
+const (
+	replayHeader        = "header"
+	replayAckHeader     = "ack-header"
+	replayAckInsert     = "ack-insert"
+	replayAckReset      = "ack-reset"
+	replayCapacity      = "capacity"
+	replayMaxCapacity   = "max-capacity"
+	replayMaxBlocked    = "max-blocked"
+	replayReferenceable = "referenceable"
+	replayStateless     = "stateless"
+
+	replayMaxUnacknowledged = "max-unacknowledged"
+	replayMaxHeaderList     = "max-header-list"
+
+	replayPreload = "preload"
+	replayRestore = "restore"
+
+	replayDuplicateAcknowledged  = "duplicate-acknowledged"
+	replayDuplicateWithFreeSpace = "duplicate-free-space"
+)
+
+// replayRecord is a single line in the replay log.  `Updates` and `Block` are
+// only set for header blocks, and record what was written to the encoder
+// stream and the header block.
+type replayRecord struct {
+	Op      string        `json:"op"`
+	ID      uint64        `json:"id,omitempty"`
+	Value   uint64        `json:"value,omitempty"`
+	Headers []HeaderField `json:"headers,omitempty"`
+	Updates []byte        `json:"updates,omitempty"`
+	Block   []byte        `json:"block,omitempty"`
+}
+
+// replayCapture copies what is written to the encoder stream so that it can
+// be added to the replay log.
+type replayCapture struct {
+	encoder *QpackEncoder
+	w       io.Writer
+}
+
+func (rc replayCapture) Write(p []byte) (int, error) {
+	if rc.encoder.replayUpdates != nil {
+		rc.encoder.replayUpdates.Write(p)
+	}
+	return rc.w.Write(p)
+}
+
+// SetReplayLog causes the encoder to write a log of everything that affects
+// its state to `w`.  The log has one JSON object on each line.  Each header
+// block is logged with the stream ID, the header fields, and the bytes that
+// were written to the encoder stream and header block.  Acknowledgments and
+// changes to settings are also logged.  This includes the values of sensitive
+// header fields, so take care with the log.  ReplayQpackEncoder reads the log.
+// Set this to nil to stop logging.
+func (encoder *QpackEncoder) SetReplayLog(w io.Writer) {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if w == nil {
+		encoder.replay = nil
+		encoder.replayUpdates = nil
+		return
+	}
+	encoder.replay = json.NewEncoder(w)
+	encoder.replayUpdates = new(bytes.Buffer)
+}
+
+// logReplay writes a record to the replay log.  The caller needs to hold the
+// lock.
+func (encoder *QpackEncoder) logReplay(record *replayRecord) {
+	if encoder.replay == nil {
+		return
+	}
+	err := encoder.replay.Encode(record)
+	if err != nil {
+		encoder.logger.Printf("error writing replay log: %v", err)
+	}
+}
+
+// replayHeaderBlock encodes a logged header block and checks that the output
+// is the same as what was logged.
+func (encoder *QpackEncoder) replayHeaderBlock(record *replayRecord) error {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if encoder.replayUpdates == nil {
+		encoder.replayUpdates = new(bytes.Buffer)
+		defer func() { encoder.replayUpdates = nil }()
+	}
+	block, err := encoder.encodeHeaderBlock(record.ID, record.Headers)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(record.Updates, encoder.replayUpdates.Bytes()) ||
+		!bytes.Equal(record.Block, block) {
+		return ErrReplayMismatch
+	}
+	return nil
+}
+
+// replayPreload repeats a logged call to Preload and checks that the encoder
+// stream is the same as what was logged.
+func (encoder *QpackEncoder) replayPreload(record *replayRecord) error {
+	defer encoder.mutex.Unlock()
+	encoder.mutex.Lock()
+	if encoder.replayUpdates == nil {
+		encoder.replayUpdates = new(bytes.Buffer)
+		defer func() { encoder.replayUpdates = nil }()
+	}
+	encoder.replayUpdates.Reset()
+	err := encoder.preload(record.Headers)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(record.Updates, encoder.replayUpdates.Bytes()) {
+		return ErrReplayMismatch
+	}
+	return nil
+}
+
+// ReplayQpackEncoder reads a log that was written by an encoder after calling
+// SetReplayLog and repeats each operation with `encoder`.  The encoder needs
+// to be new and created with the same arguments as the encoder that wrote the
+// log.  This returns ErrReplayMismatch if a header block or the encoder stream
+// differ from the log.  Acknowledgments and settings are repeated, but any
+// errors from those are ignored, because those errors aren't logged.
+func ReplayQpackEncoder(r io.Reader, encoder *QpackEncoder) error {
+	d := json.NewDecoder(r)
+	for {
+		var record replayRecord
+		err := d.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch record.Op {
+		case replayHeader:
+			err = encoder.replayHeaderBlock(&record)
+			if err != nil {
+				return err
+			}
+		case replayPreload:
+			err = encoder.replayPreload(&record)
+			if err != nil {
+				return err
+			}
+		case replayAckHeader:
+			_ = encoder.AcknowledgeHeader(record.ID)
+		case replayAckInsert:
+			_ = encoder.AcknowledgeInsert(int(record.Value))
+		case replayAckReset:
+			_ = encoder.AcknowledgeReset(record.ID)
+		case replayCapacity:
+			_ = encoder.SetCapacity(TableCapacity(record.Value))
+		case replayMaxCapacity:
+			_ = encoder.SetMaxCapacity(TableCapacity(record.Value))
+		case replayMaxBlocked:
+			encoder.SetMaxBlockedStreams(int(record.Value))
+		case replayReferenceable:
+			encoder.SetReferenceableLimit(TableCapacity(record.Value))
+		case replayStateless:
+			encoder.SetStateless(record.Value != 0)
+		case replayMaxUnacknowledged:
+			encoder.SetMaxUnacknowledgedSize(TableCapacity(record.Value))
+		case replayMaxHeaderList:
+			encoder.SetMaxHeaderListSize(record.Value)
+		case replayRestore:
+			// The known received count is logged in the ID field.
+			_ = encoder.RestoreState(int(record.Value), int(record.ID))
+		case replayDuplicateAcknowledged:
+			encoder.SetDuplicationPolicy(DuplicateAcknowledged, TableCapacity(record.Value))
+		case replayDuplicateWithFreeSpace:
+			encoder.SetDuplicationPolicy(DuplicateWithFreeSpace, TableCapacity(record.Value))
+		default:
+			encoder.logger.Printf("unknown replay operation %v", record.Op)
+		}
+	}
+}
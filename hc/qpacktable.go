@@ -1,9 +1,21 @@
 package hc
 
 import (
+	"context"
+	"errors"
 	"sync"
 )
 
+// ErrTableReset is returned to anything waiting on a table that is cleared.
+var ErrTableReset = errors.New("table was reset")
+
+// ErrTableClosed is returned to anything waiting on a table that is closed.
+var ErrTableClosed = errors.New("table was closed")
+
+// ErrBlockedStreamLimit is returned when waiting for entries would exceed
+// the limit on the number of blocked header blocks.
+var ErrBlockedStreamLimit = errors.New("too many blocked header blocks")
+
 const tableOverhead = TableCapacity(32)
 
 // qpackEntry is an entry in the QPACK table.
@@ -20,9 +32,9 @@ const useQpackStaticTable = true
 // Lookup finds an entry.
 func (table *qpackTableCommon) Lookup(name string, value string) (Entry, Entry) {
 	if useQpackStaticTable {
-		return table.lookupImpl(qpackStaticTable, name, value, 0, len(table.dynamic))
+		return table.lookupImpl(qpackStaticIndex, name, value, 0, table.dynamic.len())
 	}
-	return table.lookupImpl(hpackStaticTable, name, value, 0, len(table.dynamic))
+	return table.lookupImpl(hpackStaticIndex, name, value, 0, table.dynamic.len())
 }
 
 // Index returns the index for the given entry.
@@ -58,11 +70,31 @@ type QpackDecoderTable struct {
 	// This is used to notify any waiting readers that new table entries are
 	// available.
 	insertCondition *sync.Cond
+	// generation increases each time that the table is cleared.
+	generation int
+	// closed is set when no more entries will be added.
+	closed bool
+	// closeErr is returned to waiters after the table is closed.
+	closeErr error
+	// blocked is the number of calls to WaitForEntry that are waiting.
+	blocked int
+	// maxBlocked limits blocked, but only if limitBlocked is set.
+	maxBlocked   int
+	limitBlocked bool
+	// encoderCapacity is the capacity that the encoder believes the table
+	// has.  This is different from the actual capacity after ReduceCapacity.
+	encoderCapacity TableCapacity
+	// capacityLimit limits the capacity, but only if limitCapacity is set.
+	capacityLimit TableCapacity
+	limitCapacity bool
 }
 
 // NewQpackDecoderTable makes a new table of the specified capacity.
 func NewQpackDecoderTable(capacity TableCapacity) *QpackDecoderTable {
-	qt := &QpackDecoderTable{table: qpackTableCommon{tableCommon{capacity: capacity}}}
+	qt := &QpackDecoderTable{
+		table:           qpackTableCommon{tableCommon{capacity: capacity}},
+		encoderCapacity: capacity,
+	}
 	qt.insertCondition = sync.NewCond(&qt.lock)
 	return qt
 }
@@ -79,13 +111,110 @@ func (qt *QpackDecoderTable) GetStatic(i int) Entry {
 	return qt.table.GetStatic(i)
 }
 
-// WaitForEntry waits until the table base reaches or exceeds the specified value.
-func (qt *QpackDecoderTable) WaitForEntry(base int) {
+// WaitForEntry waits until the table base reaches or exceeds the specified
+// value.  This returns ErrTableReset if the table is cleared while waiting,
+// ErrTableClosed (or the error passed to CloseWithError) if the table is
+// closed, or ErrBlockedStreamLimit if too many
+// callers are already waiting.
+func (qt *QpackDecoderTable) WaitForEntry(base int) error {
+	return qt.WaitForEntryContext(context.Background(), base)
+}
+
+// WaitForEntryContext is like WaitForEntry, except that it also stops
+// waiting and returns ctx.Err() when `ctx` is done.
+func (qt *QpackDecoderTable) WaitForEntryContext(ctx context.Context, base int) error {
 	defer qt.lock.Unlock()
 	qt.lock.Lock()
+	if qt.table.Base() >= base {
+		return nil
+	}
+	if qt.closed {
+		return qt.closeErr
+	}
+	if qt.limitBlocked && qt.blocked >= qt.maxBlocked {
+		return ErrBlockedStreamLimit
+	}
+	qt.blocked++
+	defer func() { qt.blocked-- }()
+
+	if ctx.Done() != nil {
+		// Wake this waiter when the context is done.  Taking the lock
+		// ensures that the broadcast can't happen before Wait is called.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				qt.lock.Lock()
+				qt.insertCondition.Broadcast()
+				qt.lock.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+
+	generation := qt.generation
 	for qt.table.Base() < base {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
 		qt.insertCondition.Wait()
+		if qt.generation != generation {
+			return ErrTableReset
+		}
+		if qt.closed {
+			return qt.closeErr
+		}
 	}
+	return nil
+}
+
+// Close stops the table from being used for waiting.  Anything that is
+// waiting for entries is woken and fails with ErrTableClosed.
+func (qt *QpackDecoderTable) Close() {
+	qt.CloseWithError(ErrTableClosed)
+}
+
+// CloseWithError is like Close, except that anything waiting for entries fails
+// with `err`.  Only the first error is used if this is called more than once.
+func (qt *QpackDecoderTable) CloseWithError(err error) {
+	defer qt.lock.Unlock()
+	qt.lock.Lock()
+	if !qt.closed {
+		qt.closed = true
+		qt.closeErr = err
+	}
+	qt.insertCondition.Broadcast()
+}
+
+// SetMaxBlocked limits the number of callers that can be waiting in
+// WaitForEntry at the same time.  By default, there is no limit.
+func (qt *QpackDecoderTable) SetMaxBlocked(max int) {
+	defer qt.lock.Unlock()
+	qt.lock.Lock()
+	qt.maxBlocked = max
+	qt.limitBlocked = true
+}
+
+// Blocked returns the number of callers that are waiting in WaitForEntry.
+func (qt *QpackDecoderTable) Blocked() int {
+	defer qt.lock.RUnlock()
+	qt.lock.RLock()
+	return qt.blocked
+}
+
+// Clear removes all entries from the table and resets the base to zero, so
+// that the table can be reused.  The capacity is unchanged.  Anything that is
+// waiting for entries is woken and fails with ErrTableReset.
+func (qt *QpackDecoderTable) Clear() {
+	defer qt.lock.Unlock()
+	qt.lock.Lock()
+	qt.table.dynamic.truncate(0)
+	qt.table.used = 0
+	qt.table.base = 0
+	qt.generation++
+	qt.insertCondition.Broadcast()
 }
 
 // Insert an entry into the table.
@@ -108,13 +237,42 @@ func (qt *QpackDecoderTable) Capacity() TableCapacity {
 	return qt.table.Capacity()
 }
 
-// SetCapacity wraps tableCommon.SetCapacity with a writer lock.
+// SetCapacity wraps tableCommon.SetCapacity with a writer lock.  If the
+// capacity was reduced with ReduceCapacity, the table won't grow past that.
 func (qt *QpackDecoderTable) SetCapacity(capacity TableCapacity) {
 	defer qt.lock.Unlock()
 	qt.lock.Lock()
+	qt.encoderCapacity = capacity
+	if qt.limitCapacity && capacity > qt.capacityLimit {
+		capacity = qt.capacityLimit
+	}
 	qt.table.SetCapacity(capacity)
 }
 
+// ReduceCapacity limits the capacity of the table, evicting entries as
+// needed.  This is a local decision, so nothing tells the encoder about
+// it.  The encoder will continue to reference entries that were evicted and
+// insert entries that don't fit, which causes decoding to fail with
+// ErrIndexError or ErrTableOverflow respectively.  Only use this when losing
+// the connection is better than using more memory.
+func (qt *QpackDecoderTable) ReduceCapacity(capacity TableCapacity) {
+	defer qt.lock.Unlock()
+	qt.lock.Lock()
+	qt.capacityLimit = capacity
+	qt.limitCapacity = true
+	if qt.table.Capacity() > capacity {
+		qt.table.SetCapacity(capacity)
+	}
+}
+
+// referenceCapacity is the capacity that the encoder uses when it encodes
+// the largest reference in a header block.
+func (qt *QpackDecoderTable) referenceCapacity() TableCapacity {
+	defer qt.lock.RUnlock()
+	qt.lock.RLock()
+	return qt.encoderCapacity
+}
+
 // Base wraps tableCommon.Base with a reader lock.
 func (qt *QpackDecoderTable) Base() int {
 	defer qt.lock.RUnlock()
@@ -143,6 +301,18 @@ func (qt *QpackDecoderTable) Index(e Entry) int {
 	return qt.table.Index(e)
 }
 
+// snapshot copies the entries in the table, newest first.
+func (qt *QpackDecoderTable) snapshot() []HeaderField {
+	defer qt.lock.RUnlock()
+	qt.lock.RLock()
+	entries := make([]HeaderField, qt.table.dynamic.len())
+	for i := range entries {
+		e := qt.table.dynamic.get(i)
+		entries[i] = HeaderField{Name: e.Name(), Value: e.Value()}
+	}
+	return entries
+}
+
 type qpackEncoderEntry struct {
 	qpackEntry
 	usageCount uint
@@ -231,18 +401,19 @@ func (ut *qpackUsageTracker) get(id uint64) *qpackStreamUsage {
 // ack removes one header block from the given id.  This returns the largest
 // reference from the acknowledged block and the new largest reference for
 // the given id so that the calling code can account for the number of blocked
-// streams correctly and efficiently.
-func (ut *qpackUsageTracker) ack(id uint64) (int, int) {
+// streams correctly and efficiently.  The final value is false if header
+// blocks were never written for the id.  A largest reference of 0 means that
+// header blocks were written, but none of those referenced the dynamic table.
+func (ut *qpackUsageTracker) ack(id uint64) (int, int, bool) {
 	su := (*ut)[id]
 	if su == nil {
-		// TODO report an error rather than just passing this silently
-		return 0, 0
+		return 0, 0, false
 	}
 	oldLargest := su.ack()
 	if su.count() == 0 {
 		delete(*ut, id)
 	}
-	return oldLargest, su.max()
+	return oldLargest, su.max(), true
 }
 
 func (ut *qpackUsageTracker) cancel(id uint64) int {
@@ -292,7 +463,7 @@ func (qt *QpackEncoderTable) added(qe DynamicEntry) {
 	i := qt.referenceable + 1
 	for updatedSize > qt.referenceableLimit {
 		i--
-		updatedSize -= qt.dynamic[i].Size()
+		updatedSize -= qt.dynamic.get(i).Size()
 	}
 	qt.referenceable = i
 	qt.referenceableSize = updatedSize
@@ -348,9 +519,9 @@ func (qt *QpackEncoderTable) LookupReferenceable(name string, value string, maxB
 		end = 0
 	}
 	if useQpackStaticTable {
-		return qt.lookupImpl(qpackStaticTable, name, value, start, end)
+		return qt.lookupImpl(qpackStaticIndex, name, value, start, end)
 	}
-	return qt.lookupImpl(hpackStaticTable, name, value, start, end)
+	return qt.lookupImpl(hpackStaticIndex, name, value, start, end)
 }
 
 // LookupBlocked looks in the portion of the table that we're blocked from looking at
@@ -364,7 +535,8 @@ func (qt *QpackEncoderTable) LookupBlocked(name string, value string, maxBase in
 	if end > qt.referenceable {
 		end = qt.referenceable
 	}
-	for _, entry := range qt.dynamic[:end] {
+	for i := 0; i < end; i++ {
+		entry := qt.dynamic.get(i)
 		if entry.Name() == name && entry.Value() == value {
 			return true
 		}
@@ -376,7 +548,8 @@ func (qt *QpackEncoderTable) LookupBlocked(name string, value string, maxBase in
 // offset. It is designed for use after LookupReferenceable() fails.
 func (qt *QpackEncoderTable) LookupExtra(name string, value string) (DynamicEntry, DynamicEntry) {
 	var nameMatch DynamicEntry
-	for _, entry := range qt.dynamic[qt.referenceable:] {
+	for i := qt.referenceable; i < qt.dynamic.len(); i++ {
+		entry := qt.dynamic.get(i)
 		if entry.Name() == name {
 			if entry.Value() == value {
 				return entry, entry
@@ -403,6 +576,20 @@ func (qt *QpackEncoderTable) SetCapacity(c TableCapacity) {
 	}
 }
 
+// resize changes the capacity of the table after entries have been inserted.
+// This evicts entries as needed, but fails without changing anything if an
+// entry that needs to be evicted can't be.
+func (qt *QpackEncoderTable) resize(c TableCapacity, evict evictionCheck) bool {
+	ok := qt.evictTo(c, &qpackEncoderEvictWrapper{evict, qt})
+	if ok {
+		qt.capacity = c
+	}
+	// Recalculate the referenceable entries; the eviction check updates these
+	// even if eviction fails.
+	qt.SetReferenceableLimit(qt.referenceableLimit)
+	return ok
+}
+
 // SetReferenceableLimit limits the space in the table that can be used.
 // This value is set to the minimum of the provided value and the capacity.
 func (qt *QpackEncoderTable) SetReferenceableLimit(limit TableCapacity) {
@@ -415,13 +602,13 @@ func (qt *QpackEncoderTable) SetReferenceableLimit(limit TableCapacity) {
 	qt.referenceable = 0
 
 	remainingSpace := qt.referenceableLimit
-	for i := range qt.dynamic {
-		sz := qt.dynamic[i].Size()
-		if sz < remainingSpace {
-			qt.referenceable++
-			qt.referenceableSize += sz
-		} else {
+	for i := 0; i < qt.dynamic.len(); i++ {
+		sz := qt.dynamic.get(i).Size()
+		if sz > remainingSpace {
 			break
 		}
+		remainingSpace -= sz
+		qt.referenceable++
+		qt.referenceableSize += sz
 	}
 }
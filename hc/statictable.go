@@ -22,6 +22,49 @@ func (hse staticTableEntry) String() string {
 	return hse.name + ": " + hse.value
 }
 
+// fieldKey identifies a header field by name and value.
+type fieldKey struct {
+	name  string
+	value string
+}
+
+// staticIndex maps names, and names with values, to the static table entry
+// with the smallest index.
+type staticIndex struct {
+	names  map[string]Entry
+	fields map[fieldKey]Entry
+}
+
+func newStaticIndex(table []staticTableEntry) *staticIndex {
+	index := &staticIndex{
+		names:  make(map[string]Entry),
+		fields: make(map[fieldKey]Entry),
+	}
+	for _, entry := range table {
+		if _, ok := index.names[entry.name]; !ok {
+			index.names[entry.name] = entry
+		}
+		key := fieldKey{entry.name, entry.value}
+		if _, ok := index.fields[key]; !ok {
+			index.fields[key] = entry
+		}
+	}
+	return index
+}
+
+// lookup finds a static table entry that matches the name and value, or
+// failing that, the name.  This doesn't depend on any table state, so it is
+// safe to use from any goroutine.
+func (index *staticIndex) lookup(name string, value string) (Entry, Entry) {
+	if entry, ok := index.fields[fieldKey{name, value}]; ok {
+		return entry, entry
+	}
+	return nil, index.names[name]
+}
+
+var hpackStaticIndex = newStaticIndex(hpackStaticTable)
+var qpackStaticIndex = newStaticIndex(qpackStaticTable)
+
 // staticTable contains the static HPACK table
 var hpackStaticTable = []staticTableEntry{
 	{1, ":authority", ""},
@@ -1,5 +1,7 @@
 package hc
 
+import "sort"
+
 const entryOverhead = TableCapacity(32)
 
 // Entry is a key-value pair for the HPACK table.
@@ -87,9 +89,101 @@ type Table interface {
 	Lookup(name string, value string) (Entry, Entry)
 }
 
+// dynamicEntries is a ring buffer of dynamic table entries.  Entries are
+// indexed from the newest, so the most recent insertion is at index 0.  This
+// makes inserting and evicting entries cheap.
+type dynamicEntries struct {
+	entries []DynamicEntry
+	// head is the position of the newest entry in entries.
+	head int
+	// count is the number of entries.
+	count int
+
+	// names and fields index entries by name and by name and value.  Each
+	// list is ordered from oldest to newest.
+	names  map[string][]DynamicEntry
+	fields map[fieldKey][]DynamicEntry
+}
+
+func (d *dynamicEntries) len() int {
+	return d.count
+}
+
+// get returns the entry at index i.
+func (d *dynamicEntries) get(i int) DynamicEntry {
+	return d.entries[(d.head+i)%len(d.entries)]
+}
+
+// grow makes more space, moving the newest entry to the start.
+func (d *dynamicEntries) grow() {
+	size := len(d.entries) * 2
+	if size == 0 {
+		size = 8
+	}
+	tmp := make([]DynamicEntry, size)
+	for i := 0; i < d.count; i++ {
+		tmp[i] = d.get(i)
+	}
+	d.entries = tmp
+	d.head = 0
+}
+
+// push adds a new entry, which becomes index 0.
+func (d *dynamicEntries) push(e DynamicEntry) {
+	if d.count == len(d.entries) {
+		d.grow()
+	}
+	d.head = (d.head + len(d.entries) - 1) % len(d.entries)
+	d.entries[d.head] = e
+	d.count++
+
+	if d.names == nil {
+		d.names = make(map[string][]DynamicEntry)
+		d.fields = make(map[fieldKey][]DynamicEntry)
+	}
+	d.names[e.Name()] = append(d.names[e.Name()], e)
+	key := fieldKey{e.Name(), e.Value()}
+	d.fields[key] = append(d.fields[key], e)
+}
+
+// truncate removes the oldest entries so that only `l` remain.
+func (d *dynamicEntries) truncate(l int) {
+	for i := d.count - 1; i >= l; i-- {
+		pos := (d.head + i) % len(d.entries)
+		e := d.entries[pos]
+		d.entries[pos] = nil
+
+		// The oldest entry is always first in each list.
+		if names := d.names[e.Name()]; len(names) > 1 {
+			d.names[e.Name()] = names[1:]
+		} else {
+			delete(d.names, e.Name())
+		}
+		key := fieldKey{e.Name(), e.Value()}
+		if fields := d.fields[key]; len(fields) > 1 {
+			d.fields[key] = fields[1:]
+		} else {
+			delete(d.fields, key)
+		}
+	}
+	d.count = l
+}
+
+// newestBetween returns the newest entry from `list` that has a base greater
+// than `lo` and no more than `hi`.  `list` is ordered from oldest to newest.
+func newestBetween(list []DynamicEntry, lo int, hi int) DynamicEntry {
+	i := sort.Search(len(list), func(j int) bool {
+		return list[j].Base() > hi
+	})
+	if i == 0 || list[i-1].Base() <= lo {
+		return nil
+	}
+	return list[i-1]
+}
+
 // Table holds dynamic entries and accounting for space.
 type tableCommon struct {
-	dynamic []DynamicEntry
+	dynamic dynamicEntries
 	// The total capacity (in HPACK bytes) of the table. This is set by
 	// configuration.
 	capacity TableCapacity
@@ -99,6 +193,27 @@ type tableCommon struct {
 	base int
 	// Retrieve a static table entry.
 	getStatic func(int) Entry
+	// namePreference decides between static and dynamic name matches.
+	namePreference NameMatchPreference
+}
+
+// NameMatchPreference determines which entry Lookup returns as a name match
+// when there are entries with the same name in both static and dynamic tables.
+type NameMatchPreference byte
+
+const (
+	// PreferStaticNameMatch picks the static table entry with the smallest
+	// index.  Static entries can be referenced without any risk of blocking
+	// or eviction and often have shorter encodings.  This is the default.
+	PreferStaticNameMatch = NameMatchPreference(iota)
+	// PreferDynamicNameMatch picks the most recently inserted dynamic table
+	// entry.  This keeps references to fresh entries.
+	PreferDynamicNameMatch
+)
+
+// SetNameMatchPreference sets the preference for name matches.
+func (table *tableCommon) SetNameMatchPreference(pref NameMatchPreference) {
+	table.namePreference = pref
 }
 
 // Base returns the current base for the table, which is the number of inserts.
@@ -106,6 +221,11 @@ func (table *tableCommon) Base() int {
 	return table.base
 }
 
+// restoreBase sets the number of inserts for an empty table.
+func (table *tableCommon) restoreBase(base int) {
+	table.base = base
+}
+
 // GetDynamic retrieves a dynamic table entry using zero-based indexing from the base.
 func (table *tableCommon) GetDynamic(i int, base int) DynamicEntry {
 	delta := table.Base() - base
@@ -113,24 +233,24 @@ func (table *tableCommon) GetDynamic(i int, base int) DynamicEntry {
 		return nil
 	}
 	dynIndex := i + delta
-	if dynIndex >= len(table.dynamic) || dynIndex < 0 {
+	if dynIndex >= table.dynamic.len() || dynIndex < 0 {
 		return nil
 	}
-	return table.dynamic[dynIndex]
+	return table.dynamic.get(dynIndex)
 }
 
 // Evict entries until the used capacity is less than the reduced capacity.
 func (table *tableCommon) evictTo(reduced TableCapacity, evict evictionCheck) bool {
-	l := len(table.dynamic)
+	l := table.dynamic.len()
 	used := table.used
 	for l > 0 && used > reduced {
 		l--
-		if evict != nil && !evict.CanEvict(table.dynamic[l]) {
+		if evict != nil && !evict.CanEvict(table.dynamic.get(l)) {
 			return false
 		}
-		used -= table.dynamic[l].Size()
+		used -= table.dynamic.get(l).Size()
 	}
-	table.dynamic = table.dynamic[0:l]
+	table.dynamic.truncate(l)
 	table.used = used
 	return true
 }
@@ -145,7 +265,7 @@ func (table *tableCommon) SetCapacity(capacity TableCapacity) {
 func (table *tableCommon) insert(entry DynamicEntry, evict evictionCheck) bool {
 	if entry.Size() > table.capacity {
 		if table.evictTo(0, evict) {
-			table.dynamic = table.dynamic[0:0]
+			table.dynamic.truncate(0)
 			table.used = 0
 		}
 		return false
@@ -158,13 +278,7 @@ func (table *tableCommon) insert(entry DynamicEntry, evict evictionCheck) bool {
 	table.base++
 	entry.setBase(table.base)
 
-	// TODO This is grossly inefficient. Indexing from the other end might be less
-	// bad, especially if the underlying array is made a little bigger than needed
-	// when resizing.
-	tmp := make([]DynamicEntry, len(table.dynamic)+1)
-	copy(tmp[1:], table.dynamic)
-	tmp[0] = entry
-	table.dynamic = tmp
+	table.dynamic.push(entry)
 	table.used += entry.Size()
 	return true
 }
@@ -179,27 +293,29 @@ func (table *tableCommon) Used() TableCapacity {
 	return table.used
 }
 
-func (table *tableCommon) lookupImpl(staticTable []staticTableEntry, name string, value string, dynamicMin int, dynamicMax int) (Entry, Entry) {
-	var nameMatch Entry
-	for _, entry := range staticTable {
-		if entry.Name() == name {
-			if entry.Value() == value {
-				return entry, entry
-			}
-			if nameMatch == nil {
-				nameMatch = entry
-			}
-		}
+// lookupImpl looks for a match in the static table, then in the dynamic table
+// between the indices `dynamicMin` (inclusive) and `dynamicMax` (exclusive).
+// The newest dynamic table entries are preferred.
+func (table *tableCommon) lookupImpl(static *staticIndex, name string, value string, dynamicMin int, dynamicMax int) (Entry, Entry) {
+	key := fieldKey{name, value}
+	if entry, ok := static.fields[key]; ok {
+		return entry, entry
 	}
-	for _, entry := range table.dynamic[dynamicMin:dynamicMax] {
-		if entry.Name() == name {
-			if entry.Value() == value {
-				return entry, entry
-			}
-			if nameMatch == nil {
-				nameMatch = entry
-			}
-		}
+	staticNameMatch := static.names[name]
+
+	// Convert the range of indices into a range of bases.
+	lo := table.base - dynamicMax
+	hi := table.base - dynamicMin
+	if entry := newestBetween(table.dynamic.fields[key], lo, hi); entry != nil {
+		return entry, entry
+	}
+	var dynamicNameMatch Entry
+	if entry := newestBetween(table.dynamic.names[name], lo, hi); entry != nil {
+		dynamicNameMatch = entry
+	}
+	if staticNameMatch == nil ||
+		(dynamicNameMatch != nil && table.namePreference == PreferDynamicNameMatch) {
+		return nil, dynamicNameMatch
 	}
-	return nil, nameMatch
+	return nil, staticNameMatch
 }
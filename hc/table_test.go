@@ -1,6 +1,9 @@
 package hc_test
 
 import (
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/martinthomson/minhq/hc"
@@ -75,6 +78,35 @@ func TestBase(t *testing.T) {
 	assert.Equal(t, dynamicBase, e2.Index(2))
 }
 
+func TestGetDynamicAtBase(t *testing.T) {
+	var table hc.HpackTable
+	table.SetCapacity(300)
+	e1 := table.Insert("name1", "value1", nil)
+	e2 := table.Insert("name2", "value2", nil)
+	e3 := table.Insert("name3", "value3", nil)
+	assert.Equal(t, 3, table.Base())
+
+	// Index 0 is the entry at the base.
+	assert.Equal(t, e3, table.GetDynamic(0, table.Base()))
+	assert.Equal(t, e2, table.GetDynamic(1, table.Base()))
+	assert.Equal(t, e1, table.GetDynamic(2, table.Base()))
+	assert.Nil(t, table.GetDynamic(3, table.Base()))
+
+	assert.Equal(t, e2, table.GetDynamic(0, table.Base()-1))
+	assert.Equal(t, e1, table.GetDynamic(1, table.Base()-1))
+	assert.Nil(t, table.GetDynamic(2, table.Base()-1))
+
+	// Negative indices are after the base, which is how post-base indices
+	// work: -1 is the first entry after the base.
+	assert.Equal(t, e3, table.GetDynamic(-1, table.Base()-1))
+	assert.Equal(t, e2, table.GetDynamic(-1, table.Base()-2))
+	assert.Equal(t, e3, table.GetDynamic(-2, table.Base()-2))
+	assert.Nil(t, table.GetDynamic(-1, table.Base()))
+
+	// A base beyond the table can't be used.
+	assert.Nil(t, table.GetDynamic(0, table.Base()+1))
+}
+
 func TestInsertEvict(t *testing.T) {
 	var table hc.HpackTable
 	table.SetCapacity(86) // Enough room for two values.
@@ -99,3 +131,123 @@ func TestLookupStatic(t *testing.T) {
 	assert.Nil(t, m)
 	assert.Equal(t, 2, nm.Base())
 }
+
+func TestNameMatchPreference(t *testing.T) {
+	var table hc.HpackTable
+	table.SetCapacity(300)
+	table.Insert(":method", "PUT", nil)
+	newest := table.Insert(":method", "DELETE", nil)
+
+	// By default, the static entry is preferred.
+	m, nm := table.Lookup(":method", "PATCH")
+	assert.Nil(t, m)
+	assert.Equal(t, 2, nm.Base())
+	_, dynamic := nm.(hc.DynamicEntry)
+	assert.True(t, !dynamic)
+
+	table.SetNameMatchPreference(hc.PreferDynamicNameMatch)
+	m, nm = table.Lookup(":method", "PATCH")
+	assert.Nil(t, m)
+	assert.Equal(t, newest, nm)
+
+	// A full match is always used, wherever it is.
+	m, _ = table.Lookup(":method", "GET")
+	assert.Equal(t, 2, m.Base())
+	m, _ = table.Lookup(":method", "PUT")
+	assert.Equal(t, 1, m.Base())
+
+	// Static matches are used if there are no dynamic matches.
+	m, nm = table.Lookup(":path", "/other")
+	assert.Nil(t, m)
+	assert.Equal(t, 4, nm.Base())
+}
+
+// TestDynamicTableModel performs random inserts and capacity changes and
+// compares the table against a simple model.
+func TestDynamicTableModel(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var table hc.HpackTable
+	capacity := hc.TableCapacity(512)
+	table.SetCapacity(capacity)
+
+	// The model is ordered newest first, just like dynamic table indices.
+	var model []hc.HeaderField
+	size := func(h hc.HeaderField) hc.TableCapacity {
+		return hc.TableCapacity(32 + len(h.Name) + len(h.Value))
+	}
+	evict := func(limit hc.TableCapacity) {
+		var used hc.TableCapacity
+		for i, h := range model {
+			used += size(h)
+			if used > limit {
+				model = model[:i]
+				return
+			}
+		}
+	}
+
+	for op := 0; op < 10000; op++ {
+		if rng.Intn(50) == 0 {
+			capacity = hc.TableCapacity(rng.Intn(1024))
+			table.SetCapacity(capacity)
+			evict(capacity)
+		} else {
+			h := hc.HeaderField{
+				Name:  "n" + strconv.Itoa(table.Base()+1),
+				Value: strings.Repeat("v", rng.Intn(100)),
+			}
+			table.Insert(h.Name, h.Value, nil)
+			if size(h) > capacity {
+				model = nil
+			} else {
+				evict(capacity - size(h))
+				model = append([]hc.HeaderField{h}, model...)
+			}
+		}
+
+		var used hc.TableCapacity
+		for i, h := range model {
+			e := table.GetDynamic(i, table.Base())
+			assert.NotNil(t, e)
+			assert.Equal(t, h.Name, e.Name())
+			assert.Equal(t, h.Value, e.Value())
+			assert.Equal(t, table.Base()-i, e.Base())
+			used += size(h)
+		}
+		assert.Nil(t, table.GetDynamic(len(model), table.Base()))
+		assert.Equal(t, used, table.Used())
+
+		// Lookup finds the oldest entry, but not the last one evicted.
+		if len(model) > 0 {
+			oldest := model[len(model)-1]
+			m, nm := table.Lookup(oldest.Name, oldest.Value)
+			assert.NotNil(t, m)
+			assert.Equal(t, table.Base()-len(model)+1, m.Base())
+			assert.Equal(t, m, nm)
+		}
+		m, nm := table.Lookup("n"+strconv.Itoa(table.Base()-len(model)), "")
+		assert.Nil(t, m)
+		assert.Nil(t, nm)
+	}
+}
+
+func BenchmarkDynamicTableInsert(b *testing.B) {
+	var table hc.HpackTable
+	table.SetCapacity(4096)
+	value := strings.Repeat("v", 20)
+	for i := 0; i < b.N; i++ {
+		table.Insert("name", value, nil)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	var table hc.HpackTable
+	table.SetCapacity(4096)
+	for i := 0; i < 60; i++ {
+		table.Insert("x-name-"+strconv.Itoa(i), "value", nil)
+	}
+	for i := 0; i < b.N; i++ {
+		table.Lookup("x-name-0", "value")
+		table.Lookup("x-missing", "value")
+	}
+}
@@ -2,9 +2,15 @@ package io
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"io"
 )
 
+// ErrDanglingBits is returned when a BitWriter is closed while part of an
+// octet is still waiting to be written.  Use Flush to pad that octet first.
+var ErrDanglingBits = errors.New("closing a writer with a partially written octet")
+
 // BitWriter is used to write individual bits.
 type BitWriter interface {
 	io.Writer
@@ -12,6 +18,8 @@ type BitWriter interface {
 	WriteBit(count byte) error
 	WriteBits(value uint64, count byte) error
 	Pad(pad byte) error
+	Flush(pad byte) error
+	Close() error
 	Written() int64
 }
 type bitWriter struct {
@@ -41,8 +49,12 @@ func (bw *bitWriter) Written() int64 {
 func (bw *bitWriter) writeByteInternal(c byte) error {
 	byteWriter, ok := bw.writer.(io.ByteWriter)
 	if ok {
+		err := byteWriter.WriteByte(c)
+		if err != nil {
+			return err
+		}
 		bw.written++
-		return byteWriter.WriteByte(c)
+		return nil
 	}
 	n, err := bw.writer.Write([]byte{c})
 	if err != nil {
@@ -116,16 +128,63 @@ func (bw *bitWriter) WriteByte(c byte) error {
 
 // Write so that we can claim to implement the io.Writer interface.
 func (bw *bitWriter) Write(p []byte) (int, error) {
+	err := bw.writeSaved()
+	if err != nil {
+		return 0, err
+	}
 	if bw.savedBits == 0 {
 		n, err := bw.writer.Write(p)
 		bw.written += int64(n)
 		return n, err
 	}
-	for i, b := range p {
-		err := bw.WriteByte(b)
-		if err != nil {
-			return i, err
+	return bw.writeUnaligned(p)
+}
+
+// unalignedChunkSize is the size of the buffer that writeUnaligned uses.
+const unalignedChunkSize = 512
+
+// writeUnaligned writes p when there are saved bits.  Each input octet spans
+// two output octets, so this shifts the input through the saved bits,
+// converting eight octets at a time where possible.
+func (bw *bitWriter) writeUnaligned(p []byte) (int, error) {
+	shift := bw.savedBits
+	mask := (uint64(1) << shift) - 1
+	saved := bw.saved & mask
+
+	var buf [unalignedChunkSize]byte
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > len(buf) {
+			chunk = chunk[:len(buf)]
+		}
+		i := 0
+		for ; i+8 <= len(chunk); i += 8 {
+			v := binary.BigEndian.Uint64(chunk[i:])
+			binary.BigEndian.PutUint64(buf[i:], (saved<<(64-shift))|(v>>shift))
+			saved = v & mask
 		}
+		for ; i < len(chunk); i++ {
+			v := uint64(chunk[i])
+			buf[i] = byte((saved << (8 - shift)) | (v >> shift))
+			saved = v & mask
+		}
+
+		n, err := bw.writer.Write(buf[:len(chunk)])
+		bw.written += int64(n)
+		if n < len(chunk) {
+			// Each octet that was written carries the high bits of an input octet,
+			// so save the low bits of the last of those.
+			if n > 0 {
+				bw.saved = uint64(p[written+n-1]) & mask
+			}
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return written + n, err
+		}
+		written += n
+		bw.saved = saved
 	}
 	return len(p), nil
 }
@@ -133,12 +192,18 @@ func (bw *bitWriter) Write(p []byte) (int, error) {
 // Pad pads out any partially filled octet with the high bits of pad.
 // Pad also serves as a flush, in case there are saved bits that couldn't be written.
 func (bw *bitWriter) Pad(pad byte) error {
+	return bw.Flush(pad)
+}
+
+// Flush writes any saved bits, padding out any partially filled octet with the
+// high bits of pad.  Flushing when there is nothing saved does nothing.
+func (bw *bitWriter) Flush(pad byte) error {
+	err := bw.writeSaved()
+	if err != nil {
+		return err
+	}
 	if bw.savedBits > 0 {
-		err := bw.writeSaved()
-		if err != nil {
-			return err
-		}
-		err = bw.WriteBits(uint64(pad>>bw.savedBits), 8-bw.savedBits)
+		err = bw.writeByteInternal(byte(bw.saved<<(8-bw.savedBits)) | (pad >> bw.savedBits))
 		if err != nil {
 			return err
 		}
@@ -148,6 +213,25 @@ func (bw *bitWriter) Pad(pad byte) error {
 	return nil
 }
 
+// Close writes any whole octets that are saved, then closes the underlying
+// writer if it is an io.Closer.  This returns ErrDanglingBits if there is a
+// partially filled octet, because Close can't know what to pad it with.  The
+// underlying writer is closed either way.
+func (bw *bitWriter) Close() error {
+	err := bw.writeSaved()
+	if err == nil && bw.savedBits > 0 {
+		err = ErrDanglingBits
+	}
+	closer, ok := bw.writer.(io.Closer)
+	if ok {
+		closeErr := closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
 // BitReader reads individual bits
 type BitReader interface {
 	io.Reader
@@ -160,6 +244,9 @@ type bitReader struct {
 	reader    io.Reader
 	saved     uint64
 	savedBits byte
+	// err is an error that the underlying reader returned along with data.
+	// It is reported by the next read.
+	err error
 }
 
 // NewBitReader makes a new BitWriter.  If the reader is already a BitReader, return that instead.
@@ -168,23 +255,30 @@ func NewBitReader(reader io.Reader) BitReader {
 	if ok {
 		return br
 	}
-	return &bitReader{reader, 0, 0}
+	return &bitReader{reader: reader}
 }
 
 func (br *bitReader) readByteInternal() (byte, error) {
+	if br.err != nil {
+		err := br.err
+		br.err = nil
+		return 0, err
+	}
 	byteReader, ok := br.reader.(io.ByteReader)
 	if ok {
 		return byteReader.ReadByte()
 	}
 	buf := [1]byte{}
 	n, err := br.reader.Read(buf[:])
+	if n == 1 {
+		// Keep the octet, and save any error for the next read.
+		br.err = err
+		return buf[0], nil
+	}
 	if err != nil {
 		return 0, err
 	}
-	if n != 1 {
-		return 0, io.ErrNoProgress
-	}
-	return buf[0], nil
+	return 0, io.ErrNoProgress
 }
 
 // Read the next octet and update the saved state.
@@ -213,7 +307,9 @@ func (br *bitReader) ReadBit() (byte, error) {
 	return byte(br.saved>>br.savedBits) & 1, nil
 }
 
-// ReadBits reads up to 64 bits.
+// ReadBits reads up to 64 bits.  If this fails, any octets that were read
+// from the underlying reader are kept, so calling ReadBits again resumes from
+// the same place.
 func (br *bitReader) ReadBits(count byte) (uint64, error) {
 	if count > 64 {
 		return 0, bytes.ErrTooLarge
@@ -258,7 +354,7 @@ func (br *bitReader) ReadByte() (byte, error) {
 // unaligned reads if it is preceded by reads for a number of bits that aren't a
 // whole multiple of 8.
 func (br *bitReader) Read(p []byte) (int, error) {
-	if br.savedBits == 0 {
+	if br.savedBits == 0 && br.err == nil {
 		return br.reader.Read(p)
 	}
 	for i := range p {
@@ -2,7 +2,9 @@ package io_test
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"testing"
 
 	bitio "github.com/martinthomson/minhq/io"
@@ -78,6 +80,8 @@ func TestBlockingWrite(t *testing.T) {
 	assert.NotNil(t, writer.WriteBits(1, 7))
 	assert.Nil(t, writer.WriteBits(1, 7))
 	assert.Equal(t, []byte{0x81}, buf.Bytes())
+	// The failed write isn't counted.
+	assert.Equal(t, int64(1), writer.Written())
 
 	buf.Truncate(0)
 	writer = bitio.NewBitWriter(&blockingByteWriter{&buf, 2})
@@ -94,6 +98,102 @@ func TestWriteError(t *testing.T) {
 	assert.NotNil(t, writer.WriteBits(2, 1))
 }
 
+func TestFlush(t *testing.T) {
+	var buf bytes.Buffer
+	writer := bitio.NewBitWriter(&buf)
+	assert.Nil(t, writer.WriteBits(5, 3))
+	assert.Nil(t, writer.Flush(0xff))
+	assert.Equal(t, []byte{0xbf}, buf.Bytes())
+	assert.Equal(t, int64(1), writer.Written())
+	assert.Nil(t, writer.Flush(0xff))
+	assert.Equal(t, []byte{0xbf}, buf.Bytes())
+
+	// A whole octet that couldn't be written isn't padded.
+	buf.Truncate(0)
+	writer = bitio.NewBitWriter(&blockingByteWriter{&buf, 2})
+	assert.Nil(t, writer.WriteBits(0xffff, 16))
+	assert.Equal(t, []byte{0xff}, buf.Bytes())
+	assert.Nil(t, writer.Flush(0))
+	assert.Equal(t, []byte{0xff, 0xff}, buf.Bytes())
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed int
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed++
+	return nil
+}
+
+func TestClose(t *testing.T) {
+	var cr closeRecorder
+	writer := bitio.NewBitWriter(&cr)
+	assert.Nil(t, writer.WriteBits(0x1ff, 9))
+	assert.Equal(t, bitio.ErrDanglingBits, writer.Close())
+	assert.Equal(t, []byte{0xff}, cr.Bytes())
+	assert.Equal(t, 1, cr.closed)
+
+	cr = closeRecorder{}
+	writer = bitio.NewBitWriter(&cr)
+	assert.Nil(t, writer.WriteBits(1, 1))
+	assert.Nil(t, writer.Flush(0))
+	assert.Nil(t, writer.Close())
+	assert.Equal(t, []byte{0x80}, cr.Bytes())
+	assert.Equal(t, 1, cr.closed)
+
+	// Close works without an io.Closer.
+	assert.Nil(t, bitio.NewBitWriter(&bytes.Buffer{}).Close())
+}
+
+func TestUnalignedWrite(t *testing.T) {
+	p := make([]byte, 1000)
+	for i := range p {
+		p[i] = byte(i * 7)
+	}
+
+	for shift := byte(1); shift < 8; shift++ {
+		var buf bytes.Buffer
+		writer := bitio.NewBitWriter(&buf)
+		assert.Nil(t, writer.WriteBits(1, shift))
+		n, err := writer.Write(p)
+		assert.Nil(t, err)
+		assert.Equal(t, len(p), n)
+		assert.Nil(t, writer.Pad(0))
+
+		reader := bitio.NewBitReader(&buf)
+		v, err := reader.ReadBits(shift)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), v)
+		r := make([]byte, len(p))
+		_, err = io.ReadFull(reader, r)
+		assert.Nil(t, err)
+		assert.Equal(t, p, r)
+		v, err = reader.ReadBits(8 - shift)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), v)
+		_, err = reader.ReadBit()
+		assert.Equal(t, io.EOF, err)
+	}
+}
+
+func BenchmarkUnalignedWrite(b *testing.B) {
+	p := make([]byte, 1<<16)
+	for i := range p {
+		p[i] = byte(i)
+	}
+	b.SetBytes(int64(len(p)))
+	for i := 0; i < b.N; i++ {
+		writer := bitio.NewBitWriter(ioutil.Discard)
+		_ = writer.WriteBit(1)
+		_, err := writer.Write(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestReaderWrap(t *testing.T) {
 	p := []byte{1, 2, 3}
 	buf := bytes.NewBuffer(p)
@@ -136,3 +236,70 @@ func TestReader(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, uint64(0x03>>3), v)
 }
+
+var errFlaky = errors.New("flaky")
+
+// flakyReader returns one octet at a time.  Reads at each offset in `fail`
+// return errFlaky the first time, with the octet if `withData` is set.
+type flakyReader struct {
+	data     []byte
+	offset   int
+	fail     map[int]bool
+	withData bool
+}
+
+func (fr *flakyReader) Read(p []byte) (int, error) {
+	if fr.offset >= len(fr.data) {
+		return 0, io.EOF
+	}
+	var err error
+	if fr.fail[fr.offset] {
+		delete(fr.fail, fr.offset)
+		err = errFlaky
+		if !fr.withData {
+			return 0, err
+		}
+	}
+	p[0] = fr.data[fr.offset]
+	fr.offset++
+	return 1, err
+}
+
+func TestReadBitsRetry(t *testing.T) {
+	for _, withData := range []bool{false, true} {
+		// Fail at the second and fourth octets.
+		fr := &flakyReader{
+			data:     []byte{0xa5, 0x5a, 0xc3, 0x3c},
+			fail:     map[int]bool{1: true, 3: true},
+			withData: withData,
+		}
+		reader := bitio.NewBitReader(fr)
+		v, err := reader.ReadBits(3)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(5), v)
+
+		v, err = reader.ReadBits(16)
+		if err != nil {
+			assert.Equal(t, errFlaky, err)
+			v, err = reader.ReadBits(16)
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0x2ad6), v)
+
+		v, err = reader.ReadBits(13)
+		if err != nil {
+			assert.Equal(t, errFlaky, err)
+			v, err = reader.ReadBits(13)
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0x033c), v)
+
+		// An error that came with the last octet is reported next.
+		_, err = reader.ReadBit()
+		if withData {
+			assert.Equal(t, errFlaky, err)
+			_, err = reader.ReadBit()
+		}
+		assert.Equal(t, io.EOF, err)
+	}
+}
@@ -2,6 +2,7 @@ package io
 
 import (
 	"io"
+	"sync"
 )
 
 type concatMessage struct {
@@ -15,6 +16,12 @@ type concatMessage struct {
 type ConcatenatingReader struct {
 	pending chan *concatMessage
 	current *concatMessage
+
+	// lock protects closed and adding.
+	lock   sync.Mutex
+	closed bool
+	// adding tracks calls to AddReader that are still running.
+	adding sync.WaitGroup
 }
 
 // NewConcatenatingReader allocates the internal channel.
@@ -22,16 +29,36 @@ func NewConcatenatingReader() *ConcatenatingReader {
 	return &ConcatenatingReader{pending: make(chan *concatMessage)}
 }
 
-// AddReader adds a reader, then holds until it is fully drained.
+// AddReader adds a reader, then holds until it is fully drained.  If the
+// reader has been closed, the reader is dropped.
 func (cat *ConcatenatingReader) AddReader(r io.Reader) {
+	cat.lock.Lock()
+	if cat.closed {
+		cat.lock.Unlock()
+		return
+	}
+	cat.adding.Add(1)
+	cat.lock.Unlock()
+	defer cat.adding.Done()
+
 	message := &concatMessage{r, make(chan struct{})}
 	cat.pending <- message
 	<-message.drained
 }
 
-// Close the reader and cause the reader to receive an EOF.
+// Close the reader and cause the reader to receive an EOF.  Any readers that
+// were added before Close was called are read first.
 func (cat *ConcatenatingReader) Close() error {
-	close(cat.pending)
+	defer cat.lock.Unlock()
+	cat.lock.Lock()
+	if cat.closed {
+		return nil
+	}
+	cat.closed = true
+	go func() {
+		cat.adding.Wait()
+		close(cat.pending)
+	}()
 	return nil
 }
 
@@ -0,0 +1,59 @@
+package io_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	bitio "github.com/martinthomson/minhq/io"
+	"github.com/stvp/assert"
+)
+
+func TestConcatenate(t *testing.T) {
+	cat := bitio.NewConcatenatingReader()
+	go func() {
+		cat.AddReader(bytes.NewReader([]byte{1, 2}))
+		cat.AddReader(bytes.NewReader([]byte{3}))
+		cat.Close()
+	}()
+	p, err := ioutil.ReadAll(cat)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, p)
+}
+
+func TestConcatenateAddAfterClose(t *testing.T) {
+	cat := bitio.NewConcatenatingReader()
+	assert.Nil(t, cat.Close())
+	assert.Nil(t, cat.Close())
+	cat.AddReader(bytes.NewReader([]byte{1}))
+	p, err := ioutil.ReadAll(cat)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(p))
+}
+
+// TestConcatenateCloseRace runs AddReader and Close concurrently.  The data is
+// either read in full, or not at all.
+func TestConcatenateCloseRace(t *testing.T) {
+	data := []byte{1, 2, 3}
+	for i := 0; i < 100; i++ {
+		cat := bitio.NewConcatenatingReader()
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			cat.AddReader(bytes.NewReader(data))
+		}()
+		go func() {
+			defer wg.Done()
+			cat.Close()
+		}()
+
+		p, err := ioutil.ReadAll(cat)
+		assert.Nil(t, err)
+		if len(p) > 0 {
+			assert.Equal(t, data, p)
+		}
+		wg.Wait()
+	}
+}
@@ -1,7 +1,6 @@
 package minhq
 
 import (
-	"bytes"
 	"errors"
 	"io"
 	"net/url"
@@ -53,14 +52,20 @@ func (a headerFieldArray) String() string {
 
 // GetHeader performs a case-insensitive lookup for a given name.
 // This returns an empty string if the header field wasn't present.
-// Multiple values are concatenated using commas.
+// Multiple values are concatenated using commas, except for Cookie, which
+// uses "; ".
 func (a headerFieldArray) GetHeader(n string) string {
+	n = strings.ToLower(n)
+	sep := ","
+	if n == "cookie" {
+		sep = "; "
+	}
 	v := ""
 	for _, h := range a {
 		// Incoming messages have all lowercase names.
-		if h.Name == strings.ToLower(n) {
+		if h.Name == n {
 			if len(v) > 0 {
-				v += "," + h.Value
+				v += sep + h.Value
 			} else {
 				v = h.Value
 			}
@@ -69,6 +74,25 @@ func (a headerFieldArray) GetHeader(n string) string {
 	return v
 }
 
+// getContentLength parses the Content-Length header field.  This returns false
+// if there isn't one.  Repeated values are permitted as long as they are the
+// same.
+func (a headerFieldArray) getContentLength() (int64, bool, error) {
+	v := a.GetHeader("content-length")
+	if v == "" {
+		return 0, false, nil
+	}
+	var length int64 = -1
+	for _, s := range strings.Split(v, ",") {
+		l, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || l < 0 || (length >= 0 && l != length) {
+			return 0, false, ErrContentLength
+		}
+		length = l
+	}
+	return length, true, nil
+}
+
 // GetStatus returns the status from the header block, or 0 if it's not there or badly formed.
 func (a headerFieldArray) GetStatus() int {
 	status, err := strconv.Atoi(a.GetHeader(":status"))
@@ -114,6 +138,14 @@ func (a headerFieldArray) getMethodAndTarget() (string, *url.URL, error) {
 type initialHeadersHandler func(headers headerFieldArray) (bool, error)
 type incomingMessageFrameHandler func(FrameType, io.Reader) error
 
+// ErrContentLength indicates that the length of a message body doesn't match
+// its Content-Length header field, or that the header field is invalid.
+var ErrContentLength = errors.New("Message body doesn't match Content-Length")
+
+// ErrBodyTooLarge indicates that a message body was longer than
+// Config.MaxBodySize.
+var ErrBodyTooLarge = errors.New("Message body is too large")
+
 // IncomingMessage is the common parts of inbound messages (requests for
 // servers, responses for clients).
 type IncomingMessage struct {
@@ -123,10 +155,26 @@ type IncomingMessage struct {
 	reader   *bitio.ConcatenatingReader
 	Trailers <-chan []hc.HeaderField
 	trailers chan<- []hc.HeaderField
+
+	// headRequest is set for a response to a HEAD request.  The
+	// Content-Length of these responses doesn't describe the body.
+	headRequest bool
+	// contentLength is the expected length of the body, or -1 if that isn't
+	// known.
+	contentLength int64
+	// bodyRead counts the octets of body that have been read with Read.
+	bodyRead int64
+	// maxBodySize limits the size of the body, if it isn't zero.
+	maxBodySize int64
+	// bodyErr is returned by Read in place of io.EOF.  This is set before the
+	// body ends.
+	bodyErr error
 }
 
 func newIncomingMessage(s *recvStream, decoder *hc.QpackDecoder, headers []hc.HeaderField) IncomingMessage {
-	trailers := make(chan []hc.HeaderField)
+	// The body doesn't end until trailers are delivered, so this has space for
+	// the trailers.  Otherwise, reading the body before the trailers would stall.
+	trailers := make(chan []hc.HeaderField, 1)
 	return IncomingMessage{
 		s:        s,
 		decoder:  decoder,
@@ -134,25 +182,105 @@ func newIncomingMessage(s *recvStream, decoder *hc.QpackDecoder, headers []hc.He
 		reader:   bitio.NewConcatenatingReader(),
 		Trailers: trailers,
 		trailers: trailers,
+
+		contentLength: -1,
 	}
 }
 
-// Read means that this implements io.Reader.
+// Read means that this implements io.Reader.  If the message has a
+// Content-Length, this returns ErrContentLength when the body is longer or
+// shorter than that.  This returns ErrBodyTooLarge if the body is longer than
+// Config.MaxBodySize.
 func (msg *IncomingMessage) Read(p []byte) (int, error) {
-	return msg.reader.Read(p)
+	n, err := msg.reader.Read(p)
+	if err == io.EOF && msg.bodyErr != nil {
+		return n, msg.bodyErr
+	}
+	if msg.contentLength < 0 {
+		return n, err
+	}
+	msg.bodyRead += int64(n)
+	if msg.bodyRead > msg.contentLength {
+		over := msg.bodyRead - msg.contentLength
+		if over > int64(n) {
+			over = int64(n)
+		}
+		return n - int(over), ErrContentLength
+	}
+	if err == io.EOF && msg.bodyRead < msg.contentLength {
+		return n, ErrContentLength
+	}
+	return n, err
+}
+
+// ContentLength returns the length of the body, as declared by the
+// Content-Length header field.  This returns false if there is no
+// Content-Length, or if the message can't have a body, as is the case for a
+// response to a HEAD request or a 304 (Not Modified) response.
+func (msg *IncomingMessage) ContentLength() (int64, bool) {
+	return msg.contentLength, msg.contentLength >= 0
 }
 
-func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
-	frameHandler incomingMessageFrameHandler) error {
+// setContentLength sets the expected length of the body from the header
+// fields.
+func (msg *IncomingMessage) setContentLength(headers headerFieldArray) error {
+	msg.contentLength = -1
+	if msg.headRequest || headers.GetStatus() == 304 {
+		return nil
+	}
+	length, ok, err := headers.getContentLength()
+	if err != nil {
+		return err
+	}
+	if ok {
+		msg.contentLength = length
+	}
+	return nil
+}
+
+// bodyCounter counts the octets that are read from a DATA frame.  If there is
+// a limit, this stops at the first octet past that limit, which isn't
+// delivered.
+type bodyCounter struct {
+	r     io.Reader
+	count *int64
+	limit int64
+}
+
+func (bc *bodyCounter) Read(p []byte) (int, error) {
+	if bc.limit > 0 {
+		allowed := bc.limit - *bc.count + 1
+		if int64(len(p)) > allowed {
+			p = p[:allowed]
+		}
+	}
+	n, err := bc.r.Read(p)
+	*bc.count += int64(n)
+	if bc.limit > 0 && *bc.count > bc.limit {
+		return n - 1, io.EOF
+	}
+	return n, err
+}
+
+// handleMessage reads frames from the stream.  The first header blocks are
+// checked using `validation`; any trailers are checked as trailers.
+func (msg *IncomingMessage) handleMessage(validation hc.PseudoHeaderValidation,
+	headersHandler initialHeadersHandler, frameHandler incomingMessageFrameHandler) error {
 	defer close(msg.trailers)
 	defer msg.reader.Close()
 
 	err := func() error {
 		gotFirstHeaders := false
 		afterTrailers := false
+		// received counts the octets of body.  This is only updated while
+		// AddReader is running, so it is safe to check once that returns.
+		var received int64
 		for {
 			t, r, err := msg.s.ReadFrame()
 			if err == io.EOF {
+				if msg.contentLength >= 0 && received != msg.contentLength {
+					return ErrContentLength
+				}
 				return nil
 			}
 			if err != nil {
@@ -167,14 +295,20 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 				if !gotFirstHeaders {
 					return ErrInvalidFrame
 				}
-				msg.reader.AddReader(r)
+				msg.reader.AddReader(&bodyCounter{r, &received, msg.maxBodySize})
+				if msg.maxBodySize > 0 && received > msg.maxBodySize {
+					msg.bodyErr = ErrBodyTooLarge
+					return ErrBodyTooLarge
+				}
+				if msg.contentLength >= 0 && received > msg.contentLength {
+					return ErrContentLength
+				}
 
 			case frameHeaders:
-				headers, err := msg.decoder.ReadHeaderBlock(r, msg.s.Id())
-				if err != nil {
-					return err
+				if gotFirstHeaders {
+					validation = hc.ValidateTrailer
 				}
-				err = hc.ValidatePseudoHeaders(headers)
+				headers, err := msg.decoder.ReadHeaderBlockValidated(r, msg.s.Id(), validation)
 				if err != nil {
 					return err
 				}
@@ -183,6 +317,10 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 					msg.trailers <- headers
 					afterTrailers = true
 				} else {
+					err = msg.setContentLength(headers)
+					if err != nil {
+						return err
+					}
 					gotFirstHeaders, err = headersHandler(headers)
 					if err != nil {
 						return err
@@ -203,6 +341,17 @@ func (msg *IncomingMessage) handleMessage(headersHandler initialHeadersHandler,
 	return err
 }
 
+// Pause stops reading from the stream that carries the message.  This is
+// useful for holding off on a push until the client is ready for it.
+func (msg *IncomingMessage) Pause() {
+	msg.s.Pause()
+}
+
+// Resume restarts reading after a call to Pause.
+func (msg *IncomingMessage) Resume() {
+	msg.s.Resume()
+}
+
 // GetHeader performs a case-insensitive lookup for a given name.
 // This returns an empty string if the header field wasn't present.
 // Multiple values are concatenated using commas.
@@ -224,15 +373,18 @@ type OutgoingMessage struct {
 
 	// encoder is needed for encoding trailers (ugh)
 	encoder *hc.QpackEncoder
+	// maxFrameSize is the largest DATA frame that Write produces.
+	maxFrameSize int
 }
 
 var _ io.WriteCloser = &OutgoingMessage{}
 
 func newOutgoingMessage(c *connection, s *sendStream, headers []hc.HeaderField) OutgoingMessage {
 	return OutgoingMessage{
-		headers: headers,
-		s:       s,
-		encoder: c.encoder,
+		headers:      headers,
+		s:            s,
+		encoder:      c.encoder,
+		maxFrameSize: c.config.maxDataFrameSize(),
 	}
 }
 
@@ -241,27 +393,43 @@ func (msg *OutgoingMessage) Headers() []hc.HeaderField {
 	return msg.headers[:]
 }
 
-// Write fulfils the io.Writer contract.
+// Write fulfils the io.Writer contract.  Large writes are split into DATA
+// frames no larger than Config.MaxDataFrameSize.
 func (msg *OutgoingMessage) Write(p []byte) (int, error) {
 	// Note that WriteFrame always uses the entire input array, and it reports
-	// how much it wrote, not how much it used.  It always uses the entire
-	// input array.  That's not the io.Writer contract, so adapt.
-	_, err := msg.s.WriteFrame(frameData, p)
-	if err != nil {
-		return 0, err
+	// how much it wrote, not how much it used.  That's not the io.Writer
+	// contract, so adapt.
+	written := 0
+	for {
+		chunk := p
+		if len(chunk) > msg.maxFrameSize {
+			chunk = chunk[:msg.maxFrameSize]
+		}
+		_, err := msg.s.WriteFrame(frameData, chunk)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+		if len(p) == 0 {
+			return written, nil
+		}
 	}
-	return len(p), nil
+}
+
+// headersFrameWriter writes header blocks in HEADERS frames.
+type headersFrameWriter struct {
+	FrameWriter
+}
+
+func (fw headersFrameWriter) WriteHeaderFrame(block []byte) error {
+	_, err := fw.WriteFrame(frameHeaders, block)
+	return err
 }
 
 func (msg *OutgoingMessage) writeHeaderBlock(headers []hc.HeaderField) error {
 	// TODO: ensure that header blocks are properly dropped if the stream is reset.
-	var headerBuf bytes.Buffer
-	err := msg.encoder.WriteHeaderBlock(&headerBuf, msg.s.Id(), headers...)
-	if err != nil {
-		return err
-	}
-	_, err = msg.s.WriteFrame(frameHeaders, headerBuf.Bytes())
-	return err
+	return msg.encoder.WriteHeaderFrame(headersFrameWriter{msg.s}, msg.s.Id(), headers...)
 }
 
 // End closes out the stream, writing any trailers that might be included.
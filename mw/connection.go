@@ -17,6 +17,8 @@ type Packet struct {
 // Connection is an async wrapper around minq.Connection
 type Connection struct {
 	minq *minq.Connection
+	// remoteAddr is the address of the peer, if known.
+	remoteAddr net.Addr
 
 	// Connected produces this connection when the connection is established.
 	Connected    <-chan struct{}
@@ -73,11 +75,21 @@ func NewConnection(mc *minq.Connection) *Connection {
 // connection doesn't accept incoming packets from Connection.IncomingPackets
 // (that is set to nil), because the expectation is that packets will be passed
 // to the server.
-func newServerConnection(mc *minq.Connection, ops *connectionOperations) *Connection {
+func newServerConnection(mc *minq.Connection, ops *connectionOperations, remote *net.UDPAddr) *Connection {
 	if mc.Role() != minq.RoleServer {
 		panic("minq.Server spat out a client")
 	}
-	return newConnection(mc, ops)
+	c := newConnection(mc, ops)
+	if remote != nil {
+		c.remoteAddr = remote
+	}
+	return c
+}
+
+// RemoteAddr returns the address of the peer.  This is only available for
+// connections that were accepted by a Server; it returns nil otherwise.
+func (c *Connection) RemoteAddr() net.Addr {
+	return c.remoteAddr
 }
 
 // Service is intended to be run as a goroutine. This is the only goroutine that
@@ -162,6 +174,11 @@ func (c *Connection) handleReadRequest(req *readRequest) {
 	}
 }
 
+// Closed returns a channel that is closed when the connection closes.
+func (c *Connection) Closed() <-chan struct{} {
+	return c.closed
+}
+
 // GetState returns the current connection of the connection.
 func (c *Connection) GetState() minq.State {
 	state := make(chan minq.State)
@@ -1,6 +1,8 @@
 package mw
 
 import (
+	"net"
+	"sync"
 	"time"
 
 	"github.com/ekr/minq"
@@ -8,7 +10,8 @@ import (
 
 // Server is the server side of the connection.  It accepts multiple connections.
 type Server struct {
-	s *minq.Server
+	s       *minq.Server
+	handler *serverHandler
 
 	// Connections is the connections that are created.
 	Connections <-chan *Connection
@@ -23,12 +26,29 @@ type Server struct {
 type serverHandler struct {
 	connections chan<- *Connection
 	ops         *connectionOperations
+	// remote is the source address of the packet that is being processed.
+	// minq creates connections while processing packets, so this is the
+	// address of any new connection.
+	remote *net.UDPAddr
+
+	refuseLock sync.Mutex
+	refuse     bool
+}
+
+func (sh *serverHandler) refusing() bool {
+	defer sh.refuseLock.Unlock()
+	sh.refuseLock.Lock()
+	return sh.refuse
 }
 
 // NewConnection is part of the minq.ServerHandler interface.
 // Note the use of a goroutine to avoid blocking the main thread.
 func (sh *serverHandler) NewConnection(mc *minq.Connection) {
-	c := newServerConnection(mc, sh.ops)
+	if sh.refusing() {
+		_ = mc.Close()
+		return
+	}
+	c := newServerConnection(mc, sh.ops, sh.remote)
 	go func() {
 		<-c.Connected
 		sh.connections <- c
@@ -46,7 +66,8 @@ func RunServer(ms *minq.Server) *Server {
 		ops:             newConnectionOperations(),
 		shutdown:        make(chan chan<- struct{}),
 	}
-	ms.SetHandler(&serverHandler{connections, s.ops})
+	s.handler = &serverHandler{connections: connections, ops: s.ops}
+	ms.SetHandler(s.handler)
 	go s.service(incoming)
 	return s
 }
@@ -62,6 +83,7 @@ func (s *Server) service(incoming <-chan *Packet) {
 			s.ops.Handle(op)
 
 		case p := <-incoming:
+			s.handler.remote = p.SrcAddr
 			_, _ = s.s.Input(p.SrcAddr, p.Data)
 
 		case <-ticker.C:
@@ -74,6 +96,14 @@ func (s *Server) service(incoming <-chan *Packet) {
 	}
 }
 
+// StopAccepting causes the server to close any new connections immediately.
+// Existing connections are unaffected.
+func (s *Server) StopAccepting() {
+	defer s.handler.refuseLock.Unlock()
+	s.handler.refuseLock.Lock()
+	s.handler.refuse = true
+}
+
 func (s *Server) cleanup() {
 	s.ops.Close()
 }
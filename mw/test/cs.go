@@ -9,8 +9,11 @@ import (
 	"github.com/martinthomson/minhq/mw"
 )
 
-var clientAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 12589}
-var serverAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 12590}
+// ClientAddr is the address that the server sees for the client.
+var ClientAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 12589}
+
+// ServerAddr is the address that the client sees for the server.
+var ServerAddr = &net.UDPAddr{IP: net.ParseIP("::1"), Port: 12590}
 
 // Transport shuffles arrays of bytes from one channel to the other.
 type Transport struct {
@@ -79,11 +82,11 @@ func NewClientServerPair(runServerFunc func(*minq.Server) *mw.Server,
 
 	serverConfig := minq.NewTlsConfig("localhost")
 	cs.Server = runServerFunc(minq.NewServer(&simpleTransportFactory{cs.serverTransport}, &serverConfig, nil))
-	go cs.serverTransport.Service(clientAddr, cs.Server.IncomingPackets)
+	go cs.serverTransport.Service(ClientAddr, cs.Server.IncomingPackets)
 
 	clientConfig := minq.NewTlsConfig("localhost")
 	cs.ClientConnection = mw.NewConnection(minq.NewConnection(cs.clientTransport, minq.RoleClient, &clientConfig, nil))
-	go cs.clientTransport.Service(serverAddr, cs.ClientConnection.IncomingPackets)
+	go cs.clientTransport.Service(ServerAddr, cs.ClientConnection.IncomingPackets)
 
 	if getServerConnectionFunc == nil {
 		getServerConnectionFunc = func(s *mw.Server) *mw.Connection {
@@ -0,0 +1,91 @@
+package minhq
+
+import (
+	"errors"
+)
+
+// ErrMalformedPriority indicates that a PRIORITY frame couldn't be parsed.
+var ErrMalformedPriority = errors.New("Malformed PRIORITY frame")
+
+// PriorityElementType identifies what type of element a PRIORITY frame refers
+// to, either as the prioritized element or as its dependency.
+type PriorityElementType byte
+
+// These are the types of element in the priority tree.
+const (
+	PriorityRequest     = PriorityElementType(0)
+	PriorityPush        = PriorityElementType(1)
+	PriorityPlaceholder = PriorityElementType(2)
+	PriorityRoot        = PriorityElementType(3)
+)
+
+func (pt PriorityElementType) String() string {
+	switch pt {
+	case PriorityRequest:
+		return "request"
+	case PriorityPush:
+		return "push"
+	case PriorityPlaceholder:
+		return "placeholder"
+	case PriorityRoot:
+		return "root"
+	}
+	return "unknown"
+}
+
+// Priority is the content of a PRIORITY frame.
+type Priority struct {
+	// ElementType is the type of the element that is being prioritized.
+	// This can't be PriorityRoot.
+	ElementType PriorityElementType
+	// ElementID is the stream ID, push ID, or placeholder ID of the element.
+	ElementID uint64
+	// DependencyType is the type of the element that this depends on.
+	DependencyType PriorityElementType
+	// DependencyID identifies the element that this depends on.  This is
+	// zero if DependencyType is PriorityRoot.
+	DependencyID uint64
+	// Exclusive is set if this becomes the only dependency of its parent.
+	Exclusive bool
+	// Weight is a value between 1 and 256.
+	Weight uint16
+}
+
+// ReadPriority reads the content of a PRIORITY frame.  This returns
+// ErrMalformedPriority if the reserved bits are set, if the prioritized element
+// is the root, or if the frame is truncated.
+func ReadPriority(r FrameReader) (*Priority, error) {
+	var p Priority
+	v, err := r.ReadBits(8)
+	if err != nil {
+		return nil, ErrMalformedPriority
+	}
+	p.ElementType = PriorityElementType(v >> 6)
+	p.DependencyType = PriorityElementType((v >> 4) & 3)
+	if (v&0xe) != 0 || p.ElementType == PriorityRoot {
+		return nil, ErrMalformedPriority
+	}
+	p.Exclusive = (v & 1) == 1
+
+	p.ElementID, err = r.ReadVarint()
+	if err != nil {
+		return nil, ErrMalformedPriority
+	}
+	if p.DependencyType != PriorityRoot {
+		p.DependencyID, err = r.ReadVarint()
+		if err != nil {
+			return nil, ErrMalformedPriority
+		}
+	}
+	w, err := r.ReadBits(8)
+	if err != nil {
+		return nil, ErrMalformedPriority
+	}
+	p.Weight = uint16(w) + 1
+
+	err = r.CheckForEOF()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,65 @@
+package minhq_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/martinthomson/minhq"
+	"github.com/stvp/assert"
+)
+
+func readPriority(p []byte) (*minhq.Priority, error) {
+	return minhq.ReadPriority(minhq.NewFrameReader(bytes.NewReader(p)))
+}
+
+func TestReadPriority(t *testing.T) {
+	// Request 4 depends on placeholder 2, with a weight of 16.
+	p, err := readPriority([]byte{0x20, 0x04, 0x02, 0x0f})
+	assert.Nil(t, err)
+	assert.Equal(t, &minhq.Priority{
+		ElementType:    minhq.PriorityRequest,
+		ElementID:      4,
+		DependencyType: minhq.PriorityPlaceholder,
+		DependencyID:   2,
+		Weight:         16,
+	}, p)
+
+	// Push 300 depends exclusively on request 8, with a weight of 256.
+	p, err = readPriority([]byte{0x41, 0x41, 0x2c, 0x08, 0xff})
+	assert.Nil(t, err)
+	assert.Equal(t, &minhq.Priority{
+		ElementType:    minhq.PriorityPush,
+		ElementID:      300,
+		DependencyType: minhq.PriorityRequest,
+		DependencyID:   8,
+		Exclusive:      true,
+		Weight:         256,
+	}, p)
+
+	// A dependency on the root has no ID.
+	p, err = readPriority([]byte{0xb0, 0x01, 0x00})
+	assert.Nil(t, err)
+	assert.Equal(t, &minhq.Priority{
+		ElementType:    minhq.PriorityPlaceholder,
+		ElementID:      1,
+		DependencyType: minhq.PriorityRoot,
+		Weight:         1,
+	}, p)
+}
+
+func TestReadPriorityMalformed(t *testing.T) {
+	for _, tc := range [][]byte{
+		{},                       // empty
+		{0x08, 0x04, 0x02, 0x0f}, // reserved bits set
+		{0xc0, 0x04, 0x02, 0x0f}, // the root can't be prioritized
+		{0x00, 0x04, 0x02},       // no weight
+		{0x30, 0x04},             // no weight, with a root dependency
+		{0x00, 0x40},             // truncated element ID
+	} {
+		_, err := readPriority(tc)
+		assert.Equal(t, minhq.ErrMalformedPriority, err)
+	}
+
+	_, err := readPriority([]byte{0x00, 0x04, 0x02, 0x0f, 0x00})
+	assert.Equal(t, minhq.ErrExtraData, err)
+}
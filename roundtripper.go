@@ -0,0 +1,183 @@
+package minhq
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/martinthomson/minhq/hc"
+)
+
+// RoundTripper adapts a ClientConnection so that it can be used as an
+// http.RoundTripper.  Every request is made on the same connection, so this
+// doesn't check that the request is for the server at the other end.
+type RoundTripper struct {
+	C *ClientConnection
+}
+
+var _ http.RoundTripper = &RoundTripper{}
+
+// requestHeaderFields converts the header fields of an http.Request.  Header
+// fields that are specific to HTTP/1.1 connections are dropped.
+func requestHeaderFields(hr *http.Request) []hc.HeaderField {
+	var headers []hc.HeaderField
+	for name, values := range hr.Header {
+		for _, v := range values {
+			h := hc.HeaderField{Name: strings.ToLower(name), Value: v}
+			if h.Name == "host" || hc.ValidateConnectionHeaders([]hc.HeaderField{h}) != nil {
+				continue
+			}
+			headers = append(headers, h)
+		}
+	}
+	if hr.ContentLength > 0 && hr.Header.Get("Content-Length") == "" {
+		headers = append(headers, hc.HeaderField{
+			Name:  "content-length",
+			Value: strconv.FormatInt(hr.ContentLength, 10),
+		})
+	}
+	return headers
+}
+
+// trailerFields converts trailers from an http.Request.
+func trailerFields(trailer http.Header) []hc.HeaderField {
+	var trailers []hc.HeaderField
+	for name, values := range trailer {
+		for _, v := range values {
+			trailers = append(trailers, hc.HeaderField{Name: strings.ToLower(name), Value: v})
+		}
+	}
+	return trailers
+}
+
+// sendBody writes the body of `hr` to `req`, followed by any trailers.  If the
+// body can't be read or written, the request is aborted.
+func (rt *RoundTripper) sendBody(hr *http.Request, req *ClientRequest) {
+	if hr.Body != nil {
+		defer hr.Body.Close()
+		_, err := io.Copy(req, hr.Body)
+		if err != nil {
+			req.abort(rt.C, ErrHttpRequestCancelled)
+			return
+		}
+	}
+	// Trailers can be set up until the body is read, so look now.
+	err := req.End(trailerFields(hr.Trailer))
+	if err != nil {
+		req.abort(rt.C, ErrHttpRequestCancelled)
+	}
+}
+
+// RoundTrip makes a request.  The request body is sent concurrently.  The body
+// of the response has to be read to the end before Response.Trailer is
+// populated.  Closing the body early aborts the request.
+func (rt *RoundTripper) RoundTrip(hr *http.Request) (*http.Response, error) {
+	u := *hr.URL
+	if hr.Host != "" {
+		u.Host = hr.Host
+	}
+	method := hr.Method
+	if method == "" {
+		method = "GET"
+	}
+	ctx := hr.Context()
+	req, err := rt.C.FetchContext(ctx, method, u.String(), requestHeaderFields(hr)...)
+	if err != nil {
+		if hr.Body != nil {
+			hr.Body.Close()
+		}
+		return nil, err
+	}
+	// net/http has no use for pushes or informational responses.
+	go func() {
+		for pp := range req.Pushes {
+			_ = pp.Cancel()
+		}
+	}()
+	if req.InformationalResponses != nil {
+		go func() {
+			for range req.InformationalResponses {
+			}
+		}()
+	}
+	go rt.sendBody(hr, req)
+
+	body := &responseBody{rt: rt, req: req, done: make(chan struct{})}
+	resp := req.Response()
+	if resp == nil {
+		body.finish()
+		return nil, req.Err()
+	}
+	body.resp = resp
+	return body.response(hr), nil
+}
+
+// responseBody is the body of an http.Response.  This fills in the Trailer
+// of the response when the body has been read.
+type responseBody struct {
+	rt      *RoundTripper
+	req     *ClientRequest
+	resp    *ClientResponse
+	trailer http.Header
+
+	// done is closed when the body is read or closed.
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (body *responseBody) finish() {
+	body.doneOnce.Do(func() { close(body.done) })
+}
+
+// response builds the http.Response.
+func (body *responseBody) response(hr *http.Request) *http.Response {
+	resp := body.resp
+	hresp := &http.Response{
+		Status:        strconv.Itoa(resp.Status) + " " + http.StatusText(resp.Status),
+		StatusCode:    resp.Status,
+		Proto:         "HTTP/3",
+		ProtoMajor:    3,
+		Header:        make(http.Header),
+		Trailer:       make(http.Header),
+		Body:          body,
+		ContentLength: -1,
+		Request:       hr,
+	}
+	for _, h := range resp.Headers {
+		if h.Name[0] == ':' {
+			continue
+		}
+		hresp.Header.Add(h.Name, h.Value)
+	}
+	if length, ok := resp.ContentLength(); ok {
+		hresp.ContentLength = length
+	}
+	body.trailer = hresp.Trailer
+	return hresp
+}
+
+// Read reads the response body.  At the end of the body, this waits for
+// trailers.
+func (body *responseBody) Read(p []byte) (int, error) {
+	n, err := body.resp.Read(p)
+	if err == io.EOF {
+		for _, h := range <-body.resp.Trailers {
+			body.trailer.Add(h.Name, h.Value)
+		}
+		body.finish()
+	}
+	return n, err
+}
+
+// Close aborts the request if the body hasn't been read completely.
+func (body *responseBody) Close() error {
+	select {
+	case <-body.done:
+	default:
+		body.req.abort(body.rt.C, ErrHttpRequestCancelled)
+		body.finish()
+	}
+	return nil
+}
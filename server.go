@@ -1,11 +1,13 @@
 package minhq
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"net"
+	"sync"
 
 	"github.com/ekr/minq"
 	"github.com/martinthomson/minhq/mw"
@@ -24,11 +26,16 @@ type Server struct {
 	// `go func() { for <-server.Connections != nil {} }()` unless they
 	// need direct access to the connection.
 	Connections <-chan *ServerConnection
+
+	// active holds the connections that are open.
+	activeLock sync.Mutex
+	active     map[*ServerConnection]struct{}
 }
 
 func (s *Server) serviceConnections(requests chan<- *ServerRequest, connections chan<- *ServerConnection) {
 	for c := range s.Server.Connections {
 		wrapped := newServerConnection(c, s.config)
+		s.addActive(wrapped)
 		go func() {
 			wrapped.Connect(requests)
 			if connections != nil {
@@ -38,6 +45,50 @@ func (s *Server) serviceConnections(requests chan<- *ServerRequest, connections
 	}
 }
 
+func (s *Server) addActive(c *ServerConnection) {
+	s.activeLock.Lock()
+	s.active[c] = struct{}{}
+	s.activeLock.Unlock()
+
+	go func() {
+		<-c.Closed()
+		defer s.activeLock.Unlock()
+		s.activeLock.Lock()
+		delete(s.active, c)
+	}()
+}
+
+// Shutdown stops the server from accepting new connections, then shuts down
+// each open connection.  Each connection is sent a GOAWAY and is closed once
+// requests on that connection are complete.  If the context is done before
+// all requests are complete, the connections are closed anyway and the error
+// from the context is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Server.StopAccepting()
+
+	s.activeLock.Lock()
+	active := make([]*ServerConnection, 0, len(s.active))
+	for c := range s.active {
+		active = append(active, c)
+	}
+	s.activeLock.Unlock()
+
+	results := make(chan error, len(active))
+	for _, c := range active {
+		go func(c *ServerConnection) {
+			results <- c.Shutdown(ctx)
+		}(c)
+	}
+	var err error
+	for range active {
+		e := <-results
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 // RunServer takes a minq Server and starts the various goroutines that service it.
 // Run Listen() for a basic server.
 func RunServer(ms *minq.Server, config *Config) *Server {
@@ -51,6 +102,7 @@ func RunServer(ms *minq.Server, config *Config) *Server {
 		config:      config,
 		Requests:    requests,
 		Connections: connections,
+		active:      make(map[*ServerConnection]struct{}),
 	}
 
 	go s.serviceConnections(requests, connections)
@@ -2,12 +2,17 @@ package minhq
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"sync"
 
 	"github.com/martinthomson/minhq/mw"
 )
 
+// ErrNoPushID is returned when the client hasn't authorized any more pushes
+// with MAX_PUSH_ID.
+var ErrNoPushID = errors.New("No push IDs available")
+
 // ServerConnection specializes Connection with server-related functions.
 type ServerConnection struct {
 	connection
@@ -15,20 +20,71 @@ type ServerConnection struct {
 	pushIDLock sync.RWMutex
 	nextPushID uint64
 	maxPushID  uint64
+	// pushIDsAdded is closed when MAX_PUSH_ID raises maxPushID.  This is only
+	// created when something is waiting.
+	pushIDsAdded chan struct{}
 
+	// cancelledPushesLock protects both cancelledPushes and pushStreams.
 	cancelledPushesLock sync.RWMutex
 	cancelledPushes     map[uint64]bool
+	// pushStreams holds the streams for push responses that are in progress.
+	pushStreams map[uint64]*sendStream
+
+	// requests tracks requests that haven't been completed.
+	requests requestTracker
+}
+
+// requestTracker counts the requests that are in progress.
+type requestTracker struct {
+	lock  sync.Mutex
+	count int
+	// idle is closed when count reaches zero.  This is only created when
+	// something is waiting.
+	idle chan struct{}
+}
+
+func (rt *requestTracker) add() {
+	defer rt.lock.Unlock()
+	rt.lock.Lock()
+	rt.count++
+}
+
+func (rt *requestTracker) done() {
+	defer rt.lock.Unlock()
+	rt.lock.Lock()
+	rt.count--
+	if rt.count == 0 && rt.idle != nil {
+		close(rt.idle)
+		rt.idle = nil
+	}
+}
+
+// wait returns a channel that is closed when there are no requests.
+func (rt *requestTracker) wait() <-chan struct{} {
+	defer rt.lock.Unlock()
+	rt.lock.Lock()
+	if rt.count == 0 {
+		idle := make(chan struct{})
+		close(idle)
+		return idle
+	}
+	if rt.idle == nil {
+		rt.idle = make(chan struct{})
+	}
+	return rt.idle
 }
 
 // newServerConnection wraps an instance of mw.Connection with server-related capabilities.
 func newServerConnection(mwc *mw.Connection, config *Config) *ServerConnection {
 	return &ServerConnection{
 		connection: connection{
-			config:     config,
-			Connection: *mwc,
-			ready:      make(chan struct{}),
+			config:         config,
+			Connection:     *mwc,
+			ready:          make(chan struct{}),
+			goAwayReceived: make(chan struct{}),
 		},
 		cancelledPushes: make(map[uint64]bool),
+		pushStreams:     make(map[uint64]*sendStream),
 	}
 }
 
@@ -44,12 +100,40 @@ func (c *ServerConnection) Connect(requests chan<- *ServerRequest) error {
 
 func (c *ServerConnection) serviceRequests(requests chan<- *ServerRequest) {
 	for {
-		s := newStream(<-c.RemoteStreams)
+		s := newStream(<-c.RemoteStreams, c.Closed())
+		if !c.accept(s.Id()) {
+			// This arrived after GOAWAY was sent.
+			s.Reset(uint16(ErrHttpRequestCancelled))
+			s.StopSending(uint16(ErrHttpRequestCancelled))
+			continue
+		}
+		c.requests.add()
+		c.idle.add()
 		req := newServerRequest(c, s)
 		go req.handle(requests)
 	}
 }
 
+// Shutdown sends GOAWAY, then waits for outstanding requests to complete
+// before closing the connection.  If the context is done before then, the
+// connection is closed anyway and the error from the context is returned.
+func (c *ServerConnection) Shutdown(ctx context.Context) error {
+	err := c.goAway(ctx)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	select {
+	case <-c.requests.wait():
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.Close()
+	return err
+}
+
+// handleMaxPushID raises the limit on push IDs.  The client counts the pushes
+// it permits, so push IDs up to, but not including, this value can be used.
 func (c *ServerConnection) handleMaxPushID(r FrameReader) error {
 	n, err := r.ReadVarint()
 	if err != nil {
@@ -66,15 +150,36 @@ func (c *ServerConnection) handleMaxPushID(r FrameReader) error {
 	defer c.pushIDLock.Unlock()
 	if n > c.maxPushID {
 		c.maxPushID = n
+		if c.pushIDsAdded != nil {
+			close(c.pushIDsAdded)
+			c.pushIDsAdded = nil
+		}
 	}
 	return nil
 }
 
+// PushIDsAdded returns a channel that is closed the next time that the client
+// permits more pushes with MAX_PUSH_ID.  After Push fails with ErrNoPushID,
+// this signals when trying again might succeed.
+func (c *ServerConnection) PushIDsAdded() <-chan struct{} {
+	defer c.pushIDLock.Unlock()
+	c.pushIDLock.Lock()
+	if c.pushIDsAdded == nil {
+		c.pushIDsAdded = make(chan struct{})
+	}
+	return c.pushIDsAdded
+}
+
+// getNextPushID allocates a push ID.  This fails with ErrNoPushID if the client
+// hasn't sent a MAX_PUSH_ID frame that permits another push.
 func (c *ServerConnection) getNextPushID() (uint64, error) {
-	c.pushIDLock.RLock()
-	defer c.pushIDLock.RUnlock()
+	if c.peerGoingAway() {
+		return 0, ErrGoingAway
+	}
+	c.pushIDLock.Lock()
+	defer c.pushIDLock.Unlock()
 	if c.nextPushID >= c.maxPushID {
-		return 0, errors.New("No push IDs available")
+		return 0, ErrNoPushID
 	}
 
 	id := c.nextPushID
@@ -82,28 +187,61 @@ func (c *ServerConnection) getNextPushID() (uint64, error) {
 	return id, nil
 }
 
+// handleCancelPush marks a push as cancelled.  If the push response has
+// started, the push stream is reset.
 func (c *ServerConnection) handleCancelPush(r FrameReader) error {
 	pushID, err := r.ReadVarint()
-	if err != nil {
-		return err
+	if err == nil {
+		err = r.CheckForEOF()
 	}
-	err = r.CheckForEOF()
 	if err != nil {
+		c.FatalError(malformedFrame(frameCancelPush))
 		return err
 	}
+
 	c.cancelledPushesLock.Lock()
-	defer c.cancelledPushesLock.Unlock()
 	c.cancelledPushes[pushID] = true
+	s := c.pushStreams[pushID]
+	delete(c.pushStreams, pushID)
+	c.cancelledPushesLock.Unlock()
+
+	if s != nil {
+		c.idle.done()
+		return s.Reset(uint16(ErrHttpRequestCancelled))
+	}
 	return nil
 }
 
+// addPushStream records the stream for a push response.  This returns false
+// if the push was cancelled.
+func (c *ServerConnection) addPushStream(pushID uint64, s *sendStream) bool {
+	defer c.cancelledPushesLock.Unlock()
+	c.cancelledPushesLock.Lock()
+	if c.cancelledPushes[pushID] {
+		return false
+	}
+	c.pushStreams[pushID] = s
+	c.idle.add()
+	return true
+}
+
+// removePushStream forgets the stream for a push response that is complete.
+func (c *ServerConnection) removePushStream(pushID uint64) {
+	defer c.cancelledPushesLock.Unlock()
+	c.cancelledPushesLock.Lock()
+	if c.pushStreams[pushID] != nil {
+		delete(c.pushStreams, pushID)
+		c.idle.done()
+	}
+}
+
 func (c *ServerConnection) cancelPush(pushID uint64) error {
 	var buf bytes.Buffer
 	_, err := NewFrameWriter(&buf).WriteVarint(pushID)
 	if err != nil {
 		return err
 	}
-	_, err = c.controlStream.WriteFrame(frameCancelPush, buf.Bytes())
+	_, err = c.writeControlFrame(frameCancelPush, buf.Bytes())
 	if err != nil {
 		return err
 	}
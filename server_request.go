@@ -4,8 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
 	"net/url"
 	"strconv"
+	"sync"
+	"sync/atomic"
 
 	"github.com/martinthomson/minhq/hc"
 )
@@ -13,6 +18,14 @@ import (
 // ErrPushCancelled is used when a push response is created, but the push was already cancelled.
 var ErrPushCancelled = errors.New("push was already cancelled")
 
+// ErrInformationalBody is used when RespondWith is given an informational
+// status code, because informational responses can't have a body.
+var ErrInformationalBody = errors.New("informational responses can't have a body")
+
+// ErrNotForm is used when a request body is parsed as a form, but the
+// content-type doesn't match.
+var ErrNotForm = errors.New("request content-type is not a form")
+
 // ServerRequest handles incoming requests.
 type ServerRequest struct {
 	C      *ServerConnection
@@ -21,10 +34,20 @@ type ServerRequest struct {
 	method string
 	target *url.URL
 	IncomingMessage
+
+	// finished ensures that the connection is only told once that the
+	// request is complete.
+	finished sync.Once
+	// continued ensures that only one 100 (Continue) response is sent.
+	continued   sync.Once
+	continueErr error
+	// responded is set to 1 once a final response is sent.  Access this
+	// atomically.
+	responded int32
 }
 
 func newServerRequest(c *ServerConnection, s *stream) *ServerRequest {
-	return &ServerRequest{
+	req := &ServerRequest{
 		C:               c,
 		s:               s,
 		ID:              0,
@@ -32,6 +55,8 @@ func newServerRequest(c *ServerConnection, s *stream) *ServerRequest {
 		target:          nil,
 		IncomingMessage: newIncomingMessage(&s.recvStream, c.connection.decoder, nil),
 	}
+	req.maxBodySize = c.config.MaxBodySize
+	return req
 }
 
 // Method returns the request method.
@@ -45,17 +70,78 @@ func (req *ServerRequest) Target() *url.URL {
 }
 
 func (req *ServerRequest) handle(requests chan<- *ServerRequest) {
-	err := req.handleMessage(func(headers headerFieldArray) (bool, error) {
+	// Once the request is passed on, whoever handles it owns the request and
+	// finishes it by completing or cancelling the response.
+	delivered := false
+	err := req.handleMessage(hc.ValidateRequest, func(headers headerFieldArray) (bool, error) {
 		req.setHeaders(headers)
 		requests <- req
+		delivered = true
 		return true, nil
 	}, func(t FrameType, r io.Reader) error {
 		return ErrUnsupportedFrame
 	})
-	if err != nil {
-		req.s.abort()
+	// A stream that ends before HEADERS is malformed.
+	if err == nil && delivered {
 		return
 	}
+	if err == ErrBodyTooLarge {
+		req.s.cancel(ErrHttpRequestCancelled)
+	} else {
+		req.s.abort()
+	}
+	if !delivered {
+		req.finish()
+	}
+}
+
+// mediaType parses the content-type header field.
+func (req *ServerRequest) mediaType() (string, map[string]string, error) {
+	ct := req.GetHeader("content-type")
+	if ct == "" {
+		return "", nil, ErrNotForm
+	}
+	return mime.ParseMediaType(ct)
+}
+
+// ParseForm reads the request body and parses it as a form, if the
+// content-type is application/x-www-form-urlencoded.  This consumes the body.
+func (req *ServerRequest) ParseForm() (url.Values, error) {
+	mt, _, err := req.mediaType()
+	if err != nil {
+		return nil, err
+	}
+	if mt != "application/x-www-form-urlencoded" {
+		return nil, ErrNotForm
+	}
+	body, err := ioutil.ReadAll(req)
+	if err != nil {
+		return nil, err
+	}
+	return url.ParseQuery(string(body))
+}
+
+// ParseMultipart reads the request body and parses it as a form, if the
+// content-type is multipart/form-data.  This consumes the body.  Up to
+// `maxMemory` bytes of file parts are held in memory; the remainder are
+// stored in temporary files, see multipart.Reader.ReadForm.
+func (req *ServerRequest) ParseMultipart(maxMemory int64) (*multipart.Form, error) {
+	mt, params, err := req.mediaType()
+	if err != nil {
+		return nil, err
+	}
+	if mt != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ErrNotForm
+	}
+	return multipart.NewReader(req, params["boundary"]).ReadForm(maxMemory)
+}
+
+// finish marks the request as complete.
+func (req *ServerRequest) finish() {
+	req.finished.Do(func() {
+		req.C.requests.done()
+		req.C.idle.done()
+	})
 }
 
 type hasHeaders interface {
@@ -76,6 +162,9 @@ func (req *ServerRequest) sendResponse(statusCode int, headers []hc.HeaderField,
 		return nil, err
 	}
 	<-req.C.ready
+	if push == nil && statusCode/100 != 1 {
+		atomic.StoreInt32(&req.responded, 1)
+	}
 	allHeaders := append([]hc.HeaderField{
 		hc.HeaderField{Name: ":status", Value: strconv.Itoa(statusCode)},
 	}, headers...)
@@ -98,10 +187,52 @@ func (req *ServerRequest) sendResponse(statusCode int, headers []hc.HeaderField,
 
 // Respond creates a response, starting by writing the response header block.
 func (req *ServerRequest) Respond(statusCode int, headers ...hc.HeaderField) (*ServerResponse, error) {
-	return req.sendResponse(statusCode, headers, &req.s.sendStream, nil)
+	resp, err := req.sendResponse(statusCode, headers, &req.s.sendStream, nil)
+	if err != nil {
+		// There's no response to finish the request, so finish it now.
+		req.finish()
+	}
+	return resp, err
+}
+
+// Continue sends a 100 (Continue) response if the request included
+// `Expect: 100-continue`.  A client that sends that waits for this response,
+// or a final response, before sending the request body.  This does nothing if
+// the client didn't ask for a 100 (Continue), if one was already sent, or if
+// a final response was already sent.
+func (req *ServerRequest) Continue() error {
+	if !expectsContinue(req.Headers) {
+		return nil
+	}
+	req.continued.Do(func() {
+		if atomic.LoadInt32(&req.responded) != 0 {
+			return
+		}
+		_, req.continueErr = req.Respond(100)
+	})
+	return req.continueErr
+}
+
+// RespondWith sends a complete response, using the contents of body for the
+// response body.  If copying the body fails, the response is cancelled.
+func (req *ServerRequest) RespondWith(statusCode int, body io.Reader, headers ...hc.HeaderField) error {
+	if statusCode/100 == 1 {
+		return ErrInformationalBody
+	}
+	resp, err := req.Respond(statusCode, headers...)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(resp, body)
+	if err != nil {
+		resp.Cancel()
+		return err
+	}
+	return resp.Close()
 }
 
-// Push creates a new server push.
+// Push creates a new server push.  This returns ErrNoPushID if the client
+// hasn't authorized another push.
 func (req *ServerRequest) Push(method string, target string, headers ...hc.HeaderField) (*ServerPushRequest, error) {
 	err := hc.ValidatePseudoHeaders(headers)
 	if err != nil {
@@ -126,6 +257,9 @@ func (req *ServerRequest) Push(method string, target string, headers ...hc.Heade
 	}
 
 	err = req.writePushPromise(push)
+	if err != nil {
+		return nil, err
+	}
 	return push, nil
 }
 
@@ -172,8 +306,31 @@ func (resp *ServerResponse) ReferencePush(push *ServerPushRequest) error {
 	return resp.Request.ReferencePush(push)
 }
 
+// finish tells the connection that the request is complete.  Push responses
+// don't count toward the requests on a connection.
+func (resp *ServerResponse) finish() {
+	if resp.PushRequest == nil {
+		resp.Request.finish()
+	} else {
+		resp.PushRequest.C.removePushStream(resp.PushRequest.PushID)
+	}
+}
+
+// End writes any trailers and closes the response.
+func (resp *ServerResponse) End(trailers []hc.HeaderField) error {
+	defer resp.finish()
+	return resp.OutgoingMessage.End(trailers)
+}
+
+// Close closes the response.
+func (resp *ServerResponse) Close() error {
+	defer resp.finish()
+	return resp.OutgoingMessage.Close()
+}
+
 // Cancel cancels the server response.
 func (resp *ServerResponse) Cancel() error {
+	defer resp.finish()
 	return resp.s.Reset(uint16(ErrHttpRequestCancelled))
 }
 
@@ -208,10 +365,24 @@ func (push *ServerPushRequest) Respond(statusCode int, headers ...hc.HeaderField
 	if err != nil {
 		return nil, err
 	}
-	return push.Request.sendResponse(statusCode, headers, s, push)
+	// The client might have cancelled the push while the stream was opened.
+	if !push.C.addPushStream(push.PushID, s) {
+		s.Reset(uint16(ErrHttpRequestCancelled))
+		return nil, ErrPushCancelled
+	}
+	resp, err := push.Request.sendResponse(statusCode, headers, s, push)
+	if err != nil {
+		push.C.removePushStream(push.PushID)
+	}
+	return resp, err
 }
 
 // Cancel abandons a push.
 func (push *ServerPushRequest) Cancel() error {
 	return push.C.cancelPush(push.PushID)
 }
+
+// Cancelled returns true if the push was cancelled by either endpoint.
+func (push *ServerPushRequest) Cancelled() bool {
+	return push.C.pushCancelled(push.PushID)
+}
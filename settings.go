@@ -16,15 +16,28 @@ type settingType uint16
 
 const (
 	settingTableSize              = settingType(1)
-	settingMaxHeaderListSize      = settingType(6) // TODO implement
+	settingMaxHeaderListSize      = settingType(6)
 	settingMaxQpackBlockedStreams = settingType(7)
+	// settingQpackEncoderCapacity is the capacity that the sender intends to
+	// use in its encoder.  This isn't a standard setting.
+	settingQpackEncoderCapacity = settingType(0x20)
 )
 
+// encoderCapacity determines the capacity that an encoder uses given the
+// capacity of the decoder and the capacity that the encoder wants to use.
+// A zero intent means that the encoder doesn't have a preference.
+func encoderCapacity(decoder hc.TableCapacity, intent hc.TableCapacity) hc.TableCapacity {
+	if intent > 0 && intent < decoder {
+		return intent
+	}
+	return decoder
+}
+
 type settingsWriter struct {
 	config *Config
 }
 
-// WriteTo writes out just one integer setting for the moment.
+// WriteTo writes out the settings from the configuration.
 func (sw *settingsWriter) WriteTo(w io.Writer) (written int64, err error) {
 	fw := NewFrameWriter(w)
 	n, err := sw.writeIntSetting(fw, settingTableSize,
@@ -36,6 +49,22 @@ func (sw *settingsWriter) WriteTo(w io.Writer) (written int64, err error) {
 	n, err = sw.writeIntSetting(fw, settingMaxQpackBlockedStreams,
 		uint64(sw.config.ConcurrentDecoders))
 	written += n
+	if err != nil {
+		return
+	}
+	if sw.config.MaxHeaderListSize > 0 {
+		n, err = sw.writeIntSetting(fw, settingMaxHeaderListSize,
+			sw.config.MaxHeaderListSize)
+		written += n
+		if err != nil {
+			return
+		}
+	}
+	if sw.config.EncoderTableCapacity > 0 {
+		n, err = sw.writeIntSetting(fw, settingQpackEncoderCapacity,
+			uint64(sw.config.EncoderTableCapacity))
+		written += n
+	}
 	return
 }
 
@@ -85,7 +114,22 @@ func (sr *settingsReader) readSettings(r FrameReader) error {
 			if n >= 1<<30 {
 				return ErrSettingValue
 			}
-			sr.c.encoder.SetCapacity(hc.TableCapacity(n))
+			err = sr.c.encoder.SetMaxCapacity(hc.TableCapacity(n))
+			if err != nil {
+				return err
+			}
+			err = sr.c.encoder.SetCapacity(encoderCapacity(hc.TableCapacity(n),
+				sr.c.config.EncoderTableCapacity))
+			if err != nil {
+				return err
+			}
+
+		case settingMaxHeaderListSize:
+			n, err := lr.ReadVarint()
+			if err != nil {
+				return err
+			}
+			sr.c.encoder.SetMaxHeaderListSize(n)
 
 		case settingMaxQpackBlockedStreams:
 			n, err := lr.ReadVarint()
@@ -97,6 +141,21 @@ func (sr *settingsReader) readSettings(r FrameReader) error {
 			}
 			sr.c.encoder.SetMaxBlockedStreams(int(n))
 
+		case settingQpackEncoderCapacity:
+			n, err := lr.ReadVarint()
+			if err != nil {
+				return err
+			}
+			if n >= 1<<30 {
+				return ErrSettingValue
+			}
+			// The peer encoder uses the smaller of this and our advertised
+			// capacity, so the decoder table can be sized to match.  The
+			// encoder sends the same capacity on the encoder stream, so it
+			// doesn't matter which of these arrives first.
+			sr.c.decoder.Table.SetCapacity(encoderCapacity(sr.c.config.DecoderTableCapacity,
+				hc.TableCapacity(n)))
+
 		default:
 			_, err = io.Copy(ioutil.Discard, lr)
 		}
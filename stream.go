@@ -1,9 +1,17 @@
 package minhq
 
 import (
+	"errors"
+	"io"
+	"sync"
+
 	"github.com/ekr/minq"
+	"github.com/martinthomson/minhq/mw"
 )
 
+// ErrStreamStopped is returned when reading from a stream after StopSending.
+var ErrStreamStopped = errors.New("Reading from the stream was stopped")
+
 type stream struct {
 	sendStream
 	recvStream
@@ -11,10 +19,10 @@ type stream struct {
 
 var _ minq.Stream = &stream{}
 
-func newStream(s minq.Stream) *stream {
+func newStream(s minq.Stream, closed <-chan struct{}) *stream {
 	return &stream{
 		sendStream: sendStream{NewFrameWriter(s), s},
-		recvStream: recvStream{NewFrameReader(s), s},
+		recvStream: *newRecvStream(s, closed),
 	}
 }
 
@@ -25,8 +33,13 @@ func (s *stream) Id() uint64 {
 
 // abort is the option of last resort.
 func (s *stream) abort() {
-	s.Reset(uint16(ErrHttpInternalError))
-	s.StopSending(uint16(ErrHttpInternalError))
+	s.cancel(ErrHttpInternalError)
+}
+
+// cancel resets the stream and stops reading from it.
+func (s *stream) cancel(code HTTPError) {
+	s.Reset(uint16(code))
+	s.StopSending(uint16(code))
 }
 
 type sendStream struct {
@@ -44,17 +57,117 @@ func (s *sendStream) Write(p []byte) (int, error) {
 	return s.FrameWriter.Write(p)
 }
 
+// Close is needed to resolve an ambiguity between FrameWriter and
+// minq.SendStream.  The stream is what needs closing.
+func (s *sendStream) Close() error {
+	return s.SendStream.Close()
+}
+
+// pausableReader holds off reads while it is paused.  Reads that are already
+// in progress when the reader is paused complete, but the data isn't released
+// to the caller until the reader is resumed.  A paused read fails if the reader
+// is stopped or the connection closes.
+type pausableReader struct {
+	r io.Reader
+	// closed is closed when the connection closes.
+	closed <-chan struct{}
+	lock   sync.Mutex
+	// resume is closed to resume reading; it is nil unless paused.
+	resume chan struct{}
+	// stopped is closed when the reader stops, after which reads fail with err.
+	stopped chan struct{}
+	err     error
+}
+
+func newPausableReader(r io.Reader, closed <-chan struct{}) *pausableReader {
+	return &pausableReader{r: r, closed: closed, stopped: make(chan struct{})}
+}
+
+func (pr *pausableReader) wait() error {
+	pr.lock.Lock()
+	resume := pr.resume
+	pr.lock.Unlock()
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-pr.stopped:
+		case <-pr.closed:
+			pr.stop(mw.ErrConnectionClosed)
+		}
+	}
+
+	defer pr.lock.Unlock()
+	pr.lock.Lock()
+	return pr.err
+}
+
+func (pr *pausableReader) Read(p []byte) (int, error) {
+	err := pr.wait()
+	if err != nil {
+		return 0, err
+	}
+	n, err := pr.r.Read(p)
+	if werr := pr.wait(); werr != nil {
+		return 0, werr
+	}
+	return n, err
+}
+
+func (pr *pausableReader) setPaused(paused bool) {
+	defer pr.lock.Unlock()
+	pr.lock.Lock()
+	if paused && pr.resume == nil {
+		pr.resume = make(chan struct{})
+	} else if !paused && pr.resume != nil {
+		close(pr.resume)
+		pr.resume = nil
+	}
+}
+
+// stop causes all reads to fail with the given error, including any that are
+// waiting for the reader to be resumed.
+func (pr *pausableReader) stop(err error) {
+	defer pr.lock.Unlock()
+	pr.lock.Lock()
+	if pr.err == nil {
+		pr.err = err
+		close(pr.stopped)
+	}
+}
+
 type recvStream struct {
 	FrameReader
 	minq.RecvStream
+	pause *pausableReader
 }
 
 var _ minq.RecvStream = &recvStream{}
 
-func newRecvStream(s minq.RecvStream) *recvStream {
-	return &recvStream{NewFrameReader(s), s}
+func newRecvStream(s minq.RecvStream, closed <-chan struct{}) *recvStream {
+	pause := newPausableReader(s, closed)
+	return &recvStream{NewFrameReader(pause), s, pause}
 }
 
 func (s *recvStream) Read(p []byte) (int, error) {
 	return s.FrameReader.Read(p)
 }
+
+// Pause stops reading from the stream.  Any goroutine reading from the stream
+// blocks until Resume is called, StopSending is called, or the connection
+// closes.  Because nothing is read from the underlying
+// stream, flow control will eventually stop the peer from sending more.
+func (s *recvStream) Pause() {
+	s.pause.setPaused(true)
+}
+
+// StopSending tells the peer to stop sending.  Reading from the stream fails
+// from here on, which releases any goroutine waiting on a paused stream.
+func (s *recvStream) StopSending(code uint16) error {
+	s.pause.stop(ErrStreamStopped)
+	return s.RecvStream.StopSending(code)
+}
+
+// Resume allows reading from a paused stream to continue.
+func (s *recvStream) Resume() {
+	s.pause.setPaused(false)
+}